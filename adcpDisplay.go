@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/ricorx7/go-rti"
@@ -19,12 +21,27 @@ const (
 	profileC3ID       = "ProfileC3Data"
 	profileEpochID    = "ProfileEpochData"
 	hprID             = "HprData"
+	bottomTrackID     = "BottomTrackData"
+	velProfileID      = "VelProfileData"
+	dischargeID       = "DischargeData"
+	wavesID           = "WavesData"
+	waveSpectrumID    = "WaveSpectrumData"
 )
 
+// beamColors are the colors of the beam series.
+var beamColors = []string{"#ff7f0e", "#2ca02c", "#7777ff", "#d67777", "#9467bd", "#8c564b", "#e377c2", "#17becf"}
+
+// beamColor will get the color of the beam's series.
+// The colors repeat if there are more beams than colors.
+func beamColor(beam int) string {
+	return beamColors[beam%len(beamColors)]
+}
+
 // adcp will store all the ADCP it is monitoring and also the last ensemble.
 type adcpList struct {
-	ID            string   // Data ID
-	SerialNumList []string // List of Serial number
+	ID               string              // Data ID
+	SerialNumList    []string            // List of Serial number
+	SubsystemConfigs map[string][]string // Active subsystem configurations for each serial number
 }
 
 // adcp will store the last ensemble.
@@ -32,19 +49,30 @@ type adcpEnsemble struct {
 	ID              string       // Data ID
 	SerialNum       string       // Serial number
 	SubsystemConfig string       // Subsystem configuration
+	Replay          bool         // Flag if the data is from a replay
+	Average         bool         // Flag if the data is averaged
 	Ens             rti.Ensemble // Last ensemble
 }
 
-// velBeamData will store the beam velocity data.
+// velBeamData will store the beam velocity data.  The values of each
+// ensemble in the window follow each other, bin by bin.  Bad velocities
+// are null so the display can blank them.
 type velBeamData struct {
-	ID              string    // Data ID
-	SerialNum       string    // Serial Number
-	SubsystemConfig string    // Subystem configuration
-	Labels          []string  // Seprate each ensemble's data with this label
-	Beam0Vel        []float32 // Beam 0 velocity
-	Beam1Vel        []float32 // Beam 1 velocity
-	Beam2Vel        []float32 // Beam 2 velocity
-	Beam3Vel        []float32 // Beam 3 velocity
+	ID              string       // Data ID
+	SerialNum       string       // Serial Number
+	SubsystemConfig string       // Subystem configuration
+	Replay          bool         // Flag if the data is from a replay
+	Average         bool         // Flag if the data is averaged
+	Labels          []string     // Seprate each ensemble's data with this label
+	Keys            []string     // Key of each beam
+	Colors          []string     // Color of each beam
+	BeamVel         [][]*float32 // Velocity of each beam
+}
+
+// velBeamEnsemble is the beam velocity of an ensemble in the window.
+type velBeamEnsemble struct {
+	label string      // Ensemble label
+	vel   [][]float32 // Velocity [bin][beam]
 }
 
 // profileBeamData will store the data for a bin.
@@ -63,28 +91,35 @@ type timeSeriesData struct {
 	Area   bool        `json:"area"`   // Flag if data should be area plot
 }
 
+// add will add the point to the time series.  The oldest points
+// are removed to keep only window points.
+func (series *timeSeriesData) add(x float32, y float32, window int) {
+	series.Values = append(series.Values, []float32{x, y})
+	if window > 0 && len(series.Values) > window {
+		series.Values = series.Values[len(series.Values)-window:]
+	}
+}
+
 // profileData will store the profile data.
 type profileData struct {
 	ID        string            // Data ID
 	SerialNum string            // Serial Number
 	CepoIndex uint8             // Subystem configuration
+	Replay    bool              // Flag if the data is from a replay
+	Average   bool              // Flag if the data is averaged
 	AmpData   []profileBeamData // Array of all the Amplitude series
 	CorrData  []profileBeamData // Array of all the Correlation series
 }
 
 // profileRickshawData will store the profile data.
 type profileRickshawData struct {
-	ID         string           // Data ID
-	SerialNum  string           // Serial Number
-	CepoIndex  uint8            // Subystem configuration
-	AmpB0Data  lineRickshawData // Array of all the Amplitude B0 series
-	AmpB1Data  lineRickshawData // Array of all the Amplitude B1 series
-	AmpB2Data  lineRickshawData // Array of all the Amplitude B2 series
-	AmpB3Data  lineRickshawData // Array of all the Amplitude B3 series
-	CorrB0Data lineRickshawData // Array of all the Correlation B0 series
-	CorrB1Data lineRickshawData // Array of all the Correlation B1 series
-	CorrB2Data lineRickshawData // Array of all the Correlation B2 series
-	CorrB3Data lineRickshawData // Array of all the Correlation B3 series
+	ID        string             // Data ID
+	SerialNum string             // Serial Number
+	CepoIndex uint8              // Subystem configuration
+	Replay    bool               // Flag if the data is from a replay
+	Average   bool               // Flag if the data is averaged
+	AmpData   []lineRickshawData // Array of the Amplitude series of each beam
+	CorrData  []lineRickshawData // Array of the Correlation series of each beam
 }
 
 // pointRickshawData is the point data with x and y.
@@ -101,21 +136,24 @@ type lineRickshawData struct {
 	Area  bool                `json:"area"`  // Flag if data should be area plot
 }
 
+// seriesC3Data is the column of values of a beam.
+type seriesC3Data struct {
+	Values []float32 `json:"values"` // Value of each bin
+	Color  string    `json:"color"`  // Color option
+	Key    string    `json:"key"`    // Data key
+}
+
 // profileC3Data will store the profile data.
 type profileC3Data struct {
-	ID         string    // Data ID
-	SerialNum  string    // Serial Number
-	CepoIndex  uint8     // Subystem configuration
-	AmpXAxis   []float32 // Amplitude X Axis Labels
-	AmpB0Data  []float32 // Array of all the Amplitude B0 series
-	AmpB1Data  []float32 // Array of all the Amplitude B1 series
-	AmpB2Data  []float32 // Array of all the Amplitude B2 series
-	AmpB3Data  []float32 // Array of all the Amplitude B3 series
-	CorrXAxis  []float32 // Correlation X Axis Labels
-	CorrB0Data []float32 // Array of all the Correlation B0 series
-	CorrB1Data []float32 // Array of all the Correlation B1 series
-	CorrB2Data []float32 // Array of all the Correlation B2 series
-	CorrB3Data []float32 // Array of all the Correlation B3 series
+	ID        string         // Data ID
+	SerialNum string         // Serial Number
+	CepoIndex uint8          // Subystem configuration
+	Replay    bool           // Flag if the data is from a replay
+	Average   bool           // Flag if the data is averaged
+	AmpXAxis  []float32      // Amplitude X Axis Labels
+	AmpData   []seriesC3Data // Array of the Amplitude series of each beam
+	CorrXAxis []float32      // Correlation X Axis Labels
+	CorrData  []seriesC3Data // Array of the Correlation series of each beam
 }
 
 // hprData will store the heading, pitch and roll data.
@@ -123,28 +161,38 @@ type hprData struct {
 	ID        string           // Data ID
 	SerialNum string           // Serial Number
 	CepoIndex uint8            // Subystem configuration
+	Replay    bool             // Flag if the data is from a replay
+	Average   bool             // Flag if the data is averaged
 	HprData   []timeSeriesData // Array of all the hpr series
 }
 
-// heading will accumulate the heading values.
-var heading = &timeSeriesData{
-	Color: "#ff7f0e", // Color of the plot
-	Key:   "Heading", // Key for the data
-	Area:  false,     // Flag for area plot
+// bottomTrackData will store the bottom track data.
+type bottomTrackData struct {
+	ID            string           // Data ID
+	SerialNum     string           // Serial Number
+	CepoIndex     uint8            // Subystem configuration
+	Replay        bool             // Flag if the data is from a replay
+	Average       bool             // Flag if the data is averaged
+	RangeData     []timeSeriesData // Array of the range series of each beam
+	EarthVelData  []timeSeriesData // Array of the East, North and Vertical velocity series
+	BoatSpeedData timeSeriesData   // Boat speed series
+	BoatDirData   timeSeriesData   // Boat direction series
 }
 
-// pitch will accumulate the pitch values.
-var pitch = &timeSeriesData{
-	Color: "#2ca02c", // Color of the plot
-	Key:   "Pitch",   // Key for the data
-	Area:  false,     // Flag for area plot
-}
-
-// roll will accumulate the rol values.
-var roll = &timeSeriesData{
-	Color: "#7777ff", // Color of the plot
-	Key:   "Roll",    // Key for the data
-	Area:  false,     // Flag for area plot
+// velProfileData will store the water velocity profile.  The
+// values of each series are [value, depth].  Bad bins are not included.
+type velProfileData struct {
+	ID        string          // Data ID
+	SerialNum string          // Serial Number
+	CepoIndex uint8           // Subystem configuration
+	Replay    bool            // Flag if the data is from a replay
+	Average   bool            // Flag if the data is averaged
+	BinDepth  []float32       // Depth of each bin
+	EastData  profileBeamData // East velocity series
+	NorthData profileBeamData // North velocity series
+	VertData  profileBeamData // Vertical velocity series
+	MagData   profileBeamData // Velocity magnitude series
+	DirData   profileBeamData // Velocity direction series, degrees from North
 }
 
 // pointEpochData is the point data with x and y.
@@ -182,6 +230,8 @@ type profileEpochData struct {
 	ID                   string                    // Data ID
 	SerialNum            string                    // Serial Number
 	CepoIndex            uint8                     // Subystem configuration
+	Replay               bool                      // Flag if the data is from a replay
+	Average              bool                      // Flag if the data is averaged
 	Data                 []seriesEpochData         // Data
 	RealtimeData         []seriesEpochRealtimeData // Realtime data
 	HeatmapMagData       seriesEpochHeatmapData    // Heatmap Magnitude data
@@ -190,49 +240,106 @@ type profileEpochData struct {
 }
 
 // processEnsemble will take the ensemble data and add it to the map.
-// It will then set the latest ensemble.
-func processEnsemble(server *adcpIO, ens rti.Ensemble) {
-	// See if the serial number exist in the map
-	if val, ok := server.adcp[ens.EnsembleData.SerialNumber.SerialNumber]; ok {
-		val.lastEns = ens
+// It will then set the latest ensemble.  Replay is set if the ensemble
+// is from a replayed file.
+func processEnsemble(server *adcpIO, ens rti.Ensemble, replay bool) {
+	// See if the serial number and subsystem configuration exist in the map
+	key := adcpKey(ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens))
+	server.adcpMutex.Lock()
+	data, ok := server.adcp[key]
+	if ok {
+		data.lastEns = ens
 		log.Print("ADCP exist")
 	} else {
-		var data adcp
-		data.lastEns = ens
-		server.adcp[ens.EnsembleData.SerialNumber.SerialNumber] = &data
+		data = newAdcp(ens)
+		server.adcp[key] = data
 		log.Print("ADCP does not exist")
+	}
+	data.lastSeen = time.Now()
+	data.lastReplay = replay
+	data.ensCount++
+	server.adcpMutex.Unlock()
 
-		// Send a new list of ADCP
+	// Send a new list of ADCP
+	if !ok {
 		sendAdcpList()
 	}
 
+	// Send the ensemble to the raw channel
+	sendDisplayData(&data.raw, ens, replay, false)
+
+	// Add to the discharge transect
+	addDischarge(ens, replay)
+
+	// Add to the wave burst
+	addWaves(ens, replay)
+
+	// Average the ensembles and send to the average channel
+	if avgEns, ok := data.average.add(ens); ok {
+		sendDisplayData(&data.avg, avgEns, replay, true)
+	}
+}
+
+// flushAverages will send the partial average of each ADCP averaged by time
+// that has not sent an ensemble for the average time.  Otherwise the last
+// ensembles before the ADCP stops are not shown until it starts again.
+func flushAverages(server *adcpIO, now time.Time) {
+	for _, data := range server.adcp {
+		if data.average.period <= 0 || now.Sub(data.lastSeen) < data.average.period {
+			continue
+		}
+		if avgEns, ok := data.average.flush(); ok {
+			sendDisplayData(&data.avg, avgEns, data.lastReplay, true)
+		}
+	}
+}
+
+// sendDisplayData will send all the display data of the ensemble.  The series
+// accumulate the data of the channel.  Average is set for the average channel.
+func sendDisplayData(series *displaySeries, ens rti.Ensemble, replay bool, average bool) {
 	// Send last ensemble to display
-	sendRawEnsemble(ens)
+	sendRawEnsemble(ens, replay, average)
 
 	// Send Profile data
-	sendProfilePlotData(ens)
+	sendProfilePlotData(ens, replay, average)
 
 	// Send Profile Rickshaw data
-	sendProfileRickshawPlotData(ens)
+	sendProfileRickshawPlotData(ens, replay, average)
 
 	// Send Profile C3 data
-	sendProfileC3PlotData(ens)
+	sendProfileC3PlotData(ens, replay, average)
 
 	// Send Profile Epoch data
-	sendProfileEpochPlotData(ens)
+	sendProfileEpochPlotData(ens, replay, average)
 
 	// Send HPR data
-	sendHprPlotData(ens)
+	sendHprPlotData(series, ens, replay, average)
+
+	// Send Bottom Track data
+	sendBottomTrackPlotData(series, ens, replay, average)
+
+	// Send Velocity Profile data
+	sendVelProfilePlotData(ens, replay, average)
+
+	// Send Beam Velocity data
+	sendVelBeamPlotData(series, ens, replay, average)
+}
+
+// binDepth will get the depth of the bin from the transducer.
+func binDepth(ens rti.Ensemble, bin int) float32 {
+	return ens.AncillaryData.FirstBinRange + (ens.AncillaryData.BinSize * float32(bin))
 }
 
 // sendRawEnsemble will send the ensemble to the registered displays through
 // the websocket connection.
-func sendRawEnsemble(ens rti.Ensemble) {
+func sendRawEnsemble(ens rti.Ensemble, replay bool, average bool) {
 	// Create the data struct
 	adcpEns := &adcpEnsemble{
 		ID:              adcpEnsembleID,                             // ID
 		SerialNum:       ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
-		SubsystemConfig: "",
+		SubsystemConfig: subsystemConfig(ens),                       // Subsystem Config
+		Replay:          replay,                                     // Replay flag
+		Average:         average,                                    // Average flag
 		Ens:             ens,
 	}
 
@@ -244,112 +351,106 @@ func sendRawEnsemble(ens rti.Ensemble) {
 	}
 
 	// Send the data to the display
-	sendDataToDisplays(b)
+	sendAdcpDataToDisplays(adcpEnsembleID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
 }
 
-// sendProfilePlotData will accumulate the amplitude and correlation data
-// to pass to the display.
-func sendProfilePlotData(ens rti.Ensemble) {
-
-	// Create the data struct
-	ampProfileB0 := &profileBeamData{
-		Color: "#ff7f0e", // Color of the plot
-		Key:   "B0",      // Key for the data
-		Area:  false,     // Flag for area plot
-	}
-
-	ampProfileB1 := &profileBeamData{
-		Color: "#2ca02c", // Color of the plot
-		Key:   "B1",      // Key for the data
-		Area:  false,     // Flag for area plot
-	}
-
-	ampProfileB2 := &profileBeamData{
-		Color: "#7777ff", // Color of the plot
-		Key:   "B2",      // Key for the data
-		Area:  false,     // Flag for area plot
-	}
-
-	ampProfileB3 := &profileBeamData{
-		Color: "#d67777", // Color of the plot
-		Key:   "B3",      // Key for the data
-		Area:  false,     // Flag for area plot
-	}
-
-	corrProfileB0 := &profileBeamData{
-		Color: "#ff7f0e", // Color of the plot
-		Key:   "B0",      // Key for the data
-		Area:  false,     // Flag for area plot
-	}
+// beamKey will get the key of the beam's series.
+func beamKey(beam int) string {
+	return "B" + strconv.Itoa(beam)
+}
 
-	corrProfileB1 := &profileBeamData{
-		Color: "#2ca02c", // Color of the plot
-		Key:   "B1",      // Key for the data
-		Area:  false,     // Flag for area plot
+// beamColumns will split the [bin][beam] values into the values of each bin
+// for each beam.  The number of beams is the data set's element multiplier.
+// Missing values are 0.
+func beamColumns(values [][]float32, numBeams int) [][]float32 {
+	columns := make([][]float32, numBeams)
+	for beam := range columns {
+		columns[beam] = make([]float32, len(values))
+		for bin := range values {
+			if beam < len(values[bin]) {
+				columns[beam][bin] = values[bin][beam]
+			}
+		}
 	}
+	return columns
+}
 
-	corrProfileB2 := &profileBeamData{
-		Color: "#7777ff", // Color of the plot
-		Key:   "B2",      // Key for the data
-		Area:  false,     // Flag for area plot
+// profileBeamSeries will create the series of each beam.  The values are [value, bin].
+func profileBeamSeries(values [][]float32, numBeams int) []profileBeamData {
+	series := []profileBeamData{}
+	for beam, column := range beamColumns(values, numBeams) {
+		beamSeries := profileBeamData{
+			Color: beamColor(beam), // Color of the plot
+			Key:   beamKey(beam),   // Key for the data
+			Area:  false,           // Flag for area plot
+		}
+		for bin, value := range column {
+			beamSeries.Values = append(beamSeries.Values, []float32{value, float32(bin)}) // Add the key and value array to array
+		}
+		series = append(series, beamSeries)
 	}
+	return series
+}
 
-	corrProfileB3 := &profileBeamData{
-		Color: "#d67777", // Color of the plot
-		Key:   "B3",      // Key for the data
-		Area:  false,     // Flag for area plot
-	}
+// sendProfilePlotData will accumulate the amplitude and correlation data
+// to pass to the display.
+func sendProfilePlotData(ens rti.Ensemble, replay bool, average bool) {
 
 	profData := &profileData{
 		ID:        profileID,                                  // ID
 		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
 		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		Replay:    replay,                                     // Replay flag
+		Average:   average,                                    // Average flag
 	}
 
-	//for bin := int(ens.AmplitudeData.Base.NumElements - 1); bin >= 0; bin-- {
-	for bin := 0; bin < int(ens.AmplitudeData.Base.NumElements); bin++ {
-		for beam := 0; beam < int(ens.AmplitudeData.Base.ElementMultiplier); beam++ {
-			if beam == 0 {
-				var ampData = []float32{ens.AmplitudeData.Amplitude[bin][beam], float32(bin)} // Create point to hold [key, value]
-				ampProfileB0.Values = append(ampProfileB0.Values, ampData)                    // Add the key and value array to array
-
-				var corrData = []float32{ens.CorrelationData.Correlation[bin][beam], float32(bin)} // Create point to hold [key, value]
-				corrProfileB0.Values = append(corrProfileB0.Values, corrData)                      // Add the key and value array to array
-			}
-			if beam == 1 {
-				var ampData = []float32{ens.AmplitudeData.Amplitude[bin][beam], float32(bin)} // Create point to hold [key, value]
-				ampProfileB1.Values = append(ampProfileB1.Values, ampData)                    // Add the key and value array to array
+	// Set the data of each beam
+	profData.AmpData = profileBeamSeries(ens.AmplitudeData.Amplitude, int(ens.AmplitudeData.Base.ElementMultiplier))
+	profData.CorrData = profileBeamSeries(ens.CorrelationData.Correlation, int(ens.CorrelationData.Base.ElementMultiplier))
 
-				var corrData = []float32{ens.CorrelationData.Correlation[bin][beam], float32(bin)} // Create point to hold [key, value]
-				corrProfileB1.Values = append(corrProfileB1.Values, corrData)                      // Add the key and value array to array
-			}
-			if beam == 2 {
-				var ampData = []float32{ens.AmplitudeData.Amplitude[bin][beam], float32(bin)} // Create point to hold [key, value]
-				ampProfileB2.Values = append(ampProfileB2.Values, ampData)                    // Add the key and value array to array
+	// Convert the JSON to byte array
+	b, err := json.Marshal(profData)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-				var corrData = []float32{ens.CorrelationData.Correlation[bin][beam], float32(bin)} // Create point to hold [key, value]
-				corrProfileB2.Values = append(corrProfileB2.Values, corrData)                      // Add the key and value array to array
-			}
-			if beam == 3 {
-				var ampData = []float32{ens.AmplitudeData.Amplitude[bin][beam], float32(bin)} // Create point to hold [key, value]
-				ampProfileB3.Values = append(ampProfileB3.Values, ampData)                    // Add the key and value array to array
+	// Send the data to the display
+	sendAdcpDataToDisplays(profileID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
+}
 
-				var corrData = []float32{ens.CorrelationData.Correlation[bin][beam], float32(bin)} // Create point to hold [key, value]
-				corrProfileB3.Values = append(corrProfileB3.Values, corrData)                      // Add the key and value array to array
-			}
+// rickshawBeamSeries will create the line of each beam.  The points are x value and y bin.
+func rickshawBeamSeries(values [][]float32, numBeams int) []lineRickshawData {
+	series := []lineRickshawData{}
+	for beam, column := range beamColumns(values, numBeams) {
+		line := lineRickshawData{
+			Color: beamColor(beam), // Color of the plot
+			Key:   beamKey(beam),   // Key for the data
+			Area:  false,           // Flag for area plot
 		}
+		for bin, value := range column {
+			line.Data = append(line.Data, pointRickshawData{X: value, Y: float32(bin)}) // Create point to hold [key, value]
+		}
+		series = append(series, line)
 	}
+	return series
+}
 
-	// Set the data
-	profData.AmpData = append(profData.AmpData, *ampProfileB0)
-	profData.AmpData = append(profData.AmpData, *ampProfileB1)
-	profData.AmpData = append(profData.AmpData, *ampProfileB2)
-	profData.AmpData = append(profData.AmpData, *ampProfileB3)
+// sendProfileRickshawPlotData will accumulate the amplitude and correlation data
+// to pass to the display.
+func sendProfileRickshawPlotData(ens rti.Ensemble, replay bool, average bool) {
 
-	profData.CorrData = append(profData.CorrData, *corrProfileB0)
-	profData.CorrData = append(profData.CorrData, *corrProfileB1)
-	profData.CorrData = append(profData.CorrData, *corrProfileB2)
-	profData.CorrData = append(profData.CorrData, *corrProfileB3)
+	profData := &profileRickshawData{
+		ID:        profileRickshawID,                          // ID
+		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
+		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		Replay:    replay,                                     // Replay flag
+		Average:   average,                                    // Average flag
+	}
+
+	// Set the line of each beam
+	profData.AmpData = rickshawBeamSeries(ens.AmplitudeData.Amplitude, int(ens.AmplitudeData.Base.ElementMultiplier))
+	profData.CorrData = rickshawBeamSeries(ens.CorrelationData.Correlation, int(ens.CorrelationData.Base.ElementMultiplier))
 
 	// Convert the JSON to byte array
 	b, err := json.Marshal(profData)
@@ -359,221 +460,307 @@ func sendProfilePlotData(ens rti.Ensemble) {
 	}
 
 	// Send the data to the display
-	sendDataToDisplays(b)
+	sendAdcpDataToDisplays(profileRickshawID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
 }
 
-// sendProfileRickshawPlotData will accumulate the amplitude and correlation data
+// c3BeamSeries will create the column of each beam.
+func c3BeamSeries(values [][]float32, numBeams int) []seriesC3Data {
+	series := []seriesC3Data{}
+	for beam, column := range beamColumns(values, numBeams) {
+		series = append(series, seriesC3Data{
+			Color:  beamColor(beam), // Color of the plot
+			Key:    beamKey(beam),   // Key for the data
+			Values: column,          // Value of each bin
+		})
+	}
+	return series
+}
+
+// sendProfileC3PlotData will accumulate the amplitude and correlation data
 // to pass to the display.
-func sendProfileRickshawPlotData(ens rti.Ensemble) {
+func sendProfileC3PlotData(ens rti.Ensemble, replay bool, average bool) {
 
-	// Create the data struct
-	ampProfileB0 := &lineRickshawData{
-		Color: "#ff7f0e", // Color of the plot
-		Key:   "B0",      // Key for the data
-		Area:  false,     // Flag for area plot
+	profData := &profileC3Data{
+		ID:        profileC3ID,                                // ID
+		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
+		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		Replay:    replay,                                     // Replay flag
+		Average:   average,                                    // Average flag
+		AmpXAxis:  []float32{},                                // Bin of each amplitude value
+		CorrXAxis: []float32{},                                // Depth of each correlation value
 	}
 
-	ampProfileB1 := &lineRickshawData{
-		Color: "#2ca02c", // Color of the plot
-		Key:   "B1",      // Key for the data
-		Area:  false,     // Flag for area plot
+	// X Axis for each bin
+	for bin := range ens.AmplitudeData.Amplitude {
+		profData.AmpXAxis = append(profData.AmpXAxis, float32(bin))
 	}
-
-	ampProfileB2 := &lineRickshawData{
-		Color: "#7777ff", // Color of the plot
-		Key:   "B2",      // Key for the data
-		Area:  false,     // Flag for area plot
+	for bin := range ens.CorrelationData.Correlation {
+		profData.CorrXAxis = append(profData.CorrXAxis, binDepth(ens, bin))
 	}
 
-	ampProfileB3 := &lineRickshawData{
-		Color: "#d67777", // Color of the plot
-		Key:   "B3",      // Key for the data
-		Area:  false,     // Flag for area plot
+	// Set the column of each beam
+	profData.AmpData = c3BeamSeries(ens.AmplitudeData.Amplitude, int(ens.AmplitudeData.Base.ElementMultiplier))
+	profData.CorrData = c3BeamSeries(ens.CorrelationData.Correlation, int(ens.CorrelationData.Base.ElementMultiplier))
+
+	// Convert the JSON to byte array
+	b, err := json.Marshal(profData)
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
-	corrProfileB0 := &lineRickshawData{
-		Color: "#ff7f0e", // Color of the plot
-		Key:   "B0",      // Key for the data
-		Area:  false,     // Flag for area plot
+	// Send the data to the display
+	sendAdcpDataToDisplays(profileC3ID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
+}
+
+// sendVelBeamPlotData will accumulate the beam velocity data of the ADCP
+// to pass to the display.
+func sendVelBeamPlotData(series *displaySeries, ens rti.Ensemble, replay bool, average bool) {
+	if len(ens.BeamVelocityData.Velocity) == 0 {
+		return
 	}
 
-	corrProfileB1 := &lineRickshawData{
-		Color: "#2ca02c", // Color of the plot
-		Key:   "B1",      // Key for the data
-		Area:  false,     // Flag for area plot
+	// Accumulate the ensemble
+	series.velBeam = append(series.velBeam, velBeamEnsemble{
+		label: strconv.Itoa(int(ens.EnsembleData.EnsembleNumber)), // Ensemble number
+		vel:   ens.BeamVelocityData.Velocity,                      // Beam velocity
+	})
+	if *beamWindow > 0 && len(series.velBeam) > *beamWindow {
+		series.velBeam = series.velBeam[len(series.velBeam)-*beamWindow:]
 	}
 
-	corrProfileB2 := &lineRickshawData{
-		Color: "#7777ff", // Color of the plot
-		Key:   "B2",      // Key for the data
-		Area:  false,     // Flag for area plot
+	// Find the most beams in the window
+	numBeams := 0
+	for _, velEns := range series.velBeam {
+		for _, bin := range velEns.vel {
+			if len(bin) > numBeams {
+				numBeams = len(bin)
+			}
+		}
 	}
 
-	corrProfileB3 := &lineRickshawData{
-		Color: "#d67777", // Color of the plot
-		Key:   "B3",      // Key for the data
-		Area:  false,     // Flag for area plot
+	velData := &velBeamData{
+		ID:              velBeamDataID,                              // ID
+		SerialNum:       ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
+		SubsystemConfig: subsystemConfig(ens),                       // Subsystem Config
+		Replay:          replay,                                     // Replay flag
+		Average:         average,                                    // Average flag
+		BeamVel:         make([][]*float32, numBeams),               // Velocity of each beam
+	}
+	for beam := 0; beam < numBeams; beam++ {
+		velData.Keys = append(velData.Keys, beamKey(beam))
+		velData.Colors = append(velData.Colors, beamColor(beam))
+	}
+
+	// Add each bin of each ensemble.  Bad and missing velocities are null.
+	for _, velEns := range series.velBeam {
+		for bin := range velEns.vel {
+			velData.Labels = append(velData.Labels, velEns.label)
+			for beam := 0; beam < numBeams; beam++ {
+				var value *float32
+				if beam < len(velEns.vel[bin]) && velEns.vel[bin][beam] != rtiBadVelocity {
+					value = &velEns.vel[bin][beam]
+				}
+				velData.BeamVel[beam] = append(velData.BeamVel[beam], value)
+			}
+		}
 	}
 
-	profData := &profileRickshawData{
-		ID:        profileRickshawID,                          // ID
-		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
-		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+	// Convert the JSON to byte array
+	b, err := json.Marshal(velData)
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
-	//for bin := int(ens.AmplitudeData.Base.NumElements - 1); bin >= 0; bin-- {
-	for bin := 0; bin < int(ens.AmplitudeData.Base.NumElements); bin++ {
-		for beam := 0; beam < int(ens.AmplitudeData.Base.ElementMultiplier); beam++ {
-			if beam == 0 {
-				ampData := pointRickshawData{X: ens.AmplitudeData.Amplitude[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				ampProfileB0.Data = append(ampProfileB0.Data, ampData)                                   // Add the key and value array to array
+	// Send the data to the display
+	sendAdcpDataToDisplays(velBeamDataID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
+}
 
-				corrData := pointRickshawData{X: ens.CorrelationData.Correlation[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				corrProfileB0.Data = append(corrProfileB0.Data, corrData)                                     // Add the key and value array to array
-			}
-			if beam == 1 {
-				ampData := pointRickshawData{X: ens.AmplitudeData.Amplitude[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				ampProfileB1.Data = append(ampProfileB1.Data, ampData)                                   // Add the key and value array to array
+// sendHprPlotData will accumulate the heading, pitch and roll data
+// of the ADCP to pass to the display.
+func sendHprPlotData(series *displaySeries, ens rti.Ensemble, replay bool, average bool) {
 
-				corrData := pointRickshawData{X: ens.CorrelationData.Correlation[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				corrProfileB1.Data = append(corrProfileB1.Data, corrData)                                     // Add the key and value array to array
-			}
-			if beam == 2 {
-				ampData := pointRickshawData{X: ens.AmplitudeData.Amplitude[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				ampProfileB2.Data = append(ampProfileB2.Data, ampData)                                   // Add the key and value array to array
+	// Accumulate heading
+	series.heading.add(float32(ens.EnsembleData.EnsembleNumber), ens.AncillaryData.Heading, *hprWindow)
 
-				corrData := pointRickshawData{X: ens.CorrelationData.Correlation[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				corrProfileB2.Data = append(corrProfileB2.Data, corrData)                                     // Add the key and value array to array
-			}
-			if beam == 3 {
-				ampData := pointRickshawData{X: ens.AmplitudeData.Amplitude[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				ampProfileB3.Data = append(ampProfileB3.Data, ampData)                                   // Add the key and value array to array
+	// Accumulate pitch
+	series.pitch.add(float32(ens.EnsembleData.EnsembleNumber), ens.AncillaryData.Pitch, *hprWindow)
 
-				corrData := pointRickshawData{X: ens.CorrelationData.Correlation[bin][beam], Y: float32(bin)} // Create point to hold [key, value]
-				corrProfileB3.Data = append(corrProfileB3.Data, corrData)                                     // Add the key and value array to array
-			}
-		}
+	// Accumulate roll
+	series.roll.add(float32(ens.EnsembleData.EnsembleNumber), ens.AncillaryData.Roll, *hprWindow)
+
+	hpr := &hprData{
+		ID:        hprID,                                      // ID
+		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
+		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		Replay:    replay,                                     // Replay flag
+		Average:   average,                                    // Average flag
 	}
 
-	profData.AmpB0Data = *ampProfileB0
-	profData.AmpB1Data = *ampProfileB1
-	profData.AmpB2Data = *ampProfileB2
-	profData.AmpB3Data = *ampProfileB3
-	profData.CorrB0Data = *corrProfileB0
-	profData.CorrB1Data = *corrProfileB1
-	profData.CorrB2Data = *corrProfileB2
-	profData.CorrB3Data = *corrProfileB3
+	hpr.HprData = append(hpr.HprData, series.heading)
+	hpr.HprData = append(hpr.HprData, series.pitch)
+	hpr.HprData = append(hpr.HprData, series.roll)
 
 	// Convert the JSON to byte array
-	b, err := json.Marshal(profData)
+	b, err := json.Marshal(hpr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	// Send the data to the display
-	sendDataToDisplays(b)
+	sendAdcpDataToDisplays(hprID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
 }
 
-// sendProfileC3PlotData will accumulate the amplitude and correlation data
-// to pass to the display.
-func sendProfileC3PlotData(ens rti.Ensemble) {
+// sendBottomTrackPlotData will accumulate the bottom track range, earth velocity
+// and boat speed and direction of the ADCP to pass to the display.
+// Bad values are not added to the series.
+func sendBottomTrackPlotData(series *displaySeries, ens rti.Ensemble, replay bool, average bool) {
+	bt := ens.BottomTrackData
+	if bt.Base.NumElements == 0 {
+		return
+	}
+	ensNum := float32(ens.EnsembleData.EnsembleNumber)
 
-	profData := &profileC3Data{
-		ID:        profileC3ID,                                // ID
-		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
-		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+	// Accumulate the range of each beam
+	for beam, btRange := range bt.Range {
+		if beam >= len(series.btRange) {
+			series.btRange = append(series.btRange, timeSeriesData{
+				Color: beamColor(beam), // Color of the plot
+				Key:   beamKey(beam),   // Key for the data
+				Area:  false,           // Flag for area plot
+			})
+		}
+		if btRange > 0 && btRange != rtiBadVelocity {
+			series.btRange[beam].add(ensNum, btRange, *btWindow)
+		}
 	}
 
-	//for bin := int(ens.AmplitudeData.Base.NumElements - 1); bin >= 0; bin-- {
-	for bin := 0; bin < int(ens.AmplitudeData.Base.NumElements); bin++ {
-		// First bin location
-		firstBinLoc := ens.AncillaryData.FirstBinRange + (ens.AncillaryData.BinSize * float32(bin))
-		profData.AmpXAxis = append(profData.AmpXAxis, float32(bin))
-		profData.CorrXAxis = append(profData.CorrXAxis, firstBinLoc)
+	// Accumulate the East, North and Vertical velocity
+	goodVel := len(bt.EarthVelocity) >= 3
+	for i := 0; i < len(series.btEarthVel) && i < len(bt.EarthVelocity); i++ {
+		if bt.EarthVelocity[i] == rtiBadVelocity {
+			goodVel = false
+			continue
+		}
+		series.btEarthVel[i].add(ensNum, bt.EarthVelocity[i], *btWindow)
+	}
 
-		for beam := 0; beam < int(ens.AmplitudeData.Base.ElementMultiplier); beam++ {
-			if beam == 0 {
-				profData.AmpB0Data = append(profData.AmpB0Data, ens.AmplitudeData.Amplitude[bin][beam])
-				profData.CorrB0Data = append(profData.CorrB0Data, ens.CorrelationData.Correlation[bin][beam])
-			}
-			if beam == 1 {
-				profData.AmpB1Data = append(profData.AmpB1Data, ens.AmplitudeData.Amplitude[bin][beam])
-				profData.CorrB1Data = append(profData.CorrB1Data, ens.CorrelationData.Correlation[bin][beam])
-			}
-			if beam == 2 {
-				profData.AmpB2Data = append(profData.AmpB2Data, ens.AmplitudeData.Amplitude[bin][beam])
-				profData.CorrB2Data = append(profData.CorrB2Data, ens.CorrelationData.Correlation[bin][beam])
-			}
-			if beam == 3 {
-				profData.AmpB3Data = append(profData.AmpB3Data, ens.AmplitudeData.Amplitude[bin][beam])
-				profData.CorrB3Data = append(profData.CorrB3Data, ens.CorrelationData.Correlation[bin][beam])
-			}
+	// Accumulate the boat speed and direction.  The boat
+	// moves opposite to the bottom velocity.
+	if goodVel {
+		east := -float64(bt.EarthVelocity[0])
+		north := -float64(bt.EarthVelocity[1])
+		dir := math.Atan2(east, north) * 180 / math.Pi
+		if dir < 0 {
+			dir += 360
 		}
+		series.boatSpeed.add(ensNum, float32(math.Hypot(east, north)), *btWindow)
+		series.boatDir.add(ensNum, float32(dir), *btWindow)
+	}
+
+	btData := &bottomTrackData{
+		ID:            bottomTrackID,                              // ID
+		SerialNum:     ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
+		CepoIndex:     ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		Replay:        replay,                                     // Replay flag
+		Average:       average,                                    // Average flag
+		RangeData:     series.btRange,                             // Range of each beam
+		EarthVelData:  series.btEarthVel,                          // Earth velocity
+		BoatSpeedData: series.boatSpeed,                           // Boat speed
+		BoatDirData:   series.boatDir,                             // Boat direction
 	}
 
 	// Convert the JSON to byte array
-	b, err := json.Marshal(profData)
+	b, err := json.Marshal(btData)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	// Send the data to the display
-	sendDataToDisplays(b)
+	sendAdcpDataToDisplays(bottomTrackID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
 }
 
-// sendHprPlotData will accumulate the heading, pitch and roll data
-// to pass to the display.
-func sendHprPlotData(ens rti.Ensemble) {
-
-	// Accumulate heading
-	heading.Values = append(heading.Values, []float32{float32(ens.EnsembleData.EnsembleNumber), ens.AncillaryData.Heading})
-	if len(heading.Values) > 20 {
-		heading.Values = heading.Values[1:]
+// profileDepth will get the depth of the bin for the velocity profile.
+// The transducer depth is added if selected.
+func profileDepth(ens rti.Ensemble, bin int) float32 {
+	depth := binDepth(ens, bin)
+	if *xdcrDepth {
+		depth += ens.AncillaryData.TransducerDepth
 	}
+	return depth
+}
 
-	// Accumulate pitch
-	pitch.Values = append(pitch.Values, []float32{float32(ens.EnsembleData.EnsembleNumber), ens.AncillaryData.Pitch})
-	if len(pitch.Values) > 20 {
-		pitch.Values = pitch.Values[1:]
+// sendVelProfilePlotData will create the East, North and Vertical velocity,
+// magnitude and direction profiles against depth to pass to the display.
+// Bad velocities are not added to the profiles.
+func sendVelProfilePlotData(ens rti.Ensemble, replay bool, average bool) {
+	vel := ens.EarthVelocityData.Velocity
+	if len(vel) == 0 {
+		return
 	}
 
-	// Accumulate roll
-	roll.Values = append(roll.Values, []float32{float32(ens.EnsembleData.EnsembleNumber), ens.AncillaryData.Roll})
-	if len(roll.Values) > 20 {
-		roll.Values = roll.Values[1:]
-	}
+	profData := &velProfileData{
+		ID:        velProfileID,                                                        // ID
+		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber,                          // Serial Data
+		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex,                          // Subsystem Config
+		Replay:    replay,                                                              // Replay flag
+		Average:   average,                                                             // Average flag
+		EastData:  profileBeamData{Color: beamColor(0), Key: "East", Area: false},      // East velocity
+		NorthData: profileBeamData{Color: beamColor(1), Key: "North", Area: false},     // North velocity
+		VertData:  profileBeamData{Color: beamColor(2), Key: "Vertical", Area: false},  // Vertical velocity
+		MagData:   profileBeamData{Color: beamColor(0), Key: "Magnitude", Area: false}, // Velocity magnitude
+		DirData:   profileBeamData{Color: beamColor(1), Key: "Direction", Area: false}, // Velocity direction
+	}
+
+	vectors := earthVelocityVectors(vel)
+	for bin := range vel {
+		depth := profileDepth(ens, bin)
+		profData.BinDepth = append(profData.BinDepth, depth)
+
+		// East, North and Vertical velocity
+		series := []*profileBeamData{&profData.EastData, &profData.NorthData, &profData.VertData}
+		for i := 0; i < len(series) && i < len(vel[bin]); i++ {
+			if vel[bin][i] != rtiBadVelocity {
+				series[i].Values = append(series[i].Values, []float32{vel[bin][i], depth})
+			}
+		}
 
-	hpr := &hprData{
-		ID:        hprID,                                      // ID
-		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
-		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		// Magnitude and direction
+		if vectors[bin].Magnitude == rtiBadVelocity {
+			continue
+		}
+		dir := vectors[bin].DirectionYNorth
+		if dir < 0 {
+			dir += 360
+		}
+		profData.MagData.Values = append(profData.MagData.Values, []float32{float32(vectors[bin].Magnitude), depth})
+		profData.DirData.Values = append(profData.DirData.Values, []float32{float32(dir), depth})
 	}
 
-	hpr.HprData = append(hpr.HprData, *heading)
-	hpr.HprData = append(hpr.HprData, *pitch)
-	hpr.HprData = append(hpr.HprData, *roll)
-
 	// Convert the JSON to byte array
-	b, err := json.Marshal(hpr)
+	b, err := json.Marshal(profData)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	// Send the data to the display
-	sendDataToDisplays(b)
+	sendAdcpDataToDisplays(velProfileID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
 }
 
 // sendProfileEpochPlotData will accumulate the amplitude and correlation data
 // to pass to the display.
-func sendProfileEpochPlotData(ens rti.Ensemble) {
+func sendProfileEpochPlotData(ens rti.Ensemble, replay bool, average bool) {
 
 	profData := &profileEpochData{
 		ID:        profileEpochID,                             // ID
 		SerialNum: ens.EnsembleData.SerialNumber.SerialNumber, // Serial Data
 		CepoIndex: ens.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		Replay:    replay,                                     // Replay flag
+		Average:   average,                                    // Average flag
 	}
 
 	// Get the time
@@ -603,7 +790,11 @@ func sendProfileEpochPlotData(ens rti.Ensemble) {
 	profData.HeatmapDirYNorthData.Time = unixTime
 
 	// Set the heatmap data
-	for bin := 0; bin < int(ens.EarthVelocityData.Base.NumElements); bin++ {
+	for bin := 0; bin < int(ens.EarthVelocityData.Base.NumElements) && bin < len(ens.EarthVelocityData.Vectors); bin++ {
+		// Bad and screened bins are left at 0
+		if ens.EarthVelocityData.Vectors[bin].Magnitude == rtiBadVelocity {
+			continue
+		}
 		profData.HeatmapMagData.Histogram[bin] = ens.EarthVelocityData.Vectors[bin].Magnitude
 		profData.HeatmapDirXNorthData.Histogram[bin] = ens.EarthVelocityData.Vectors[bin].DirectionXNorth
 		profData.HeatmapDirYNorthData.Histogram[bin] = ens.EarthVelocityData.Vectors[bin].DirectionYNorth
@@ -617,5 +808,5 @@ func sendProfileEpochPlotData(ens rti.Ensemble) {
 	}
 
 	// Send the data to the display
-	sendDataToDisplays(b)
+	sendAdcpDataToDisplays(profileEpochID, ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens), average, b)
 }
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"encoding/json"
 	"io"
 	"log"
 	"net/http"
@@ -39,8 +40,121 @@ type websocketAdcpDisplay struct {
 	// Buffered channel of outbound messages.
 	send chan []byte
 
-	// ADCP Serial Number to associate with the websocket connection
-	adcpSerialNum string
+	// What the display is subscribed to, all, selected or none
+	subscribeMode int
+
+	// ADCP subscriptions of the display when selected.  Key is the serial
+	// number and subsystem configuration.
+	subscriptions map[string]displayCommand
+}
+
+// Display subscription modes.
+const (
+	subscribeAll      = iota // No commands yet.  The raw channel of every ADCP is sent
+	subscribeSelected        // Only the subscribed ADCP are sent
+	subscribeNone            // Unsubscribed from every ADCP.  Nothing is sent
+)
+
+// Display commands.
+const (
+	subscribeCmd     = "subscribe"     // Subscribe to an ADCP
+	unsubscribeCmd   = "unsubscribe"   // Unsubscribe from an ADCP
+	startTransectCmd = "startTransect" // Start a discharge transect
+	stopTransectCmd  = "stopTransect"  // Stop a discharge transect
+)
+
+// Display data channels.
+const (
+	rawChannel     = "raw"     // Data of each ensemble
+	averageChannel = "average" // Data of the averaged ensembles
+	allChannel     = "all"     // Data of each ensemble and the averaged ensembles
+)
+
+// displayCommand is a JSON command sent from the display.
+type displayCommand struct {
+	Cmd             string   // Command
+	SerialNum       string   // Serial number
+	SubsystemConfig string   // Subsystem configuration.  Empty for all configurations
+	IDs             []string // Data IDs to send.  Empty for all data
+	Channel         string   // Data channel to send, raw, average or all.  Empty for raw
+	EdgeDistance    float32  // Distance in meters to the bank for the transect commands
+	EdgeShape       string   // Shape of the edge for the transect commands, triangular or rectangular
+}
+
+// adcpDisplayCommand is the command and the display that sent it.
+type adcpDisplayCommand struct {
+	conn *websocketAdcpDisplay // Display connection
+	cmd  displayCommand        // Command
+}
+
+// handleCommand will process the command from the display.
+func (wsConn *websocketAdcpDisplay) handleCommand(cmd displayCommand) {
+	switch cmd.Cmd {
+	case subscribeCmd:
+		wsConn.subscribeMode = subscribeSelected
+		wsConn.subscriptions[adcpKey(cmd.SerialNum, cmd.SubsystemConfig)] = cmd
+	case unsubscribeCmd:
+		if cmd.SerialNum == "" {
+			// Unsubscribe from all the ADCP
+			wsConn.subscriptions = make(map[string]displayCommand)
+		} else {
+			delete(wsConn.subscriptions, adcpKey(cmd.SerialNum, cmd.SubsystemConfig))
+		}
+
+		// Unsubscribing the last ADCP sends nothing, not everything
+		if len(wsConn.subscriptions) == 0 {
+			wsConn.subscribeMode = subscribeNone
+		}
+	case startTransectCmd:
+		startTransect(cmd)
+	case stopTransectCmd:
+		stopTransect(cmd)
+	default:
+		log.Printf("Unknown display command: %s", cmd.Cmd)
+	}
+}
+
+// wantsChannel will check if the subscription is to the raw or average channel.
+func (cmd displayCommand) wantsChannel(average bool) bool {
+	switch cmd.Channel {
+	case allChannel:
+		return true
+	case averageChannel:
+		return average
+	default:
+		return !average
+	}
+}
+
+// isSubscribed will check if the display wants the data.  Average is set
+// for the averaged data.  If the display has not sent a command, all the
+// data of the raw channel is wanted.  After unsubscribing from every ADCP,
+// nothing is wanted.
+func (wsConn *websocketAdcpDisplay) isSubscribed(id string, serialNum string, subsystemConfig string, average bool) bool {
+	switch wsConn.subscribeMode {
+	case subscribeAll:
+		return !average
+	case subscribeNone:
+		return false
+	}
+
+	// Check the subscriptions for the configuration and all configurations
+	for _, key := range []string{adcpKey(serialNum, subsystemConfig), adcpKey(serialNum, "")} {
+		sub, ok := wsConn.subscriptions[key]
+		if !ok || !sub.wantsChannel(average) {
+			continue
+		}
+		if len(sub.IDs) == 0 {
+			return true
+		}
+		for _, subID := range sub.IDs {
+			if subID == id {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 // reader is a Websocket reader
@@ -71,7 +185,16 @@ func (wsConn *websocketAdcpDisplay) reader() {
 		}
 
 		log.Printf("Websocket message: %d", len(message))
-		//server.broadcast <- message
+
+		// Decode the command
+		var cmd displayCommand
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			log.Print("Err converting JSON: ", err)
+			continue
+		}
+
+		// Pass the command to the server
+		server.adcpDisplayCmd <- adcpDisplayCommand{conn: wsConn, cmd: cmd}
 	}
 
 }
@@ -131,7 +254,7 @@ func wsAdcpDisplayHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Make a async channel to create the websocket connection
 	// This will block until the buffer is full
-	c := &websocketAdcpDisplay{send: make(chan []byte, 256*10), ws: ws}
+	c := &websocketAdcpDisplay{send: make(chan []byte, 256*10), ws: ws, subscriptions: make(map[string]displayCommand)}
 
 	// Register the connection with the server
 	server.registerAdcpDisplay <- c
@@ -0,0 +1,146 @@
+///
+/// JSON REST API to get the ADCP state
+/// without a websocket.
+///
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// apiAdcp is the state of an ADCP serial number and subsystem configuration.
+type apiAdcp struct {
+	SerialNum       string    // Serial number
+	SubsystemConfig string    // Subsystem configuration
+	LastSeen        time.Time // Time the last ensemble was received
+	EnsembleCount   int       // Number of ensembles received
+}
+
+// apiHandler will handle the REST API.
+//
+//	GET /api/adcps                                 List of ADCP
+//	GET /api/adcps/{serial}/latest                 Last ensemble
+//	GET /api/adcps/{serial}/amplitude              Last amplitude data
+//	GET /api/adcps/{serial}/correlation            Last correlation data
+//	GET /api/adcps/{serial}/earthvelocity          Last earth velocity data
+//	GET /api/adcps/{serial}/shipvelocity           Last ship velocity, Starboard, Forward, Up and error velocity
+//	GET /api/adcps/{serial}/ancillary              Last ancillary data
+//
+// The subsystem configuration can be given with ?config=.  If it is not
+// given, the most recent configuration of the serial number is used.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/adcps"), "/")
+	if path == "" {
+		writeJSON(w, apiAdcpList())
+		return
+	}
+
+	// Get the serial number and the data requested
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	ens, ok := apiLastEnsemble(parts[0], r.FormValue("config"))
+	if !ok {
+		http.Error(w, "ADCP not found", http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "latest":
+		writeJSON(w, ens)
+	case "amplitude":
+		writeJSON(w, ens.AmplitudeData)
+	case "correlation":
+		writeJSON(w, ens.CorrelationData)
+	case "earthvelocity":
+		writeJSON(w, ens.EarthVelocityData)
+	case "shipvelocity":
+		writeJSON(w, transform.shipVelocity(ens))
+	case "ancillary":
+		writeJSON(w, ens.AncillaryData)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// apiAdcpList will get the state of all the ADCP.
+func apiAdcpList() []apiAdcp {
+	server.adcpMutex.RLock()
+	defer server.adcpMutex.RUnlock()
+
+	list := []apiAdcp{}
+	for _, val := range server.adcp {
+		list = append(list, apiAdcp{
+			SerialNum:       val.serialNum,
+			SubsystemConfig: val.subsystemConfig,
+			LastSeen:        val.lastSeen,
+			EnsembleCount:   val.ensCount,
+		})
+	}
+
+	// Keep the order the same every time
+	sort.Slice(list, func(i, j int) bool {
+		return adcpKey(list[i].SerialNum, list[i].SubsystemConfig) < adcpKey(list[j].SerialNum, list[j].SubsystemConfig)
+	})
+	return list
+}
+
+// apiLastEnsemble will get the last ensemble of the serial number and
+// subsystem configuration.  If the subsystem configuration is empty,
+// the last ensemble of any configuration is used.
+func apiLastEnsemble(serialNum string, config string) (rti.Ensemble, bool) {
+	server.adcpMutex.RLock()
+	defer server.adcpMutex.RUnlock()
+
+	if config != "" {
+		val, ok := server.adcp[adcpKey(serialNum, config)]
+		if !ok {
+			return rti.Ensemble{}, false
+		}
+		return val.lastEns, true
+	}
+
+	var last *adcp
+	for _, val := range server.adcp {
+		if val.serialNum == serialNum && (last == nil || val.lastSeen.After(last.lastSeen)) {
+			last = val
+		}
+	}
+	if last == nil {
+		return rti.Ensemble{}, false
+	}
+	return last.lastEns, true
+}
+
+// requirePost will check the request is a POST.  If it is not, the
+// error is sent and false is returned.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, r.URL.Path+" must be a POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// writeJSON will write the value as JSON to the response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,251 @@
+///
+/// Average the ensembles of an ADCP for the displays.
+///
+/// The ensembles are accumulated until the number of ensembles or the
+/// time is reached.  When averaging by time, the last partial average
+/// is sent when the ADCP stops sending for the average time.  The earth
+/// velocity is vector averaged, the bad velocities are not included and
+/// the heading is circular averaged.
+///
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// averageFlushInterval is how often the partial averages of the ADCP
+// that stopped sending are checked.
+const averageFlushInterval = time.Second
+
+// ensembleAverager will accumulate the ensembles of an ADCP to average.
+type ensembleAverager struct {
+	count     int            // Number of ensembles to average.  0 to not use
+	period    time.Duration  // Time of the ensembles to average.  0 to not use
+	ensembles []rti.Ensemble // Accumulated ensembles
+}
+
+// newEnsembleAverager will create the averager.  The ensembles are averaged
+// when the count or period is reached.  If both are 0, nothing is averaged.
+func newEnsembleAverager(count int, period time.Duration) *ensembleAverager {
+	return &ensembleAverager{
+		count:  count,  // Number of ensembles to average
+		period: period, // Time of the ensembles to average
+	}
+}
+
+// add will accumulate the ensemble.  When the count or period is reached,
+// the averaged ensemble is returned with true.
+func (a *ensembleAverager) add(ens rti.Ensemble) (rti.Ensemble, bool) {
+	if a.count <= 0 && a.period <= 0 {
+		return rti.Ensemble{}, false
+	}
+
+	// Start again if the bins or beams changed or the time went back
+	if len(a.ensembles) > 0 {
+		first := a.ensembles[0]
+		if len(ens.AmplitudeData.Amplitude) != len(first.AmplitudeData.Amplitude) ||
+			ens.AmplitudeData.Base.ElementMultiplier != first.AmplitudeData.Base.ElementMultiplier ||
+			ensembleTime(ens).Before(ensembleTime(first)) {
+			a.ensembles = nil
+		}
+	}
+	a.ensembles = append(a.ensembles, ens)
+
+	// Check if the count or time is reached
+	full := a.count > 0 && len(a.ensembles) >= a.count
+	if a.period > 0 && ensembleTime(ens).Sub(ensembleTime(a.ensembles[0])) >= a.period {
+		full = true
+	}
+	if !full {
+		return rti.Ensemble{}, false
+	}
+
+	avg := averageEnsembles(a.ensembles)
+	a.ensembles = nil
+	return avg, true
+}
+
+// flush will average the accumulated ensembles before the count or period
+// is reached.  If there are no ensembles, false is returned.
+func (a *ensembleAverager) flush() (rti.Ensemble, bool) {
+	if len(a.ensembles) == 0 {
+		return rti.Ensemble{}, false
+	}
+
+	avg := averageEnsembles(a.ensembles)
+	a.ensembles = nil
+	return avg, true
+}
+
+// averageEnsembles will average the ensembles.  The ensemble number and
+// time are from the last ensemble.  The ping counts are the total.
+func averageEnsembles(ensembles []rti.Ensemble) rti.Ensemble {
+	avg := ensembles[len(ensembles)-1]
+
+	// Profiles
+	avg.AmplitudeData.Amplitude = averageValues(ensembles, false, func(ens rti.Ensemble) [][]float32 { return ens.AmplitudeData.Amplitude })
+	avg.CorrelationData.Correlation = averageValues(ensembles, false, func(ens rti.Ensemble) [][]float32 { return ens.CorrelationData.Correlation })
+	avg.BeamVelocityData.Velocity = averageValues(ensembles, true, func(ens rti.Ensemble) [][]float32 { return ens.BeamVelocityData.Velocity })
+	avg.InstrumentVelocityData.Velocity = averageValues(ensembles, true, func(ens rti.Ensemble) [][]float32 { return ens.InstrumentVelocityData.Velocity })
+
+	// Averaging the East and North components is the vector average
+	avg.EarthVelocityData.Velocity = averageValues(ensembles, true, func(ens rti.Ensemble) [][]float32 { return ens.EarthVelocityData.Velocity })
+	if avg.EarthVelocityData.Velocity != nil {
+		avg.EarthVelocityData.Vectors = earthVelocityVectors(avg.EarthVelocityData.Velocity)
+	}
+
+	// Good pings and ping counts
+	avg.GoodBeamData.GoodBeam = sumCounts(ensembles, func(ens rti.Ensemble) [][]int { return ens.GoodBeamData.GoodBeam })
+	avg.GoodEarthData.GoodEarth = sumCounts(ensembles, func(ens rti.Ensemble) [][]int { return ens.GoodEarthData.GoodEarth })
+	avg.EnsembleData.DesiredPingCount = 0
+	avg.EnsembleData.ActualPingCount = 0
+	for _, ens := range ensembles {
+		avg.EnsembleData.DesiredPingCount += ens.EnsembleData.DesiredPingCount
+		avg.EnsembleData.ActualPingCount += ens.EnsembleData.ActualPingCount
+	}
+
+	// Ancillary data
+	anc := &avg.AncillaryData
+	anc.Heading = circularMean(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Heading })
+	anc.Pitch = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Pitch })
+	anc.Roll = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Roll })
+	anc.WaterTemp = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.WaterTemp })
+	anc.SystemTemp = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.SystemTemp })
+	anc.Salinity = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Salinity })
+	anc.Pressure = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Pressure })
+	anc.TransducerDepth = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.TransducerDepth })
+	anc.SpeedOfSound = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.SpeedOfSound })
+
+	// Bottom track
+	bt := &avg.BottomTrackData
+	bt.Heading = circularMean(ensembles, func(ens rti.Ensemble) float32 { return ens.BottomTrackData.Heading })
+	bt.Pitch = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.BottomTrackData.Pitch })
+	bt.Roll = meanValue(ensembles, func(ens rti.Ensemble) float32 { return ens.BottomTrackData.Roll })
+	bt.Range = averageBeams(ensembles, true, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.Range })
+	bt.BeamVelocity = averageBeams(ensembles, false, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.BeamVelocity })
+	bt.InstrumentVelocity = averageBeams(ensembles, false, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.InstrumentVelocity })
+	bt.EarthVelocity = averageBeams(ensembles, false, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.EarthVelocity })
+	bt.ActualPingCount = 0
+	for _, ens := range ensembles {
+		bt.ActualPingCount += ens.BottomTrackData.ActualPingCount
+	}
+
+	return avg
+}
+
+// averageValues will average the [bin][beam] values of the ensembles.
+// The size is from the last ensemble.  If skipBad is set, bad velocities
+// are not included and a value with no good velocities is bad.
+func averageValues(ensembles []rti.Ensemble, skipBad bool, values func(ens rti.Ensemble) [][]float32) [][]float32 {
+	last := values(ensembles[len(ensembles)-1])
+	if last == nil {
+		return nil
+	}
+
+	avg := make([][]float32, len(last))
+	for bin := range last {
+		avg[bin] = make([]float32, len(last[bin]))
+		for beam := range last[bin] {
+			sum := float64(0)
+			count := 0
+			for _, ens := range ensembles {
+				value, ok := binValue(values(ens), bin, beam)
+				if !ok || (skipBad && value == rtiBadVelocity) {
+					continue
+				}
+				sum += float64(value)
+				count++
+			}
+			if count == 0 {
+				avg[bin][beam] = rtiBadVelocity
+				continue
+			}
+			avg[bin][beam] = float32(sum / float64(count))
+		}
+	}
+	return avg
+}
+
+// averageBeams will average the bottom track value of each beam.  Bad values
+// are not included.  If skipZero is set, 0 is not included, such as a range
+// with no bottom.  A beam with no good values is bad.
+func averageBeams(ensembles []rti.Ensemble, skipZero bool, values func(ens rti.Ensemble) []float32) []float32 {
+	last := values(ensembles[len(ensembles)-1])
+	if last == nil {
+		return nil
+	}
+
+	avg := make([]float32, len(last))
+	for beam := range last {
+		sum := float64(0)
+		count := 0
+		for _, ens := range ensembles {
+			if v := values(ens); beam < len(v) && v[beam] != rtiBadVelocity && (!skipZero || v[beam] != 0) {
+				sum += float64(v[beam])
+				count++
+			}
+		}
+		avg[beam] = rtiBadVelocity
+		if count > 0 {
+			avg[beam] = float32(sum / float64(count))
+		}
+	}
+	return avg
+}
+
+// sumCounts will add the [bin][beam] counts of the ensembles.
+// The size is from the last ensemble.
+func sumCounts(ensembles []rti.Ensemble, values func(ens rti.Ensemble) [][]int) [][]int {
+	last := values(ensembles[len(ensembles)-1])
+	if last == nil {
+		return nil
+	}
+
+	sum := make([][]int, len(last))
+	for bin := range last {
+		sum[bin] = make([]int, len(last[bin]))
+		for _, ens := range ensembles {
+			v := values(ens)
+			for beam := range sum[bin] {
+				if bin < len(v) && beam < len(v[bin]) {
+					sum[bin][beam] += v[bin][beam]
+				}
+			}
+		}
+	}
+	return sum
+}
+
+// meanValue will average the value of the ensembles.
+func meanValue(ensembles []rti.Ensemble, value func(ens rti.Ensemble) float32) float32 {
+	sum := float64(0)
+	for _, ens := range ensembles {
+		sum += float64(value(ens))
+	}
+	return float32(sum / float64(len(ensembles)))
+}
+
+// circularMean will average the angle in degrees of the ensembles.
+// The average is 0 to 360 degrees, so 350 and 10 average to 0.
+func circularMean(ensembles []rti.Ensemble, value func(ens rti.Ensemble) float32) float32 {
+	sin := float64(0)
+	cos := float64(0)
+	for _, ens := range ensembles {
+		angle := float64(value(ens)) * math.Pi / 180
+		sin += math.Sin(angle)
+		cos += math.Cos(angle)
+	}
+	avg := float32(math.Atan2(sin, cos) * 180 / math.Pi)
+	if avg < 0 {
+		avg += 360
+	}
+	if avg >= 360 {
+		// Rounding of a small negative angle
+		avg = 0
+	}
+	return avg
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnsembleAveragerFlush(t *testing.T) {
+	averager := newEnsembleAverager(0, time.Minute)
+	first := pd0TestEnsemble()
+	second := pd0TestEnsemble()
+	second.EnsembleData.Second += 10
+	second.AncillaryData.Pitch = first.AncillaryData.Pitch + 2
+
+	if _, ok := averager.add(first); ok {
+		t.Fatal("averaged before the period")
+	}
+	if _, ok := averager.add(second); ok {
+		t.Fatal("averaged before the period")
+	}
+
+	avg, ok := averager.flush()
+	if !ok {
+		t.Fatal("no partial average")
+	}
+	assertFloat(t, "Pitch", avg.AncillaryData.Pitch, first.AncillaryData.Pitch+1)
+	if _, ok := averager.flush(); ok {
+		t.Error("partial average sent twice")
+	}
+}
+
+func TestFlushAverages(t *testing.T) {
+	ens := pd0TestEnsemble()
+	hub := &adcpIO{adcp: make(map[string]*adcp)}
+	data := newAdcp(ens)
+	data.average = newEnsembleAverager(0, time.Minute)
+	hub.adcp[adcpKey(data.serialNum, data.subsystemConfig)] = data
+
+	now := time.Now()
+	data.average.add(ens)
+	data.lastSeen = now.Add(-30 * time.Second)
+	flushAverages(hub, now)
+	if len(data.average.ensembles) != 1 {
+		t.Fatal("partial average sent while the ADCP is sending")
+	}
+
+	data.lastSeen = now.Add(-time.Minute)
+	flushAverages(hub, now)
+	if len(data.average.ensembles) != 0 {
+		t.Error("partial average not sent after the ADCP stopped")
+	}
+}
@@ -0,0 +1,488 @@
+///
+/// Resumable chunked uploads of large data files.
+///
+/// A session is created with the file name and size.  The file is
+/// then sent in chunks, each with the offset it starts at.  If the
+/// connection is lost, the status gives the offset to resume from.
+/// When all the bytes are received, the file is verified and moved
+/// into the upload store.  A completed session is kept for a while, so
+/// a client that lost the response of the last chunk gets the stored
+/// file and ingest job from the status.
+///
+///	GET  /chunkupload/                                          Upload page
+///	POST /chunkupload/create?name=file&size=bytes&sha256=hex   Create a session
+///	PUT  /chunkupload/data?id=session&offset=bytes              Send a chunk
+///	GET  /chunkupload/status?id=session                        Get the offset to resume from
+///	POST /chunkupload/cancel?id=session                        Cancel the session
+///
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chunkDir          = ".partial"         // Folder in the upload folder for the partial files
+	chunkExpire       = 7 * 24 * time.Hour // Time a session is kept without receiving data
+	chunkCompleteKeep = 24 * time.Hour     // Time a completed session is kept
+	chunkChecksumName = "X-Chunk-Sha256"   // Header with the hex SHA256 of a chunk
+)
+
+// chunkSession is a resumable upload of a file.
+type chunkSession struct {
+	mutex    sync.Mutex   // Lock the partial file
+	ID       string       // Session ID
+	Name     string       // File name given by the uploader
+	Size     int64        // Size of the whole file
+	SHA256   string       // Hex SHA256 of the whole file.  Empty to not verify
+	Uploader string       // Who is uploading the file
+	Created  time.Time    // Time the session was created
+	Updated  time.Time    // Time the last chunk was received
+	offset   int64        // Bytes received
+	done     *chunkStatus // Status when the upload is complete
+}
+
+// chunkStatus is the status of a session.
+type chunkStatus struct {
+	ID     string      // Session ID
+	Name   string      // File name given by the uploader
+	Size   int64       // Size of the whole file
+	Offset int64       // Bytes received.  The next chunk starts here
+	File   *storedFile // Stored file when the upload is complete
+	Job    *ingestJob  // Ingest job when the upload is complete
+}
+
+// chunkComplete is a completed session.
+type chunkComplete struct {
+	status   chunkStatus // Status with the stored file and ingest job
+	finished time.Time   // Time the upload was completed
+}
+
+// chunkUploader will keep the sessions of the chunked uploads.
+type chunkUploader struct {
+	mutex     sync.Mutex                // Lock the sessions
+	sessions  map[string]*chunkSession  // Sessions.  Key is the session ID
+	completed map[string]*chunkComplete // Completed sessions.  Key is the session ID
+}
+
+// chunkUploads is all the chunked uploads.
+var chunkUploads = &chunkUploader{
+	sessions:  make(map[string]*chunkSession),  // Sessions
+	completed: make(map[string]*chunkComplete), // Completed sessions
+}
+
+// dir will get the folder of the partial files.
+func (c *chunkUploader) dir() string {
+	return filepath.Join(uploads.dir, chunkDir)
+}
+
+// partPath will get the path to the partial file of the session.
+func (c *chunkUploader) partPath(id string) string {
+	return filepath.Join(c.dir(), id+".part")
+}
+
+// infoPath will get the path to the session information.
+func (c *chunkUploader) infoPath(id string) string {
+	return filepath.Join(c.dir(), id+".json")
+}
+
+// load will read the sessions that were not finished before a restart.
+// The offset is the size of the partial file.
+func (c *chunkUploader) load() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := os.MkdirAll(c.dir(), 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(c.dir())
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(c.dir(), info.Name()))
+		if err != nil {
+			continue
+		}
+		session := &chunkSession{}
+		if err := json.Unmarshal(data, session); err != nil || session.ID == "" {
+			log.Println("Bad chunked upload session: " + info.Name())
+			continue
+		}
+		part, err := os.Stat(c.partPath(session.ID))
+		if err != nil {
+			continue
+		}
+		session.offset = part.Size()
+		session.Updated = part.ModTime()
+		c.sessions[session.ID] = session
+	}
+	return nil
+}
+
+// expire will remove the sessions that have not received data for a while
+// and the completed sessions kept long enough.
+func (c *chunkUploader) expire() {
+	c.mutex.Lock()
+	sessions := make([]*chunkSession, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	for id, done := range c.completed {
+		if time.Since(done.finished) > chunkCompleteKeep {
+			delete(c.completed, id)
+		}
+	}
+	c.mutex.Unlock()
+
+	// The session is locked before the sessions, as in complete
+	for _, session := range sessions {
+		session.mutex.Lock()
+		if session.done == nil && time.Since(session.Updated) > chunkExpire {
+			c.mutex.Lock()
+			if c.sessions[session.ID] == session {
+				c.removeFiles(session.ID)
+				delete(c.sessions, session.ID)
+				log.Printf("Chunked upload %s of %s expired", session.ID, session.Name)
+			}
+			c.mutex.Unlock()
+		}
+		session.mutex.Unlock()
+	}
+}
+
+// removeFiles will remove the partial file and information of the session.
+func (c *chunkUploader) removeFiles(id string) {
+	os.Remove(c.partPath(id))
+	os.Remove(c.infoPath(id))
+}
+
+// newSessionID will create a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create will start a session to upload the file.
+func (c *chunkUploader) create(name string, size int64, sum string, uploader string) (*chunkSession, error) {
+	if size <= 0 {
+		return nil, errors.New("file size must be given")
+	}
+	if uploads.maxSize > 0 && size > uploads.maxSize {
+		return nil, errUploadTooLarge
+	}
+	c.expire()
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	session := &chunkSession{
+		ID:       id,
+		Name:     name,
+		Size:     size,
+		SHA256:   strings.ToLower(sum),
+		Uploader: uploader,
+		Created:  time.Now(),
+		Updated:  time.Now(),
+	}
+
+	// Session information to resume after a restart
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(c.infoPath(id), data, 0644); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(c.partPath(id))
+	if err != nil {
+		os.Remove(c.infoPath(id))
+		return nil, err
+	}
+	f.Close()
+
+	c.mutex.Lock()
+	c.sessions[id] = session
+	c.mutex.Unlock()
+
+	log.Printf("Chunked upload %s of %s started, %d bytes", id, name, size)
+	return session, nil
+}
+
+// get will get the session.
+func (c *chunkUploader) get(id string) (*chunkSession, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	session, ok := c.sessions[id]
+	return session, ok
+}
+
+// completedStatus will get the status of the completed session.  The
+// ingest job is updated.
+func (c *chunkUploader) completedStatus(id string) (chunkStatus, bool) {
+	c.mutex.Lock()
+	done, ok := c.completed[id]
+	c.mutex.Unlock()
+	if !ok {
+		return chunkStatus{}, false
+	}
+
+	status := done.status
+	if job, ok := ingest.status(status.Job.ID); ok {
+		status.Job = &job
+	}
+	return status, true
+}
+
+// remove will remove the session and its files.
+func (c *chunkUploader) remove(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeFiles(id)
+	delete(c.sessions, id)
+}
+
+// status will get the status of the session.
+func (session *chunkSession) status() chunkStatus {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return chunkStatus{
+		ID:     session.ID,
+		Name:   session.Name,
+		Size:   session.Size,
+		Offset: session.offset,
+	}
+}
+
+// errChunkOffset is returned when a chunk does not start at the offset
+// of the bytes received.
+var errChunkOffset = errors.New("chunk does not start at the upload offset")
+
+// errChunkChecksum is returned when a chunk or the whole file does not match its checksum.
+var errChunkChecksum = errors.New("checksum does not match")
+
+// write will append the chunk at the offset to the partial file.
+// If the checksum is given and does not match, the chunk is removed.
+// The chunk cannot go past the size of the file.  Nothing is written
+// once the upload is complete.
+func (c *chunkUploader) write(session *chunkSession, offset int64, r io.Reader, sum string) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.done != nil {
+		return nil
+	}
+	if offset != session.offset {
+		return errChunkOffset
+	}
+
+	f, err := os.OpenFile(c.partPath(session.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Write the chunk.  Any bytes received are kept so the
+	// upload can resume after a lost connection.
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(r, session.Size-offset+1))
+	if err == nil && offset+n > session.Size {
+		err = errors.New("chunk is past the end of the file")
+	}
+	if err == nil && sum != "" && !strings.EqualFold(sum, hex.EncodeToString(hash.Sum(nil))) {
+		err = errChunkChecksum
+	}
+	if err != nil && (sum != "" || offset+n > session.Size) {
+		// Remove the chunk that cannot be verified
+		n = 0
+	}
+	if truncErr := f.Truncate(offset + n); truncErr != nil && err == nil {
+		err = truncErr
+	}
+
+	session.offset = offset + n
+	session.Updated = time.Now()
+	return err
+}
+
+// complete will verify the file, move it into the upload store and start
+// the ingest job.  The file is read once for the checksum.  The session is
+// kept as completed.  A request that completes the session after another
+// request, such as a retried last chunk, gets the completed status.
+func (c *chunkUploader) complete(session *chunkSession) (chunkStatus, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.done != nil {
+		return *session.done, nil
+	}
+	if session.offset != session.Size {
+		return chunkStatus{}, errors.New("upload is not complete")
+	}
+
+	// Verify the whole file
+	size, sum, err := fileChecksum(c.partPath(session.ID))
+	if err != nil {
+		return chunkStatus{}, err
+	}
+	if session.SHA256 != "" && sum != session.SHA256 {
+		// Start again
+		os.Truncate(c.partPath(session.ID), 0)
+		session.offset = 0
+		return chunkStatus{}, errChunkChecksum
+	}
+
+	file, err := uploads.adopt(session.Name, session.Uploader, c.partPath(session.ID), size, sum)
+	if err != nil {
+		return chunkStatus{}, err
+	}
+	job := ingest.add(file.Name)
+	status := chunkStatus{
+		ID:     session.ID,   // Session ID
+		Name:   session.Name, // File name
+		Size:   session.Size, // Size of the file
+		Offset: size,         // All the bytes received
+		File:   &file,        // Stored file
+		Job:    &job,         // Ingest job
+	}
+	session.done = &status
+
+	c.mutex.Lock()
+	c.removeFiles(session.ID)
+	delete(c.sessions, session.ID)
+	c.completed[session.ID] = &chunkComplete{status: status, finished: time.Now()}
+	c.mutex.Unlock()
+
+	log.Printf("Chunked upload %s of %s complete", session.ID, session.Name)
+	return status, nil
+}
+
+// chunkUploadHandler will receive the chunked uploads.
+func chunkUploadHandler(w http.ResponseWriter, r *http.Request) {
+	cmd := strings.TrimPrefix(r.URL.Path, "/chunkupload/")
+	if cmd == "" {
+		http.ServeFile(w, r, "chunkUpload.html")
+		return
+	}
+	if cmd == "create" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Create must be a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		size, _ := strconv.ParseInt(r.FormValue("size"), 10, 64)
+		session, err := chunkUploads.create(r.FormValue("name"), size, r.FormValue("sha256"), uploaderName(r))
+		if err == errUploadTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, session.status())
+		return
+	}
+
+	// A completed session only has its status.  The client may have
+	// lost the response of the last chunk.
+	if status, ok := chunkUploads.completedStatus(r.FormValue("id")); ok {
+		switch cmd {
+		case "status", "data":
+			writeJSON(w, status)
+		case "cancel":
+			http.Error(w, "Upload is already complete", http.StatusConflict)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	session, ok := chunkUploads.get(r.FormValue("id"))
+	if !ok {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return
+	}
+
+	switch cmd {
+	case "status":
+	case "data":
+		if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+			http.Error(w, "Data must be a PUT or PATCH", http.StatusMethodNotAllowed)
+			return
+		}
+		offset, err := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad offset", http.StatusBadRequest)
+			return
+		}
+
+		err = chunkUploads.write(session, offset, r.Body, r.Header.Get(chunkChecksumName))
+		if err == errChunkOffset {
+			// Send the status so the client can resume at the offset
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, session.status())
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Store and ingest the file when all the bytes are received
+		status := session.status()
+		if status.Offset == status.Size {
+			status, err = chunkUploads.complete(session)
+			if err == errChunkChecksum {
+				http.Error(w, "File "+err.Error()+", upload again", http.StatusUnprocessableEntity)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, status)
+		return
+	case "cancel":
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Cancel must be a POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		chunkUploads.remove(session.ID)
+		log.Printf("Chunked upload %s of %s canceled", session.ID, session.Name)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, session.status())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChunkUploadCompleteTwice(t *testing.T) {
+	saved := uploads.dir
+	uploads.dir = t.TempDir()
+	defer func() { uploads.dir = saved }()
+	c := &chunkUploader{
+		sessions:  make(map[string]*chunkSession),
+		completed: make(map[string]*chunkComplete),
+	}
+	for _, dir := range []string{c.dir(), filepath.Join(uploads.dir, storageMetaDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session, err := c.create("twice.ens", 4, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(session, 0, strings.NewReader("data"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both requests of a retried last chunk get the completed upload
+	var wg sync.WaitGroup
+	statuses := make([]chunkStatus, 2)
+	errs := make([]error, 2)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if errs[i] = c.write(session, 4, strings.NewReader(""), ""); errs[i] == nil {
+				statuses[i], errs[i] = c.complete(session)
+			}
+			c.expire()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if errs[i] != nil {
+			t.Fatalf("request %d: %v", i, errs[i])
+		}
+		if status.File == nil || status.File.Name != statuses[0].File.Name {
+			t.Errorf("request %d: file = %v, want %v", i, status.File, statuses[0].File)
+		}
+	}
+	if _, ok := c.completedStatus(session.ID); !ok {
+		t.Error("session is not completed")
+	}
+}
@@ -18,6 +18,8 @@ func debugHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("val:", strings.Join(v, ""))
 	}
 	fmt.Fprintf(w, "Hello adcp.IO!") // send data to client side
+	server.adcpMutex.RLock()
+	defer server.adcpMutex.RUnlock()
 	for key, value := range server.adcp {
 		fmt.Fprint(w, key)
 		ensJSON, _ := json.Marshal(value.lastEns)
@@ -0,0 +1,350 @@
+///
+/// River discharge from moving boat transects.
+///
+/// The discharge of each ensemble is the cross product of the water
+/// velocity and the boat velocity over the measured bins.  The water
+/// velocity is the earth velocity less the bottom track velocity and
+/// the boat velocity is the negative of the bottom track velocity.
+/// The unmeasured top and bottom of the profile are extrapolated
+/// with a power law.  The edges to the banks are estimated from the
+/// first and last ensembles and the distance to the bank.
+///
+/// A transect is started and stopped with the display commands.
+///
+///	{"Cmd": "startTransect", "SerialNum": "01400000000000000000000000000001", "SubsystemConfig": "0", "EdgeDistance": 5, "EdgeShape": "triangular"}
+///	{"Cmd": "stopTransect", "SerialNum": "01400000000000000000000000000001", "SubsystemConfig": "0", "EdgeDistance": 3, "EdgeShape": "rectangular"}
+///
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+const (
+	dischargeEdgeEnsembles = 10 // Number of ensembles at each edge to estimate the edge discharge
+
+	edgeTriangular  = "triangular"  // Edge slopes to the bank
+	edgeRectangular = "rectangular" // Edge has a vertical wall at the bank
+)
+
+// edgeCoefficient is the coefficient of each edge shape.
+var edgeCoefficient = map[string]float64{
+	edgeTriangular:  0.3535, // Triangular edge
+	edgeRectangular: 0.91,   // Rectangular edge
+}
+
+// dischargeEdge is the depth and mean water speed of an ensemble at an edge.
+type dischargeEdge struct {
+	depth float64 // Depth to the bottom in meters
+	speed float64 // Depth averaged water speed in m/s
+}
+
+// dischargeTransect is the discharge of a transect in progress.
+type dischargeTransect struct {
+	serialNum       string          // Serial number
+	subsystemConfig string          // Subsystem configuration
+	cepoIndex       uint8           // CEPO index of the subsystem configuration
+	replay          bool            // Flag if the ensembles are from a replay
+	started         time.Time       // Time the transect was started
+	startDistance   float64         // Distance in meters to the bank at the start
+	startShape      string          // Shape of the edge at the start
+	lastTime        time.Time       // Time of the last ensemble
+	ensCount        int             // Number of ensembles with discharge
+	duration        float64         // Time of the ensembles in seconds
+	measured        float64         // Measured discharge in m^3/s
+	top             float64         // Top discharge in m^3/s
+	bottom          float64         // Bottom discharge in m^3/s
+	startEdge       float64         // Start edge discharge in m^3/s
+	endEdge         float64         // End edge discharge in m^3/s
+	startEnsembles  []dischargeEdge // First ensembles of the transect
+	endEnsembles    []dischargeEdge // Last ensembles of the transect
+}
+
+// dischargeData will store the running discharge of a transect.
+// The discharges are in m^3/s.
+type dischargeData struct {
+	ID              string    // Data ID
+	SerialNum       string    // Serial Number
+	SubsystemConfig string    // Subsystem configuration
+	CepoIndex       uint8     // Subystem configuration
+	Replay          bool      // Flag if the data is from a replay
+	Active          bool      // Flag if the transect is in progress
+	Started         time.Time // Time the transect was started
+	EnsembleCount   int       // Number of ensembles with discharge
+	Duration        float64   // Time of the ensembles in seconds
+	Measured        float64   // Measured discharge
+	Top             float64   // Top discharge
+	Bottom          float64   // Bottom discharge
+	StartEdge       float64   // Start edge discharge
+	EndEdge         float64   // End edge discharge
+	Total           float64   // Total discharge
+}
+
+// startTransect will start a transect for the ADCP.  A transect
+// already in progress is started again.
+func startTransect(cmd displayCommand) {
+	if cmd.SerialNum == "" {
+		log.Print("Transect needs a serial number")
+		return
+	}
+	key := adcpKey(cmd.SerialNum, cmd.SubsystemConfig)
+	server.transects[key] = &dischargeTransect{
+		serialNum:       cmd.SerialNum,             // Serial number
+		subsystemConfig: cmd.SubsystemConfig,       // Subsystem configuration
+		started:         time.Now(),                // Time the transect was started
+		startDistance:   float64(cmd.EdgeDistance), // Distance to the bank
+		startShape:      cmd.EdgeShape,             // Shape of the edge
+	}
+	log.Printf("Transect started for %s", key)
+}
+
+// stopTransect will stop the transect of the ADCP and send the final discharge.
+func stopTransect(cmd displayCommand) {
+	key := adcpKey(cmd.SerialNum, cmd.SubsystemConfig)
+	transect, ok := server.transects[key]
+	if !ok {
+		log.Printf("No transect for %s", key)
+		return
+	}
+	delete(server.transects, key)
+
+	// Edge discharge has the same direction as the measured discharge
+	transect.startEdge = edgeDischarge(transect.startEnsembles, transect.startDistance, transect.startShape, transect.measured)
+	transect.endEdge = edgeDischarge(transect.endEnsembles, float64(cmd.EdgeDistance), cmd.EdgeShape, transect.measured)
+
+	data := transect.data(false)
+	log.Printf("Transect stopped for %s, total discharge %.3f m^3/s", key, data.Total)
+	sendDischargeData(data)
+}
+
+// edgeDischarge will estimate the discharge between the bank and the edge
+// ensembles.  The sign is the sign of the measured discharge.
+func edgeDischarge(ensembles []dischargeEdge, distance float64, shape string, measured float64) float64 {
+	if len(ensembles) == 0 || distance <= 0 {
+		return 0
+	}
+	coef, ok := edgeCoefficient[shape]
+	if !ok {
+		coef = edgeCoefficient[edgeTriangular]
+	}
+
+	depth := float64(0)
+	speed := float64(0)
+	for _, edge := range ensembles {
+		depth += edge.depth
+		speed += edge.speed
+	}
+	depth /= float64(len(ensembles))
+	speed /= float64(len(ensembles))
+
+	q := coef * speed * distance * depth
+	if measured < 0 {
+		q = -q
+	}
+	return q
+}
+
+// data will get the running discharge of the transect.
+func (transect *dischargeTransect) data(active bool) dischargeData {
+	data := dischargeData{
+		ID:              dischargeID,              // ID
+		SerialNum:       transect.serialNum,       // Serial number
+		SubsystemConfig: transect.subsystemConfig, // Subsystem configuration
+		CepoIndex:       transect.cepoIndex,       // Subsystem Config
+		Replay:          transect.replay,          // Replay flag
+		Active:          active,                   // Transect in progress
+		Started:         transect.started,         // Time the transect was started
+		EnsembleCount:   transect.ensCount,        // Number of ensembles
+		Duration:        transect.duration,        // Time of the ensembles
+		StartEdge:       transect.startEdge,       // Start edge discharge
+		EndEdge:         transect.endEdge,         // End edge discharge
+		Measured:        transect.measured,        // Measured discharge
+		Top:             transect.top,             // Top discharge
+		Bottom:          transect.bottom,          // Bottom discharge
+	}
+	data.Total = data.Measured + data.Top + data.Bottom + data.StartEdge + data.EndEdge
+	return data
+}
+
+// addDischarge will add the discharge of the ensemble to the transect of
+// its ADCP and send the running discharge to the displays.
+func addDischarge(ens rti.Ensemble, replay bool) {
+	transect, ok := server.transects[adcpKey(ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens))]
+	if !ok {
+		return
+	}
+	transect.cepoIndex = ens.EnsembleData.SubsystemConfig.CepoIndex
+	transect.replay = replay
+
+	// Ensembles without bottom track or good bins are skipped.  The time
+	// is from the last good ensemble, so the next good ensemble covers
+	// the time of the skipped ensembles.
+	q, ok := ensembleDischarge(ens, *powerExp)
+	if !ok {
+		return
+	}
+
+	// Time of the ensemble.  The first good ensemble only starts the time.
+	ensTime := ensembleTime(ens)
+	dt := float64(0)
+	if !transect.lastTime.IsZero() {
+		dt = ensTime.Sub(transect.lastTime).Seconds()
+	}
+	transect.lastTime = ensTime
+	if dt < 0 {
+		return
+	}
+
+	transect.ensCount++
+	transect.duration += dt
+	transect.measured += q.measured * dt
+	transect.top += q.top * dt
+	transect.bottom += q.bottom * dt
+
+	// Keep the first and last ensembles for the edges
+	if len(transect.startEnsembles) < dischargeEdgeEnsembles {
+		transect.startEnsembles = append(transect.startEnsembles, q.edge)
+	}
+	transect.endEnsembles = append(transect.endEnsembles, q.edge)
+	if len(transect.endEnsembles) > dischargeEdgeEnsembles {
+		transect.endEnsembles = transect.endEnsembles[1:]
+	}
+
+	sendDischargeData(transect.data(true))
+}
+
+// sendDischargeData will send the discharge to the displays.
+func sendDischargeData(data dischargeData) {
+	// Convert the JSON to byte array
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Send the data to the display
+	sendAdcpDataToDisplays(dischargeID, data.SerialNum, data.SubsystemConfig, false, b)
+}
+
+// ensembleFlow is the discharge of an ensemble for each second of boat
+// travel.  Multiplied by the time between ensembles, it is the discharge
+// in m^3/s through the boat track between the ensembles.
+type ensembleFlow struct {
+	measured float64       // Measured discharge
+	top      float64       // Top discharge
+	bottom   float64       // Bottom discharge
+	edge     dischargeEdge // Depth and water speed for the edges
+}
+
+// dischargeBin is the water velocity of a bin above the side lobe.
+type dischargeBin struct {
+	east  float64 // East water velocity in m/s
+	north float64 // North water velocity in m/s
+	good  bool    // Flag if the velocity is good
+}
+
+// ensembleDischarge will get the discharge of the ensemble.  The profile
+// above and below the measured bins is extrapolated with the power law
+// exponent.  Bad bins between the good bins are interpolated from the good
+// bins above and below.  False is returned if there is no bottom track or
+// no good bins.
+func ensembleDischarge(ens rti.Ensemble, exponent float64) (ensembleFlow, bool) {
+	flow := ensembleFlow{}
+
+	// Boat velocity from the bottom track
+	btVel := ens.BottomTrackData.EarthVelocity
+	if len(btVel) < 2 || btVel[0] == rtiBadVelocity || btVel[1] == rtiBadVelocity {
+		return flow, false
+	}
+	boatEast := -float64(btVel[0])
+	boatNorth := -float64(btVel[1])
+
+	// Depth to the bottom from the water surface
+	btRange := float64(0)
+	count := 0
+	for _, r := range ens.BottomTrackData.Range {
+		if r > 0 && r != rtiBadVelocity {
+			btRange += float64(r)
+			count++
+		}
+	}
+	if count == 0 {
+		return flow, false
+	}
+	draft := float64(ens.AncillaryData.TransducerDepth)
+	depth := draft + btRange/float64(count)
+	flow.edge.depth = depth
+
+	// Bins above the side lobe of the bottom
+	binSize := float64(ens.AncillaryData.BinSize)
+	sideLobe := draft + (depth-draft)*math.Cos(transform.beamAngle*math.Pi/180)
+
+	// Water velocity less the boat motion of the bins above the side lobe
+	var bins []dischargeBin
+	firstGood := -1
+	lastGood := -1
+	for bin, vel := range ens.EarthVelocityData.Velocity {
+		binCenter := draft + float64(binDepth(ens, bin))
+		if binCenter+binSize/2 > sideLobe {
+			break
+		}
+		b := dischargeBin{}
+		if len(vel) >= 2 && vel[0] != rtiBadVelocity && vel[1] != rtiBadVelocity {
+			b = dischargeBin{
+				east:  float64(vel[0]) - float64(btVel[0]), // East water velocity
+				north: float64(vel[1]) - float64(btVel[1]), // North water velocity
+				good:  true,                                // Good velocity
+			}
+			if firstGood < 0 {
+				firstGood = bin
+			}
+			lastGood = bin
+		}
+		bins = append(bins, b)
+	}
+	if firstGood < 0 {
+		return flow, false
+	}
+
+	// Measured bins from the first to the last good bin.  z is the height
+	// above the bottom.
+	zTop := depth - (draft + float64(binDepth(ens, firstGood)) - binSize/2)
+	zBottom := depth - (draft + float64(binDepth(ens, lastGood)) + binSize/2)
+	if zTop <= zBottom {
+		return flow, false
+	}
+	speed := float64(0)
+	above := firstGood
+	for bin := firstGood; bin <= lastGood; bin++ {
+		b := bins[bin]
+		if b.good {
+			above = bin
+		} else {
+			// Interpolate between the good bins above and below
+			below := bin + 1
+			for !bins[below].good {
+				below++
+			}
+			frac := float64(bin-above) / float64(below-above)
+			b.east = bins[above].east + frac*(bins[below].east-bins[above].east)
+			b.north = bins[above].north + frac*(bins[below].north-bins[above].north)
+		}
+		flow.measured += (b.east*boatNorth - b.north*boatEast) * binSize
+		speed += math.Hypot(b.east, b.north)
+	}
+	flow.edge.speed = speed / float64(lastGood-firstGood+1)
+
+	// Power law u = a z^b fit to the measured discharge
+	b1 := exponent + 1
+	a := flow.measured * b1 / (math.Pow(zTop, b1) - math.Pow(zBottom, b1))
+	flow.top = a * (math.Pow(depth, b1) - math.Pow(zTop, b1)) / b1
+	flow.bottom = a * math.Pow(zBottom, b1) / b1
+
+	return flow, true
+}
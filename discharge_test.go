@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// dischargeTestEnsemble will create an ensemble of a boat going East at
+// 1 m/s over water flowing North at 0.5 m/s at every depth.  The transducer
+// is 0.5 m deep and the bottom is 10 m below it.
+func dischargeTestEnsemble() rti.Ensemble {
+	const numBins = 20
+
+	var ens rti.Ensemble
+	ens.AncillaryData.TransducerDepth = 0.5
+	ens.AncillaryData.FirstBinRange = 1
+	ens.AncillaryData.BinSize = 0.5
+
+	// Bottom track is the negative of the boat velocity
+	ens.BottomTrackData.Range = []float32{10, 10, 10, 10}
+	ens.BottomTrackData.EarthVelocity = []float32{-1, 0, 0, 0}
+
+	// Earth velocity is the water velocity plus the bottom track velocity
+	ens.EarthVelocityData.Velocity = make([][]float32, numBins)
+	for bin := range ens.EarthVelocityData.Velocity {
+		ens.EarthVelocityData.Velocity[bin] = []float32{-1, 0.5, 0, 0}
+	}
+	return ens
+}
+
+func TestEnsembleDischargeUniform(t *testing.T) {
+	// A power law exponent of 0 is a uniform profile, so the
+	// extrapolated discharge is exact.  The water flows to the left
+	// of the boat, so the discharge is negative.
+	const depth = 10.5
+	want := -0.5 * depth
+
+	tests := []struct {
+		name string
+		bad  []int
+	}{
+		{"all good", nil},
+		{"bad bins", []int{3, 4, 9}},
+		{"bad top and bottom bins", []int{0, 15}},
+	}
+	for _, test := range tests {
+		ens := dischargeTestEnsemble()
+		for _, bin := range test.bad {
+			ens.EarthVelocityData.Velocity[bin] = []float32{rtiBadVelocity, rtiBadVelocity, rtiBadVelocity, rtiBadVelocity}
+		}
+
+		flow, ok := ensembleDischarge(ens, 0)
+		if !ok {
+			t.Fatalf("%s: no discharge", test.name)
+		}
+		if total := flow.measured + flow.top + flow.bottom; math.Abs(total-want) > 1e-4 {
+			t.Errorf("%s: discharge = %v, want %v", test.name, total, want)
+		}
+		if math.Abs(flow.edge.depth-depth) > 1e-4 || math.Abs(flow.edge.speed-0.5) > 1e-4 {
+			t.Errorf("%s: edge depth and speed = %v %v, want %v 0.5", test.name, flow.edge.depth, flow.edge.speed, depth)
+		}
+	}
+}
+
+func TestEnsembleDischargePowerLaw(t *testing.T) {
+	// Bad bins are interpolated, so the discharge is the same as all good
+	ens := dischargeTestEnsemble()
+	all, _ := ensembleDischarge(ens, 1.0/6)
+	ens.EarthVelocityData.Velocity[5] = []float32{rtiBadVelocity, rtiBadVelocity, rtiBadVelocity, rtiBadVelocity}
+	bad, _ := ensembleDischarge(ens, 1.0/6)
+	if math.Abs(all.measured-bad.measured) > 1e-4 || math.Abs(all.top-bad.top) > 1e-4 || math.Abs(all.bottom-bad.bottom) > 1e-4 {
+		t.Errorf("discharge with a bad bin = %+v, want %+v", bad, all)
+	}
+}
+
+func TestEnsembleDischargeNoBottom(t *testing.T) {
+	ens := dischargeTestEnsemble()
+	ens.BottomTrackData.EarthVelocity = []float32{rtiBadVelocity, rtiBadVelocity, rtiBadVelocity, rtiBadVelocity}
+	if _, ok := ensembleDischarge(ens, 1.0/6); ok {
+		t.Error("discharge without bottom track")
+	}
+
+	ens = dischargeTestEnsemble()
+	for bin := range ens.EarthVelocityData.Velocity {
+		ens.EarthVelocityData.Velocity[bin][0] = rtiBadVelocity
+	}
+	if _, ok := ensembleDischarge(ens, 1.0/6); ok {
+		t.Error("discharge without good bins")
+	}
+}
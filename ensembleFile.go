@@ -0,0 +1,212 @@
+///
+/// Read the ensembles from a recorded file.
+///
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+const (
+	// Size of the buffer to read from the file.
+	fileReadSize = 1024 * 32
+
+	// Largest JSON line in a JSON-lines file.
+	maxJSONLineSize = 1024 * 1024 * 8
+)
+
+// readEnsembleFile will read all the ensembles in the file and pass
+// each ensemble to fn.  The file can be RTI binary, PD0 or JSON-lines.
+// If fn returns an error, reading stops and the error is returned.
+func readEnsembleFile(path string, fn func(rti.Ensemble) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return readEnsembles(f, fn)
+}
+
+// readEnsembles will read all the ensembles from the reader and pass
+// each ensemble to fn.  The format is found from the start of the data.
+func readEnsembles(r io.Reader, fn func(rti.Ensemble) error) error {
+	return readEnsembleOffsets(r, func(ens rti.Ensemble, offset int64) error {
+		return fn(ens)
+	})
+}
+
+// readEnsembleOffsets will read all the ensembles from the reader and pass
+// each ensemble and its offset in the data to fn.  The format is found
+// from the start of the data.
+func readEnsembleOffsets(r io.Reader, fn func(rti.Ensemble, int64) error) error {
+	reader := bufio.NewReaderSize(r, fileReadSize)
+
+	// Check the start of the data for the format
+	start, err := reader.Peek(64)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if isJSONData(start) {
+		return readJSONLines(reader, fn)
+	}
+	return readBinary(reader, fn)
+}
+
+// errEnsembleFound will stop reading at the ensemble.
+var errEnsembleFound = errors.New("ensemble found")
+
+// readEnsembleAt will read the ensemble that starts at the offset in the
+// file.  The offset is from readEnsembleOffsets.
+func readEnsembleAt(path string, offset int64) (rti.Ensemble, error) {
+	var ens rti.Ensemble
+	f, err := os.Open(path)
+	if err != nil {
+		return ens, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return ens, err
+	}
+
+	err = readEnsembleOffsets(f, func(found rti.Ensemble, start int64) error {
+		if start != 0 {
+			return fmt.Errorf("no ensemble at offset %d in %s", offset, path)
+		}
+		ens = found
+		return errEnsembleFound
+	})
+	if err == nil {
+		err = fmt.Errorf("no ensemble at offset %d in %s", offset, path)
+	}
+	if err != errEnsembleFound {
+		return ens, err
+	}
+	return ens, nil
+}
+
+// detectDataFormat will find the format of the data file from the start
+// of the file.  The format is recordFormatRti, recordFormatPd0 or
+// recordFormatJSON, or empty if no ensemble header is found.
+func detectDataFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	start := make([]byte, fileReadSize)
+	n, err := io.ReadFull(f, start)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	start = start[:n]
+
+	if isJSONData(start) {
+		return recordFormatJSON, nil
+	}
+
+	// Use the first header found
+	rtiStart := bytes.Index(start, rtiHeaderStart)
+	pd0Start := bytes.Index(start, []byte{pd0HeaderID, pd0HeaderID})
+	switch {
+	case rtiStart >= 0 && (pd0Start < 0 || rtiStart < pd0Start):
+		return recordFormatRti, nil
+	case pd0Start >= 0:
+		return recordFormatPd0, nil
+	}
+	return "", nil
+}
+
+// readJSONLines will read each line as a JSON ensemble.
+// Lines that are not ensembles are skipped.
+func readJSONLines(r io.Reader, fn func(rti.Ensemble, int64) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, fileReadSize), maxJSONLineSize)
+
+	// Keep the offset of the start of each line
+	var lineStart, next int64
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lineStart = next
+		}
+		next += int64(advance)
+		return advance, token, err
+	})
+
+	for scanner.Scan() {
+		if !isJSONData(scanner.Bytes()) {
+			continue
+		}
+
+		ens, err := decodeJSONEnsemble(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		if err := fn(ens, lineStart); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readBinary will decode the RTI binary or PD0 ensembles.
+func readBinary(r io.Reader, fn func(rti.Ensemble, int64) error) error {
+	var codec ensembleCodec
+	buf := make([]byte, fileReadSize)
+	for {
+		n, err := r.Read(buf)
+		ensembles := codec.add(buf[:n])
+		offsets := codec.offsets()
+		for i, ens := range ensembles {
+			if err := fn(ens, offsets[i]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ensembleTime will get the time of the ensemble from the ensemble data.
+func ensembleTime(ens rti.Ensemble) time.Time {
+	return time.Date(int(ens.EnsembleData.Year),
+		time.Month(ens.EnsembleData.Month),
+		int(ens.EnsembleData.Day),
+		int(ens.EnsembleData.Hour),
+		int(ens.EnsembleData.Minute),
+		int(ens.EnsembleData.Second),
+		int(ens.EnsembleData.HSec)*int(10*time.Millisecond),
+		time.Local)
+}
+
+// dataFilePath will find the data file in the recording folder
+// or the upload store.  Only files in these places can be used.
+func dataFilePath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("no file given")
+	}
+
+	path := record.path(name)
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return path, nil
+	}
+	if _, ok := uploads.info(name); ok {
+		return uploads.path(name)
+	}
+	return "", errors.New("file not found: " + name)
+}
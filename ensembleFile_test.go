@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ricorx7/go-rti"
+)
+
+func TestReadEnsembleAt(t *testing.T) {
+	encodeJSON := func(ens rti.Ensemble) []byte {
+		data, err := json.Marshal(ens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(data, '\n')
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		encode func(ens rti.Ensemble) []byte
+	}{
+		{"rti", "garbage", encodeRtiEnsemble},
+		{"pd0", "garbage", encodePd0},
+		{"json", "{\"not\": \"an ensemble\"\n", encodeJSON},
+	}
+	for _, test := range tests {
+		// Each file has data before the ensembles
+		data := []byte(test.prefix)
+		for num := uint32(1); num <= 3; num++ {
+			ens := pd0TestEnsemble()
+			ens.EnsembleData.EnsembleNumber = num
+			data = append(data, test.encode(ens)...)
+		}
+		path := filepath.Join(t.TempDir(), test.name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var offsets []int64
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = readEnsembleOffsets(f, func(ens rti.Ensemble, offset int64) error {
+			offsets = append(offsets, offset)
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(offsets) != 3 {
+			t.Fatalf("%s: offsets = %v, want 3", test.name, offsets)
+		}
+
+		// Read the ensembles in reverse order
+		for i := len(offsets) - 1; i >= 0; i-- {
+			ens, err := readEnsembleAt(path, offsets[i])
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if ens.EnsembleData.EnsembleNumber != uint32(i+1) {
+				t.Errorf("%s: ensemble at %d = %d, want %d", test.name, offsets[i], ens.EnsembleData.EnsembleNumber, i+1)
+			}
+		}
+		if _, err := readEnsembleAt(path, offsets[0]+1); err == nil {
+			t.Errorf("%s: no error reading between ensembles", test.name)
+		}
+	}
+}
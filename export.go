@@ -0,0 +1,343 @@
+///
+/// Export the ensembles in a data file to CSV.
+///
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// ensembleFilter will select the ensembles of an ADCP within a time range.
+type ensembleFilter struct {
+	serialNum       string    // Serial number.  Empty for all serial numbers
+	subsystemConfig string    // Subsystem configuration.  Empty for all configurations
+	start           time.Time // Start time.  Zero for no start time
+	end             time.Time // End time.  Zero for no end time
+}
+
+// newEnsembleFilter will create the filter.  The times are RFC3339
+// and can be empty.
+func newEnsembleFilter(serialNum string, subsystemConfig string, start string, end string) (ensembleFilter, error) {
+	filter := ensembleFilter{
+		serialNum:       serialNum,
+		subsystemConfig: subsystemConfig,
+	}
+
+	var err error
+	if start != "" {
+		if filter.start, err = time.ParseInLocation(time.RFC3339, start, time.Local); err != nil {
+			return filter, errors.New("bad start time: " + err.Error())
+		}
+	}
+	if end != "" {
+		if filter.end, err = time.ParseInLocation(time.RFC3339, end, time.Local); err != nil {
+			return filter, errors.New("bad end time: " + err.Error())
+		}
+	}
+	return filter, nil
+}
+
+// parseEnsembleFilter will get the filter from the request.
+// The values are serial, config, start and end.
+func parseEnsembleFilter(r *http.Request) (ensembleFilter, error) {
+	return newEnsembleFilter(r.FormValue("serial"), r.FormValue("config"), r.FormValue("start"), r.FormValue("end"))
+}
+
+// match will check if the ensemble is selected by the filter.
+func (filter ensembleFilter) match(ens rti.Ensemble) bool {
+	if filter.serialNum != "" && filter.serialNum != ens.EnsembleData.SerialNumber.SerialNumber {
+		return false
+	}
+	if filter.subsystemConfig != "" && filter.subsystemConfig != subsystemConfig(ens) {
+		return false
+	}
+
+	ensTime := ensembleTime(ens)
+	if !filter.start.IsZero() && ensTime.Before(filter.start) {
+		return false
+	}
+	if !filter.end.IsZero() && ensTime.After(filter.end) {
+		return false
+	}
+	return true
+}
+
+// checkSingleADCPFilter will check the filter selects a single ADCP.
+// The dimensions and bin depths of an exported file are from one ADCP.
+func checkSingleADCPFilter(filter ensembleFilter) error {
+	if filter.serialNum == "" || filter.subsystemConfig == "" {
+		return errors.New("serial and config are required")
+	}
+	return nil
+}
+
+// parseDataFiles will get the data files from the request.  If a file is
+// given, only that file is used.  Otherwise the ingested files with
+// ensembles selected by the filter are used.
+func parseDataFiles(r *http.Request, filter ensembleFilter) ([]string, error) {
+	if r.FormValue("file") != "" {
+		path, err := dataFilePath(r.FormValue("file"))
+		if err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+
+	paths := ingest.find(filter)
+	if len(paths) == 0 {
+		return nil, errors.New("no file given and no ingested files match")
+	}
+	return paths, nil
+}
+
+// readFilteredEnsembles will read all the ensembles in the files selected by the filter.
+func readFilteredEnsembles(paths []string, filter ensembleFilter, fn func(rti.Ensemble) error) error {
+	for _, path := range paths {
+		err := readEnsembleFile(path, func(ens rti.Ensemble) error {
+			if !filter.match(ens) {
+				return nil
+			}
+			return fn(ens)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvTimeFormat is the format of the ensemble time in the CSV files.
+const csvTimeFormat = "2006-01-02 15:04:05.00"
+
+// csvProfileDataSets are the bin and beam data sets that can be exported.
+// Each row is an ensemble, bin and beam value.
+var csvProfileDataSets = map[string]func(ens rti.Ensemble) [][]float32{
+	"amplitude":     func(ens rti.Ensemble) [][]float32 { return ens.AmplitudeData.Amplitude },
+	"correlation":   func(ens rti.Ensemble) [][]float32 { return ens.CorrelationData.Correlation },
+	"beamvelocity":  func(ens rti.Ensemble) [][]float32 { return ens.BeamVelocityData.Velocity },
+	"earthvelocity": func(ens rti.Ensemble) [][]float32 { return ens.EarthVelocityData.Velocity },
+}
+
+// csvDataSets are all the data sets that can be exported in the order
+// they are added to the zip file.
+var csvDataSets = []string{"ancillary", "amplitude", "correlation", "beamvelocity", "earthvelocity"}
+
+// csvDataSet is the header and the rows of each ensemble of a data set.
+type csvDataSet struct {
+	header []string                                    // Header row
+	rows   func(w *csv.Writer, ens rti.Ensemble) error // Write the rows of the ensemble
+}
+
+// newCSVDataSet will get the data set by its name.
+func newCSVDataSet(dataSet string) (csvDataSet, error) {
+	if dataSet == "ancillary" {
+		return csvDataSet{
+			header: []string{"EnsembleNumber", "DateTime", "Heading", "Pitch", "Roll", "WaterTemp", "SystemTemp",
+				"Salinity", "Pressure", "TransducerDepth", "SpeedOfSound", "FirstBinRange", "BinSize"},
+			rows: writeAncillaryRow,
+		}, nil
+	}
+
+	values, ok := csvProfileDataSets[dataSet]
+	if !ok {
+		return csvDataSet{}, errors.New("unknown data set: " + dataSet)
+	}
+	return csvDataSet{
+		header: []string{"EnsembleNumber", "DateTime", "Bin", "BinDepth", "Beam", "Value"},
+		rows: func(w *csv.Writer, ens rti.Ensemble) error {
+			return writeProfileRows(w, ens, values)
+		},
+	}, nil
+}
+
+// writeCSV will write the data set of all the ensembles selected
+// by the filter to the writer.
+func writeCSV(w io.Writer, paths []string, filter ensembleFilter, dataSet string) error {
+	set, err := newCSVDataSet(dataSet)
+	if err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(set.header)
+	err = readFilteredEnsembles(paths, filter, func(ens rti.Ensemble) error {
+		return set.rows(csvWriter, ens)
+	})
+	if err != nil {
+		return err
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// writeCSVFiles will write each of the csvDataSets to a temporary file
+// with a single read of the ensembles.  The files are removed with
+// removeCSVFiles.
+func writeCSVFiles(paths []string, filter ensembleFilter) ([]*os.File, error) {
+	var files []*os.File
+	var sets []csvDataSet
+	var writers []*csv.Writer
+	for _, dataSet := range csvDataSets {
+		set, err := newCSVDataSet(dataSet)
+		if err != nil {
+			removeCSVFiles(files)
+			return nil, err
+		}
+		f, err := os.CreateTemp("", "adcpio-"+dataSet+"-*.csv")
+		if err != nil {
+			removeCSVFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+		sets = append(sets, set)
+		writers = append(writers, csv.NewWriter(f))
+		writers[len(writers)-1].Write(set.header)
+	}
+
+	err := readFilteredEnsembles(paths, filter, func(ens rti.Ensemble) error {
+		for i, set := range sets {
+			if err := set.rows(writers[i], ens); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, w := range writers {
+		w.Flush()
+		if err == nil {
+			err = w.Error()
+		}
+	}
+	if err != nil {
+		removeCSVFiles(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+// removeCSVFiles will close and remove the temporary files.
+func removeCSVFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// writeCSVZip will write the data set files from writeCSVFiles to a zip file.
+func writeCSVZip(w io.Writer, files []*os.File, name string) error {
+	zipWriter := zip.NewWriter(w)
+	for i, dataSet := range csvDataSets {
+		f, err := zipWriter.Create(name + "_" + dataSet + ".csv")
+		if err != nil {
+			return err
+		}
+		if _, err := files[i].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, files[i]); err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// writeAncillaryRow will write a row for the ensemble with the
+// ancillary, heading, pitch, roll and temperature data.
+func writeAncillaryRow(w *csv.Writer, ens rti.Ensemble) error {
+	anc := ens.AncillaryData
+	row := []string{
+		strconv.FormatUint(uint64(ens.EnsembleData.EnsembleNumber), 10),
+		ensembleTime(ens).Format(csvTimeFormat),
+	}
+	for _, val := range []float32{anc.Heading, anc.Pitch, anc.Roll, anc.WaterTemp, anc.SystemTemp,
+		anc.Salinity, anc.Pressure, anc.TransducerDepth, anc.SpeedOfSound, anc.FirstBinRange, anc.BinSize} {
+		row = append(row, formatCSVFloat(val))
+	}
+	return w.Write(row)
+}
+
+// writeProfileRows will write a row for each bin and beam value of the ensemble.
+func writeProfileRows(w *csv.Writer, ens rti.Ensemble, values func(ens rti.Ensemble) [][]float32) error {
+	ensNum := strconv.FormatUint(uint64(ens.EnsembleData.EnsembleNumber), 10)
+	ensTime := ensembleTime(ens).Format(csvTimeFormat)
+	for bin, beams := range values(ens) {
+		for beam, val := range beams {
+			err := w.Write([]string{ensNum, ensTime, strconv.Itoa(bin), formatCSVFloat(binDepth(ens, bin)), strconv.Itoa(beam), formatCSVFloat(val)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatCSVFloat will format the value for the CSV file.
+func formatCSVFloat(val float32) string {
+	return strconv.FormatFloat(float64(val), 'f', -1, 32)
+}
+
+// exportCSVHandler will export the ensembles in a data file to CSV.
+//
+//	/export/csv?file=name&serial=&config=&start=&end=&data=
+//
+// If data is given, only that data set is exported as a CSV file.
+// Otherwise all the data sets are exported in a zip file.
+// If file is not given, the ingested files are used.
+func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEnsembleFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths, err := parseDataFiles(r, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	name := safeFileName(fmt.Sprintf("%s_%s", filter.serialNum, filter.subsystemConfig))
+
+	// Single data set.  The response has started when an error is found,
+	// so the connection is closed to fail the download.
+	if dataSet := r.FormValue("data"); dataSet != "" {
+		if _, err := newCSVDataSet(dataSet); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename="+name+"_"+dataSet+".csv")
+		if err := writeCSV(w, paths, filter, dataSet); err != nil {
+			log.Println("Error writing CSV: " + err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	// All the data sets in a zip file.  The data sets are written before
+	// the response, so a read error can still be sent.
+	files, err := writeCSVFiles(paths, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer removeCSVFiles(files)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+".zip")
+	if err := writeCSVZip(w, files, name); err != nil {
+		log.Println("Error writing CSV zip file: " + err.Error())
+		panic(http.ErrAbortHandler)
+	}
+}
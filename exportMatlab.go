@@ -0,0 +1,127 @@
+///
+/// Export the ensembles in a data file to a MATLAB file.
+///
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// matlabDatenumEpoch is the MATLAB datenum of 1970-01-01.
+const matlabDatenumEpoch = 719529
+
+// matlabDatenum will get the MATLAB datenum of the time.
+// The datenum is the days since year 0 of the local time.
+func matlabDatenum(t time.Time) float64 {
+	_, offset := t.Zone()
+	seconds := float64(t.Unix()+int64(offset)) + float64(t.Nanosecond())/1e9
+	return matlabDatenumEpoch + seconds/(24*60*60)
+}
+
+// newEnsembleMat will create the MATLAB file for the ensembles.
+// The ensembles should all be from the same serial number and subsystem configuration.
+// Missing and bad values are NaN.
+func newEnsembleMat(ensembles []rti.Ensemble) *matFile {
+	first := ensembles[0]
+	numEns := len(ensembles)
+	numBins, numBeams := exportDims(ensembles)
+	nan := float32(math.NaN())
+	profileDims := []int{numEns, numBins, numBeams}
+	btDims := []int{numEns, numBeams}
+
+	mat := &matFile{}
+	mat.addVar("SerialNumber", []int{1, len(first.EnsembleData.SerialNumber.SerialNumber)}, first.EnsembleData.SerialNumber.SerialNumber)
+	mat.addVar("SubsystemConfig", []int{1, len(subsystemConfig(first))}, subsystemConfig(first))
+	mat.addVar("FirmwareVersion", []int{1, len(firmwareVersion(first))}, firmwareVersion(first))
+
+	// Time of each ensemble
+	ensNums := make([]float64, numEns)
+	times := make([]float64, numEns)
+	for e, ens := range ensembles {
+		ensNums[e] = float64(ens.EnsembleData.EnsembleNumber)
+		times[e] = matlabDatenum(ensembleTime(ens))
+	}
+	mat.addVar("EnsembleNumber", []int{numEns}, ensNums)
+	mat.addVar("DateTime", []int{numEns}, times)
+
+	// Depth of each bin
+	depths := make([]float32, numBins)
+	for bin := range depths {
+		depths[bin] = binDepth(first, bin)
+	}
+	mat.addVar("BinDepth", []int{numBins}, depths)
+	mat.addVar("FirstBinRange", []int{1}, []float32{first.AncillaryData.FirstBinRange})
+	mat.addVar("BinSize", []int{1}, []float32{first.AncillaryData.BinSize})
+
+	// Profile data [ens x bin x beam]
+	mat.addVar("Amplitude", profileDims,
+		exportProfile(ensembles, numBins, numBeams, nan, func(ens rti.Ensemble) [][]float32 { return ens.AmplitudeData.Amplitude }))
+	mat.addVar("Correlation", profileDims,
+		exportProfile(ensembles, numBins, numBeams, nan, func(ens rti.Ensemble) [][]float32 { return ens.CorrelationData.Correlation }))
+	mat.addVar("BeamVelocity", profileDims,
+		exportProfile(ensembles, numBins, numBeams, nan, func(ens rti.Ensemble) [][]float32 { return ens.BeamVelocityData.Velocity }))
+	mat.addVar("InstrumentVelocity", profileDims,
+		exportProfile(ensembles, numBins, numBeams, nan, func(ens rti.Ensemble) [][]float32 { return ens.InstrumentVelocityData.Velocity }))
+	mat.addVar("EarthVelocity", profileDims,
+		exportProfile(ensembles, numBins, numBeams, nan, func(ens rti.Ensemble) [][]float32 { return ens.EarthVelocityData.Velocity }))
+
+	// Ancillary data
+	mat.addVar("Heading", []int{numEns}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Heading }))
+	mat.addVar("Pitch", []int{numEns}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Pitch }))
+	mat.addVar("Roll", []int{numEns}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Roll }))
+	mat.addVar("WaterTemp", []int{numEns}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.WaterTemp }))
+	mat.addVar("Pressure", []int{numEns}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Pressure }))
+	mat.addVar("TransducerDepth", []int{numEns}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.TransducerDepth }))
+
+	// Bottom track data [ens x beam]
+	mat.addVar("BottomTrackRange", btDims,
+		exportBottomTrack(ensembles, numBeams, nan, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.Range }))
+	mat.addVar("BottomTrackBeamVelocity", btDims,
+		exportBottomTrack(ensembles, numBeams, nan, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.BeamVelocity }))
+	mat.addVar("BottomTrackEarthVelocity", btDims,
+		exportBottomTrack(ensembles, numBeams, nan, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.EarthVelocity }))
+
+	return mat
+}
+
+// exportMatHandler will export the ensembles in a data file to MATLAB.
+//
+//	/export/mat?file=name&serial=&config=&start=&end=
+//
+// The serial and config are required.  If file is not given, the ingested
+// files are used.
+func exportMatHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEnsembleFilter(r)
+	if err == nil {
+		err = checkSingleADCPFilter(filter)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths, err := parseDataFiles(r, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	ensembles, err := readExportEnsembles(paths, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	name := safeFileName(fmt.Sprintf("%s_%s", filter.serialNum, filter.subsystemConfig))
+	w.Header().Set("Content-Type", "application/x-matlab-data")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+".mat")
+	if err := newEnsembleMat(ensembles).write(w); err != nil {
+		log.Println("Error writing MATLAB file: " + err.Error())
+	}
+}
@@ -0,0 +1,300 @@
+///
+/// Export the ensembles of an ADCP in a data file to a CF-conventions
+/// netCDF-4 file.
+///
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// readExportEnsembles will read all the ensembles selected by the filter.
+// An error is returned if no ensembles are found.
+func readExportEnsembles(paths []string, filter ensembleFilter) ([]rti.Ensemble, error) {
+	var ensembles []rti.Ensemble
+	err := readFilteredEnsembles(paths, filter, func(ens rti.Ensemble) error {
+		ensembles = append(ensembles, ens)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ensembles) == 0 {
+		return nil, errors.New("no ensembles found")
+	}
+	return ensembles, nil
+}
+
+// exportDims will get the largest number of bins and beams in the ensembles.
+func exportDims(ensembles []rti.Ensemble) (int, int) {
+	numBins := 0
+	numBeams := 0
+	for _, ens := range ensembles {
+		for _, values := range [][][]float32{ens.AmplitudeData.Amplitude, ens.CorrelationData.Correlation,
+			ens.BeamVelocityData.Velocity, ens.EarthVelocityData.Velocity} {
+			if len(values) > numBins {
+				numBins = len(values)
+			}
+			if len(values) > 0 && len(values[0]) > numBeams {
+				numBeams = len(values[0])
+			}
+		}
+		if len(ens.BottomTrackData.Range) > numBeams {
+			numBeams = len(ens.BottomTrackData.Range)
+		}
+	}
+	return numBins, numBeams
+}
+
+// exportProfile will get the [ens][bin][beam] values of all the ensembles.
+// Missing and bad values are set to fill.
+func exportProfile(ensembles []rti.Ensemble, numBins int, numBeams int, fill float32, values func(ens rti.Ensemble) [][]float32) []float32 {
+	data := make([]float32, len(ensembles)*numBins*numBeams)
+	for i := range data {
+		data[i] = fill
+	}
+
+	for e, ens := range ensembles {
+		for bin, beams := range values(ens) {
+			for beam, val := range beams {
+				if bin < numBins && beam < numBeams && val != rtiBadVelocity {
+					data[(e*numBins+bin)*numBeams+beam] = val
+				}
+			}
+		}
+	}
+	return data
+}
+
+// exportSeries will get a value for each ensemble.
+func exportSeries(ensembles []rti.Ensemble, value func(ens rti.Ensemble) float32) []float32 {
+	data := make([]float32, len(ensembles))
+	for e, ens := range ensembles {
+		data[e] = value(ens)
+	}
+	return data
+}
+
+// exportBottomTrack will get the [ens][beam] bottom track values.
+// Missing and bad values are set to fill.
+func exportBottomTrack(ensembles []rti.Ensemble, numBeams int, fill float32, values func(ens rti.Ensemble) []float32) []float32 {
+	data := make([]float32, len(ensembles)*numBeams)
+	for i := range data {
+		data[i] = fill
+	}
+
+	for e, ens := range ensembles {
+		for beam, val := range values(ens) {
+			if beam < numBeams && val != rtiBadVelocity && !math.IsNaN(float64(val)) {
+				data[e*numBeams+beam] = val
+			}
+		}
+	}
+	return data
+}
+
+// firmwareVersion will get the firmware version of the ensemble.
+func firmwareVersion(ens rti.Ensemble) string {
+	fw := ens.EnsembleData.SysFirmware
+	return fmt.Sprintf("%d.%d.%d", fw.FirmwareMajor, fw.FirmwareMinor, fw.FirmwareRevision)
+}
+
+// newEnsembleNetCDF will create the netCDF file for the ensembles.
+// The ensembles should all be from the same serial number and subsystem configuration.
+func newEnsembleNetCDF(ensembles []rti.Ensemble) *ncFile {
+	first := ensembles[0]
+	numBins, numBeams := exportDims(ensembles)
+
+	nc := &ncFile{}
+	nc.attrs = []ncAttr{
+		{"Conventions", "CF-1.6"},
+		{"title", "ADCP data " + first.EnsembleData.SerialNumber.SerialNumber},
+		{"source", "ADCP"},
+		{"history", "Created by ADCP.io " + version},
+		{"serial_number", first.EnsembleData.SerialNumber.SerialNumber},
+		{"firmware_version", firmwareVersion(first)},
+		{"subsystem_config", subsystemConfig(first)},
+		{"first_bin_range", first.AncillaryData.FirstBinRange},
+		{"bin_size", first.AncillaryData.BinSize},
+	}
+
+	timeDim := nc.addDim("time", len(ensembles))
+	binDim := nc.addDim("bin", numBins)
+	beamDim := nc.addDim("beam", numBeams)
+	profileDims := []int{timeDim, binDim, beamDim}
+	btDims := []int{timeDim, beamDim}
+	fill := ncAttr{"_FillValue", ncFillFloat}
+
+	// Coordinates
+	times := make([]float64, len(ensembles))
+	ensNums := make([]int32, len(ensembles))
+	for e, ens := range ensembles {
+		times[e] = float64(ensembleTime(ens).UnixNano()) / 1e9
+		ensNums[e] = int32(ens.EnsembleData.EnsembleNumber)
+	}
+	nc.addVar("time", []int{timeDim}, times,
+		ncAttr{"standard_name", "time"},
+		ncAttr{"units", "seconds since 1970-01-01 00:00:00Z"},
+		ncAttr{"calendar", "gregorian"},
+		ncAttr{"axis", "T"})
+	nc.addVar("ensemble_number", []int{timeDim}, ensNums,
+		ncAttr{"long_name", "ensemble number"})
+
+	depths := make([]float32, numBins)
+	for bin := range depths {
+		depths[bin] = binDepth(first, bin)
+	}
+	nc.addVar("bin_depth", []int{binDim}, depths,
+		ncAttr{"long_name", "bin depth below the transducer"},
+		ncAttr{"units", "m"},
+		ncAttr{"positive", "down"},
+		ncAttr{"axis", "Z"})
+
+	beams := make([]int32, numBeams)
+	for beam := range beams {
+		beams[beam] = int32(beam)
+	}
+	nc.addVar("beam", []int{beamDim}, beams,
+		ncAttr{"long_name", "beam number"})
+
+	// Profile data
+	nc.addVar("amplitude", profileDims,
+		exportProfile(ensembles, numBins, numBeams, ncFillFloat, func(ens rti.Ensemble) [][]float32 { return ens.AmplitudeData.Amplitude }),
+		ncAttr{"long_name", "echo amplitude"}, ncAttr{"units", "dB"}, fill, ncAttr{"coordinates", "time bin_depth beam"})
+	nc.addVar("correlation", profileDims,
+		exportProfile(ensembles, numBins, numBeams, ncFillFloat, func(ens rti.Ensemble) [][]float32 { return ens.CorrelationData.Correlation }),
+		ncAttr{"long_name", "beam correlation"}, ncAttr{"units", "1"}, fill, ncAttr{"coordinates", "time bin_depth beam"})
+	nc.addVar("beam_velocity", profileDims,
+		exportProfile(ensembles, numBins, numBeams, ncFillFloat, func(ens rti.Ensemble) [][]float32 { return ens.BeamVelocityData.Velocity }),
+		ncAttr{"long_name", "beam velocity"}, ncAttr{"units", "m s-1"}, fill, ncAttr{"coordinates", "time bin_depth beam"})
+
+	// Earth velocity East, North and Vertical components
+	earth := exportProfile(ensembles, numBins, numBeams, ncFillFloat, func(ens rti.Ensemble) [][]float32 { return ens.EarthVelocityData.Velocity })
+	for i, names := range [][2]string{
+		{"eastward_velocity", "eastward_sea_water_velocity"},
+		{"northward_velocity", "northward_sea_water_velocity"},
+		{"upward_velocity", "upward_sea_water_velocity"},
+	} {
+		component := make([]float32, len(ensembles)*numBins)
+		for j := range component {
+			component[j] = ncFillFloat
+			if i < numBeams {
+				component[j] = earth[j*numBeams+i]
+			}
+		}
+		nc.addVar(names[0], []int{timeDim, binDim}, component,
+			ncAttr{"standard_name", names[1]}, ncAttr{"units", "m s-1"}, fill, ncAttr{"coordinates", "time bin_depth"})
+	}
+
+	// Ancillary data
+	nc.addVar("heading", []int{timeDim}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Heading }),
+		ncAttr{"standard_name", "platform_orientation"}, ncAttr{"units", "degree"})
+	nc.addVar("pitch", []int{timeDim}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Pitch }),
+		ncAttr{"standard_name", "platform_pitch"}, ncAttr{"units", "degree"})
+	nc.addVar("roll", []int{timeDim}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.Roll }),
+		ncAttr{"standard_name", "platform_roll"}, ncAttr{"units", "degree"})
+	nc.addVar("temperature", []int{timeDim}, exportSeries(ensembles, func(ens rti.Ensemble) float32 { return ens.AncillaryData.WaterTemp }),
+		ncAttr{"standard_name", "sea_water_temperature"}, ncAttr{"units", "degree_Celsius"})
+
+	// Bottom track data
+	nc.addVar("bt_range", btDims, exportBottomTrack(ensembles, numBeams, ncFillFloat, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.Range }),
+		ncAttr{"long_name", "bottom track range"}, ncAttr{"units", "m"}, fill)
+	nc.addVar("bt_beam_velocity", btDims, exportBottomTrack(ensembles, numBeams, ncFillFloat, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.BeamVelocity }),
+		ncAttr{"long_name", "bottom track beam velocity"}, ncAttr{"units", "m s-1"}, fill)
+	nc.addVar("bt_earth_velocity", btDims, exportBottomTrack(ensembles, numBeams, ncFillFloat, func(ens rti.Ensemble) []float32 { return ens.BottomTrackData.EarthVelocity }),
+		ncAttr{"long_name", "bottom track earth velocity"}, ncAttr{"units", "m s-1"}, fill)
+
+	return nc
+}
+
+// writeEnsembleNetCDF will write the ensembles in the data files selected by
+// the filter to a netCDF file.
+func writeEnsembleNetCDF(w io.Writer, paths []string, filter ensembleFilter) error {
+	if err := checkSingleADCPFilter(filter); err != nil {
+		return err
+	}
+	ensembles, err := readExportEnsembles(paths, filter)
+	if err != nil {
+		return err
+	}
+	return newEnsembleNetCDF(ensembles).write(w)
+}
+
+// exportNetCDFHandler will export the ensembles in a data file to netCDF.
+//
+//	/export/netcdf?file=name&serial=&config=&start=&end=
+//
+// The serial and config are required.  If file is not given, the ingested
+// files are used.
+func exportNetCDFHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEnsembleFilter(r)
+	if err == nil {
+		err = checkSingleADCPFilter(filter)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths, err := parseDataFiles(r, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	ensembles, err := readExportEnsembles(paths, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	name := safeFileName(fmt.Sprintf("%s_%s", filter.serialNum, filter.subsystemConfig))
+	w.Header().Set("Content-Type", "application/x-netcdf")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+".nc")
+	if err := newEnsembleNetCDF(ensembles).write(w); err != nil {
+		log.Println("Error writing netCDF: " + err.Error())
+	}
+}
+
+// netCDFCommand will export a data file to netCDF from the command line.
+//
+//	adcpio netcdf -in file -out file.nc -serial num -config cfg -start time -end time
+func netCDFCommand(args []string) error {
+	cmd := flag.NewFlagSet("netcdf", flag.ExitOnError)
+	in := cmd.String("in", "", "RTI binary, PD0 or JSON-lines data file")
+	out := cmd.String("out", "", "netCDF file to create")
+	serial := cmd.String("serial", "", "serial number of the ADCP")
+	config := cmd.String("config", "", "subsystem configuration of the ADCP")
+	start := cmd.String("start", "", "start time in RFC3339")
+	end := cmd.String("end", "", "end time in RFC3339")
+	cmd.Parse(args)
+
+	if *in == "" || *out == "" {
+		cmd.Usage()
+		return errors.New("-in and -out are required")
+	}
+
+	filter, err := newEnsembleFilter(*serial, *config, *start, *end)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeEnsembleNetCDF(f, []string{*in}, filter); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteCSVFiles(t *testing.T) {
+	var data []byte
+	for num := uint32(1); num <= 3; num++ {
+		ens := pd0TestEnsemble()
+		ens.EnsembleData.EnsembleNumber = num
+		data = append(data, encodeRtiEnsemble(ens)...)
+	}
+	path := filepath.Join(t.TempDir(), "export.ens")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{path}
+
+	files, err := writeCSVFiles(paths, ensembleFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCSVFiles(files)
+
+	// Each file is the same as the data set written on its own
+	for i, dataSet := range csvDataSets {
+		var want bytes.Buffer
+		if err := writeCSV(&want, paths, ensembleFilter{}, dataSet); err != nil {
+			t.Fatal(err)
+		}
+		files[i].Seek(0, io.SeekStart)
+		got, err := io.ReadAll(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("%s file does not match the data set", dataSet)
+		}
+		if dataSet == "ancillary" && bytes.Count(got, []byte("\n")) != 4 {
+			t.Errorf("%s file has %d lines, want a header and 3 ensembles", dataSet, bytes.Count(got, []byte("\n")))
+		}
+	}
+
+	if _, err := writeCSVFiles([]string{filepath.Join(t.TempDir(), "missing.ens")}, ensembleFilter{}); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
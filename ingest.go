@@ -0,0 +1,378 @@
+///
+/// Ingest the uploaded data files in the background.
+///
+/// Each file is decoded and its ensembles are indexed by serial number,
+/// subsystem configuration and time range, so the file can be found
+/// for replay and export.
+///
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// Ingest job states.
+const (
+	ingestQueued  = "queued"  // Waiting to be ingested
+	ingestRunning = "running" // Decoding the file
+	ingestDone    = "done"    // File is indexed
+	ingestFailed  = "failed"  // File could not be decoded
+)
+
+// Number of finished jobs kept for the job status, in addition to the
+// jobs that index the stored files.
+const ingestKeepJobs = 100
+
+// ingestRange is the ensembles of an ADCP found in a file.
+type ingestRange struct {
+	SerialNum       string    // Serial number
+	SubsystemConfig string    // Subsystem configuration
+	Start           time.Time // Time of the first ensemble
+	End             time.Time // Time of the last ensemble
+	FirstEnsemble   uint32    // First ensemble number
+	LastEnsemble    uint32    // Last ensemble number
+	EnsembleCount   int       // Number of ensembles
+}
+
+// ingestJob is the ingest of an uploaded file.
+type ingestJob struct {
+	ID            string         // Job ID
+	File          string         // Stored file name
+	path          string         // Path to the file in the upload folder
+	Format        string         // File format
+	State         string         // Job state
+	Error         string         // Error if the job failed
+	EnsembleCount int            // Number of ensembles decoded
+	Created       time.Time      // Time the job was created
+	Finished      time.Time      // Time the job finished
+	Ranges        []*ingestRange // Ensembles of each ADCP in the file
+}
+
+// ingester will ingest the uploaded files one at a time
+// and keep the index of the ingested files.
+type ingester struct {
+	mutex   sync.Mutex            // Lock the jobs
+	nextID  int                   // ID of the next job
+	jobs    map[string]*ingestJob // All the jobs.  Key is the job ID
+	pending []*ingestJob          // Jobs waiting to be ingested
+	wake    chan bool             // Wake the ingest when a job is added
+}
+
+// ingest is the ingest of all the uploaded files.
+var ingest = &ingester{
+	nextID: 1,                           // First job ID
+	jobs:   make(map[string]*ingestJob), // All the jobs
+	wake:   make(chan bool, 1),          // Wake the ingest
+}
+
+// add will create a job to ingest the stored file.
+func (in *ingester) add(name string) ingestJob {
+	in.mutex.Lock()
+	job := &ingestJob{
+		ID:      strconv.Itoa(in.nextID),
+		File:    name,
+		State:   ingestQueued,
+		Created: time.Now(),
+	}
+	in.nextID++
+	in.jobs[job.ID] = job
+	in.pending = append(in.pending, job)
+	status := *job
+	in.mutex.Unlock()
+
+	// Wake the ingest
+	select {
+	case in.wake <- true:
+	default:
+	}
+	return status
+}
+
+// remove will remove the jobs of the stored file from the index.
+func (in *ingester) remove(name string) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	for id, job := range in.jobs {
+		if job.File == name {
+			delete(in.jobs, id)
+		}
+	}
+}
+
+// run will ingest the jobs in the order they were added.
+func (in *ingester) run() {
+	for {
+		in.mutex.Lock()
+		if len(in.pending) == 0 {
+			// Wait for a job
+			in.mutex.Unlock()
+			<-in.wake
+			continue
+		}
+		job := in.pending[0]
+		in.pending = in.pending[1:]
+		in.mutex.Unlock()
+
+		in.process(job)
+	}
+}
+
+// process will decode the file and index the ensembles.
+func (in *ingester) process(job *ingestJob) {
+	in.mutex.Lock()
+	job.State = ingestRunning
+	in.mutex.Unlock()
+
+	path, err := uploads.path(job.File)
+	format := ""
+	if err == nil {
+		format, err = detectDataFormat(path)
+	}
+	if err == nil && format == "" {
+		err = errors.New("unknown file format")
+	}
+
+	// Find the range of ensembles of each ADCP
+	ranges := make(map[string]*ingestRange)
+	count := 0
+	if err == nil {
+		err = readEnsembleFile(path, func(ens rti.Ensemble) error {
+			serial := ens.EnsembleData.SerialNumber.SerialNumber
+			config := subsystemConfig(ens)
+			ensTime := ensembleTime(ens)
+			ensNum := ens.EnsembleData.EnsembleNumber
+
+			key := adcpKey(serial, config)
+			ensRange, ok := ranges[key]
+			if !ok {
+				ensRange = &ingestRange{
+					SerialNum:       serial,
+					SubsystemConfig: config,
+					Start:           ensTime,
+					End:             ensTime,
+					FirstEnsemble:   ensNum,
+					LastEnsemble:    ensNum,
+				}
+				ranges[key] = ensRange
+			}
+			if ensTime.Before(ensRange.Start) {
+				ensRange.Start = ensTime
+				ensRange.FirstEnsemble = ensNum
+			}
+			if ensTime.After(ensRange.End) {
+				ensRange.End = ensTime
+				ensRange.LastEnsemble = ensNum
+			}
+			ensRange.EnsembleCount++
+			count++
+			return nil
+		})
+	}
+	if err == nil && count == 0 {
+		err = errors.New("no ensembles found")
+	}
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	defer in.expire()
+
+	job.path = path
+	job.Format = format
+	job.EnsembleCount = count
+	job.Finished = time.Now()
+	if err != nil {
+		job.State = ingestFailed
+		job.Error = err.Error()
+		log.Printf("Ingest of %s failed: %s", job.File, job.Error)
+		return
+	}
+
+	job.State = ingestDone
+	for _, ensRange := range ranges {
+		job.Ranges = append(job.Ranges, ensRange)
+	}
+	sort.Slice(job.Ranges, func(i, j int) bool {
+		return job.Ranges[i].Start.Before(job.Ranges[j].Start)
+	})
+	log.Printf("Ingested %d ensembles from %s", count, job.File)
+}
+
+// expire will remove the oldest finished jobs, so the jobs do not grow
+// with every upload.  The jobs that index the stored files and the jobs
+// not finished are kept.  The mutex must be locked.
+func (in *ingester) expire() {
+	latest := in.latest()
+	var finished []*ingestJob
+	for _, job := range in.jobs {
+		if job.State != ingestDone && job.State != ingestFailed {
+			continue
+		}
+		if latest[job.File] == job {
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) <= ingestKeepJobs {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].Finished.After(finished[j].Finished)
+	})
+	for _, job := range finished[ingestKeepJobs:] {
+		delete(in.jobs, job.ID)
+	}
+}
+
+// status will get the state of the job.
+func (in *ingester) status(id string) (ingestJob, bool) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	job, ok := in.jobs[id]
+	if !ok {
+		return ingestJob{}, false
+	}
+	return *job, true
+}
+
+// list will get the state of all the jobs in the order they were created.
+func (in *ingester) list() []ingestJob {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	jobs := make([]ingestJob, 0, len(in.jobs))
+	for _, job := range in.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		a, _ := strconv.Atoi(jobs[i].ID)
+		b, _ := strconv.Atoi(jobs[j].ID)
+		return a < b
+	})
+	return jobs
+}
+
+// latest will get the last finished job of each file.  A file
+// uploaded again replaces the index of the earlier upload.
+func (in *ingester) latest() map[string]*ingestJob {
+	files := make(map[string]*ingestJob)
+	for _, job := range in.jobs {
+		if job.State != ingestDone {
+			continue
+		}
+		if last, ok := files[job.File]; !ok || job.Finished.After(last.Finished) {
+			files[job.File] = job
+		}
+	}
+	return files
+}
+
+// overlaps will check if the filter selects any ensembles in the range.
+func (filter ensembleFilter) overlaps(ensRange *ingestRange) bool {
+	if filter.serialNum != "" && filter.serialNum != ensRange.SerialNum {
+		return false
+	}
+	if filter.subsystemConfig != "" && filter.subsystemConfig != ensRange.SubsystemConfig {
+		return false
+	}
+	if !filter.start.IsZero() && ensRange.End.Before(filter.start) {
+		return false
+	}
+	if !filter.end.IsZero() && ensRange.Start.After(filter.end) {
+		return false
+	}
+	return true
+}
+
+// find will get the ingested files with ensembles selected by the filter.
+// The files are in the order of their first selected ensemble.
+func (in *ingester) find(filter ensembleFilter) []string {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	starts := make(map[string]time.Time)
+	var paths []string
+	for _, job := range in.latest() {
+		for _, ensRange := range job.Ranges {
+			if !filter.overlaps(ensRange) {
+				continue
+			}
+			if start, ok := starts[job.path]; !ok {
+				paths = append(paths, job.path)
+				starts[job.path] = ensRange.Start
+			} else if ensRange.Start.Before(start) {
+				starts[job.path] = ensRange.Start
+			}
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return starts[paths[i]].Before(starts[paths[j]])
+	})
+	return paths
+}
+
+// ingestIndexEntry is an ADCP's ensembles in an ingested file.
+type ingestIndexEntry struct {
+	File string // File name
+	ingestRange
+}
+
+// index will get the ensembles of each ADCP in the ingested files
+// selected by the filter.
+func (in *ingester) index(filter ensembleFilter) []ingestIndexEntry {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	entries := []ingestIndexEntry{}
+	for _, job := range in.latest() {
+		for _, ensRange := range job.Ranges {
+			if filter.overlaps(ensRange) {
+				entries = append(entries, ingestIndexEntry{File: job.File, ingestRange: *ensRange})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Start.Before(entries[j].Start)
+	})
+	return entries
+}
+
+// ingestHandler will give the state of the ingest jobs and the index.
+//
+//	/ingest/jobs                                 List all the jobs
+//	/ingest/status?id=job                        Get the state of a job
+//	/ingest/index?serial=&config=&start=&end=    List the ingested ensembles of each ADCP
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/ingest/") {
+	case "jobs":
+		writeJSON(w, ingest.list())
+	case "status":
+		job, ok := ingest.status(r.FormValue("id"))
+		if !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, job)
+	case "index":
+		filter, err := parseEnsembleFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, ingest.index(filter))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIngesterExpire(t *testing.T) {
+	in := &ingester{jobs: make(map[string]*ingestJob)}
+	start := time.Now()
+	addJob := func(id int, file string, state string) *ingestJob {
+		job := &ingestJob{
+			ID:       strconv.Itoa(id),
+			File:     file,
+			State:    state,
+			Finished: start.Add(time.Duration(id) * time.Second),
+		}
+		in.jobs[job.ID] = job
+		return job
+	}
+
+	// The first upload is indexed and uploaded again many times after
+	index := addJob(1, "first.ens", ingestDone)
+	queued := addJob(2, "queued.ens", ingestQueued)
+	for id := 3; id < ingestKeepJobs+20; id++ {
+		addJob(id, "again.ens", ingestFailed)
+	}
+	last := addJob(ingestKeepJobs+20, "again.ens", ingestDone)
+
+	in.expire()
+	if len(in.jobs) != ingestKeepJobs+3 {
+		t.Errorf("%d jobs kept, want %d", len(in.jobs), ingestKeepJobs+3)
+	}
+	for _, job := range []*ingestJob{index, queued, last} {
+		if in.jobs[job.ID] != job {
+			t.Errorf("job %s of %s expired", job.ID, job.File)
+		}
+	}
+	if _, ok := in.jobs["3"]; ok {
+		t.Error("oldest finished job not expired")
+	}
+	if _, ok := in.jobs[strconv.Itoa(ingestKeepJobs+19)]; !ok {
+		t.Error("newest finished job expired")
+	}
+}
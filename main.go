@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"text/template"
+	"time"
 )
 
 // Flags to set at startup
@@ -13,19 +15,132 @@ var (
 	version      = "0.1"
 	versionFloat = float32(0.1)
 	addr         = flag.String("addr", ":8080", "http service address")
+	tcpAddr      = flag.String("tcp", "", "tcp ingest listen address for ADCP bridges")
+	tcpDial      = flag.String("tcpdial", "", "comma separated host:port list of ADCP bridges to connect to")
+	tcpIdle      = flag.Duration("tcpidle", 0, "time without data before a tcp ingest connection is dropped, 0 to only use the tcp keepalive")
+	udpAddr      = flag.String("udp", "", "udp ingest listen address")
+	udpGroup     = flag.String("udpgroup", "", "multicast group to join for udp ingest")
+	replayFile   = flag.String("replay", "", "recorded ensemble file to load for replay")
+	hprWindow    = flag.Int("hprwindow", 20, "number of heading, pitch and roll samples to display for each ADCP")
+	btWindow     = flag.Int("btwindow", 100, "number of bottom track samples to display for each ADCP")
+	beamWindow   = flag.Int("beamwindow", 10, "number of ensembles of beam velocity to display for each ADCP")
+	xdcrDepth    = flag.Bool("xdcrdepth", false, "add the transducer depth to the bin depths of the velocity profile")
+	averageCount = flag.Int("avgcount", 10, "number of ensembles to average for the displays, 0 to average by time only")
+	averageTime  = flag.Duration("avgtime", 0, "time of the ensembles to average for the displays, 0 to average by count only")
+	beamAngle    = flag.Float64("beamangle", 20, "beam angle in degrees to transform the beam velocities")
+	declination  = flag.Float64("declination", 0, "magnetic declination in degrees to transform to earth velocities")
+	shipOffset   = flag.Float64("shipoffset", 0, "angle in degrees of the ADCP X axis from the ship's bow")
+	binMapping   = flag.Bool("binmap", true, "map the bins of the tilted beams to the same depth when transforming")
+	powerExp     = flag.Float64("powerexp", 1.0/6, "power law exponent to extrapolate the top and bottom discharge")
+	waveBurst    = flag.Int("waveburst", 0, "samples in a wave burst of each ADCP, 0 to not process waves")
+	waveHeight   = flag.Float64("waveheight", 0, "height in meters of the wave ADCP above the bottom")
+	waveBin      = flag.Int("wavebin", -1, "bin of the wave velocity, -1 to select the bin near the surface")
+	screenCorr   = flag.Float64("screencorr", 0, "lowest correlation, 0 to 1, of the displayed velocities, 0 to not screen")
+	screenAmp    = flag.Float64("screenamp", 0, "lowest amplitude in dB of the displayed velocities, 0 to not screen")
+	screenErrVel = flag.Float64("screenerrvel", 0, "largest error velocity in m/s of the displayed velocities, 0 to not screen")
+	screenGood   = flag.Float64("screengood", 0, "lowest percent good of the displayed velocities, 0 to not screen")
+	screenBottom = flag.Bool("screenbottom", false, "screen the displayed velocities below the bottom")
+	screenTilt   = flag.Float64("screentilt", 0, "largest tilt in degrees of the displayed velocities, 0 to not screen")
+	recordOn     = flag.Bool("record", false, "start recording the ensembles at startup")
+	recordDir    = flag.String("recorddir", "record", "folder to record the ensembles to")
+	recordFormat = flag.String("recordformat", recordFormatRti, "recording format, rti, json or pd0")
+	recordSize   = flag.Int64("recordsize", 100, "largest recording file size in MB")
+	recordTime   = flag.Duration("recordtime", time.Hour, "longest time to record to a file")
+	uploadDir    = flag.String("uploaddir", "/home/ubuntu/upload", "folder to store the uploaded files")
+	uploadMax    = flag.Int64("uploadmax", 4096, "largest upload file size in MB, 0 for no limit")
+	s3Endpoint   = flag.String("s3endpoint", "", "S3-compatible endpoint to also store the uploaded files, e.g. http://localhost:9000")
+	s3Bucket     = flag.String("s3bucket", "adcpio", "S3 bucket to store the uploaded files")
+	s3Region     = flag.String("s3region", "us-east-1", "S3 region")
+	trustProxy   = flag.String("trustproxy", "", "comma separated addresses of the proxies trusted to give the uploader address in X-Forwarded-For")
 )
 
 // main will start the application.
 func main() {
+	// Run a command instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "netcdf" {
+		if err := netCDFCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "waves" {
+		if err := wavesCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Parse the flags
 	flag.Parse()
 
 	// setup logging
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
+	// Transform the beam velocities when the ADCP did not output the earth velocities
+	transform.configure(*beamAngle, *declination, *shipOffset, *binMapping)
+
+	// Screen the ensembles before they are displayed
+	screens.setDefaults(screenConfig{
+		MinCorrelation:   float32(*screenCorr),
+		MinAmplitude:     float32(*screenAmp),
+		MaxErrorVelocity: float32(*screenErrVel),
+		MinPercentGood:   float32(*screenGood),
+		BelowBottom:      *screenBottom,
+		MaxTilt:          float32(*screenTilt),
+	})
+
+	// Process the wave bursts
+	waves.configure(*waveBurst, *waveHeight, *waveBin)
+
 	// Run the server
 	go server.run()
 
+	// TCP ingest from the ADCP bridges
+	startTCPIngest(*tcpAddr, *tcpDial, *tcpIdle)
+
+	// UDP ingest from the ship LAN
+	startUDPIngest(*udpAddr, *udpGroup)
+
+	// Record the ensembles
+	record.configure(*recordDir, *recordFormat, *recordSize*1024*1024, *recordTime)
+	if *recordOn {
+		if err := record.start(); err != nil {
+			log.Println("Error starting recording: " + err.Error())
+		}
+	}
+
+	// Store the uploaded files.  The S3 keys are from the environment
+	var s3 *s3Client
+	if *s3Endpoint != "" {
+		var err error
+		s3, err = newS3Client(*s3Endpoint, *s3Bucket, *s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	uploads.configure(*uploadDir, *uploadMax*1024*1024, s3)
+	setTrustedProxies(*trustProxy)
+	if err := uploads.load(); err != nil {
+		log.Println("Error loading the upload store: " + err.Error())
+	}
+	if err := chunkUploads.load(); err != nil {
+		log.Println("Error loading the chunked uploads: " + err.Error())
+	}
+
+	// Ingest the uploaded files
+	go ingest.run()
+	for _, file := range uploads.list() {
+		ingest.add(file.Name)
+	}
+
+	// Replay recorded files
+	go replay.run()
+	if *replayFile != "" {
+		if err := replay.load([]string{*replayFile}, ensembleFilter{}); err != nil {
+			log.Println("Error loading replay file: " + err.Error())
+		}
+	}
+
 	// HTTP server
 	http.Handle("/libs/", http.StripPrefix("/libs/", http.FileServer(http.Dir("libs")))) // External libs
 	http.HandleFunc("/", debugHandler)                                                   // Debugger
@@ -41,6 +156,19 @@ func main() {
 	http.HandleFunc("/upload", uploadHandler)                                            // Upload a file to the upload folder
 	http.HandleFunc("/multiupload", multiUploadHandler)                                  // Upload multiple files to the upload folder
 	http.HandleFunc("/multiuploadform", multiUploadFormHandler)                          // Upload multiple files to the upload folder
+	http.HandleFunc("/chunkupload/", chunkUploadHandler)                                 // Resumable chunked upload of large files
+	http.HandleFunc("/replay/", replayHandler)                                           // Replay a recorded file
+	http.HandleFunc("/record/", recordHandler)                                           // Record the ensembles
+	http.HandleFunc("/api/adcps", apiHandler)                                            // REST API list of ADCP
+	http.HandleFunc("/api/adcps/", apiHandler)                                           // REST API ADCP data
+	http.HandleFunc("/api/screen", screenHandler)                                        // REST API screening thresholds
+	http.HandleFunc("/api/waves", wavesHandler)                                          // REST API last wave results
+	http.HandleFunc("/api/waves/file", wavesFileHandler)                                 // REST API wave results of a data file
+	http.HandleFunc("/export/csv", exportCSVHandler)                                     // Export a data file to CSV
+	http.HandleFunc("/export/netcdf", exportNetCDFHandler)                               // Export a data file to netCDF
+	http.HandleFunc("/export/mat", exportMatHandler)                                     // Export a data file to MATLAB
+	http.HandleFunc("/ingest/", ingestHandler)                                           // Ingest jobs of the uploaded files
+	http.HandleFunc("/uploads/", storageHandler)                                         // List, download and delete the uploaded files
 	http.HandleFunc("/ws", wsHandler)                                                    // wsHandler in websocketConn.go.  Creates websocket
 	http.HandleFunc("/wsAdcp", wsAdcpDisplayHandler)                                     // wsHandler in websocketConn.go.  Creates websocket
 	if err := http.ListenAndServe(*addr, nil); err != nil {
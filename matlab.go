@@ -0,0 +1,222 @@
+///
+/// Write MATLAB files.
+///
+/// The files use the MATLAB level 5 MAT-file format without
+/// compression.  This format is read by MATLAB, Octave and scipy.
+///
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// MAT-file data types.
+const (
+	miInt8   = 1  // 8 bit integer
+	miUint16 = 4  // 16 bit unsigned integer
+	miInt32  = 5  // 32 bit integer
+	miUint32 = 6  // 32 bit unsigned integer
+	miSingle = 7  // 32 bit float
+	miDouble = 9  // 64 bit float
+	miMatrix = 14 // MATLAB array
+)
+
+// MATLAB array classes.
+const (
+	mxCharClass   = 4 // Character array
+	mxDoubleClass = 6 // Double array
+	mxSingleClass = 7 // Single array
+)
+
+const (
+	matHeaderTextSize = 116    // Size of the descriptive text in the header
+	matVersion        = 0x0100 // MAT-file version
+	matTagSize        = 8      // Size of the data element tag
+)
+
+// matVar is a MATLAB variable.
+// The data is a []float32, []float64 or string.  The values are given
+// in the order of the dimensions with the last dimension changing the
+// fastest, and are written in the column order MATLAB uses.
+type matVar struct {
+	name string      // Variable name
+	dims []int       // Length of each dimension
+	data interface{} // Variable data
+}
+
+// matFile is a MATLAB file.
+type matFile struct {
+	vars []*matVar // Variables
+}
+
+// addVar will add the variable.
+func (mat *matFile) addVar(name string, dims []int, data interface{}) {
+	mat.vars = append(mat.vars, &matVar{name: name, dims: dims, data: data})
+}
+
+// matType will get the MAT-file data type, array class and number of values of the data.
+func matType(data interface{}) (int, int, int, error) {
+	switch v := data.(type) {
+	case string:
+		return miUint16, mxCharClass, len(v), nil
+	case []float32:
+		return miSingle, mxSingleClass, len(v), nil
+	case []float64:
+		return miDouble, mxDoubleClass, len(v), nil
+	}
+	return 0, 0, 0, errors.New("unsupported MATLAB data type")
+}
+
+// matTypeSize is the size in bytes of each MAT-file data type.
+var matTypeSize = map[int]int{miInt8: 1, miUint16: 2, miInt32: 4, miUint32: 4, miSingle: 4, miDouble: 8}
+
+// matPad will get the number of bytes to pad n to an 8 byte boundary.
+func matPad(n int) int {
+	return (8 - n%8) % 8
+}
+
+// matColumnOrder will get the index of each value in column order.
+// The values are given with the last dimension changing the fastest.
+func matColumnOrder(dims []int) []int {
+	count := 1
+	for _, dim := range dims {
+		count *= dim
+	}
+
+	order := make([]int, count)
+	index := make([]int, len(dims))
+	for i := range order {
+		// Row order index of the column order position
+		row := 0
+		for d := range dims {
+			row = row*dims[d] + index[d]
+		}
+		order[i] = row
+
+		// Next column order position, the first dimension changing the fastest
+		for d := range index {
+			index[d]++
+			if index[d] < dims[d] {
+				break
+			}
+			index[d] = 0
+		}
+	}
+	return order
+}
+
+// matWriter will write the little endian MAT-file values.
+type matWriter struct {
+	w   *bufio.Writer // Buffered output
+	err error         // First error writing
+}
+
+// write will write the value in little endian.
+func (w *matWriter) write(v interface{}) {
+	if w.err == nil {
+		w.err = binary.Write(w.w, binary.LittleEndian, v)
+	}
+}
+
+// writeElement will write the tag, data and padding of the data element.
+func (w *matWriter) writeElement(dataType int, count int, data interface{}) {
+	size := count * matTypeSize[dataType]
+	w.write([]uint32{uint32(dataType), uint32(size)})
+	w.write(data)
+	w.write(make([]byte, matPad(size)))
+}
+
+// size will get the size in bytes of the array without its tag.
+func (v *matVar) size() int {
+	dataType, _, count, _ := matType(v.data)
+	size := 0
+	for _, n := range []int{2 * 4, len(v.dims) * 4, len(v.name), count * matTypeSize[dataType]} {
+		size += matTagSize + n + matPad(n)
+	}
+	return size
+}
+
+// writeVar will write the variable as a MATLAB array.
+func (w *matWriter) writeVar(v *matVar) {
+	dataType, class, count, _ := matType(v.data)
+
+	w.write([]uint32{miMatrix, uint32(v.size())})
+
+	// Array flags and dimensions
+	w.writeElement(miUint32, 2, []uint32{uint32(class), 0})
+	dims := make([]int32, len(v.dims))
+	for i, dim := range v.dims {
+		dims[i] = int32(dim)
+	}
+	w.writeElement(miInt32, len(dims), dims)
+
+	// Name
+	w.writeElement(miInt8, len(v.name), []byte(v.name))
+
+	// Data in column order
+	order := matColumnOrder(v.dims)
+	switch data := v.data.(type) {
+	case string:
+		chars := make([]uint16, len(data))
+		for i := range chars {
+			chars[i] = uint16(data[order[i]])
+		}
+		w.writeElement(dataType, count, chars)
+	case []float32:
+		values := make([]float32, len(data))
+		for i := range values {
+			values[i] = data[order[i]]
+		}
+		w.writeElement(dataType, count, values)
+	case []float64:
+		values := make([]float64, len(data))
+		for i := range values {
+			values[i] = data[order[i]]
+		}
+		w.writeElement(dataType, count, values)
+	}
+}
+
+// write will write the MATLAB file.
+func (mat *matFile) write(out io.Writer) error {
+	// Verify the data matches the dimensions.  MATLAB arrays
+	// have at least 2 dimensions.
+	for _, v := range mat.vars {
+		if len(v.dims) == 1 {
+			v.dims = append(v.dims, 1)
+		}
+		count := 1
+		for _, dim := range v.dims {
+			count *= dim
+		}
+		if _, _, n, err := matType(v.data); err != nil || n != count || len(v.dims) < 2 {
+			return errors.New("variable " + v.name + " does not match its dimensions")
+		}
+	}
+
+	w := &matWriter{w: bufio.NewWriter(out)}
+
+	// Header text, no subsystem data, version and endian indicator
+	text := make([]byte, matHeaderTextSize)
+	for i := range text {
+		text[i] = ' '
+	}
+	copy(text, "MATLAB 5.0 MAT-file, Created by: ADCP.io "+version+", Created on: "+time.Now().Format(time.ANSIC))
+	w.write(text)
+	w.write(make([]byte, 8))
+	w.write(uint16(matVersion))
+	w.write([]byte{'I', 'M'})
+
+	for _, v := range mat.vars {
+		w.writeVar(v)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
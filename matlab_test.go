@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// matReadVar is a variable read back from a MATLAB file.
+type matReadVar struct {
+	class  int       // Array class
+	dims   []int     // Length of each dimension
+	values []float64 // Numeric values in column order
+	text   string    // Character values in column order
+}
+
+// readMat is a minimal MAT-file reader for the arrays written by matFile.
+func readMat(t *testing.T, data []byte) map[string]matReadVar {
+	t.Helper()
+	if len(data) < 128 || !bytes.HasPrefix(data, []byte("MATLAB 5.0 MAT-file")) {
+		t.Fatal("missing MAT-file header")
+	}
+	if binary.LittleEndian.Uint16(data[124:]) != matVersion || string(data[126:128]) != "IM" {
+		t.Fatal("bad MAT-file version or endian indicator")
+	}
+
+	// element will read the data element at the offset and return its
+	// type, data and the offset of the next element.
+	element := func(offset int) (uint32, []byte, int) {
+		dataType := binary.LittleEndian.Uint32(data[offset:])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		start := offset + matTagSize
+		if start+size > len(data) {
+			t.Fatalf("element at %d is larger than the file", offset)
+		}
+		return dataType, data[start : start+size], start + size + matPad(size)
+	}
+
+	vars := make(map[string]matReadVar)
+	offset := 128
+	for offset < len(data) {
+		dataType, _, next := element(offset)
+		if dataType != miMatrix {
+			t.Fatalf("element type %d, want miMATRIX", dataType)
+		}
+
+		var v matReadVar
+		_, flags, pos := element(offset + matTagSize)
+		v.class = int(binary.LittleEndian.Uint32(flags) & 0xFF)
+		_, dims, pos := element(pos)
+		for i := 0; i < len(dims); i += 4 {
+			v.dims = append(v.dims, int(int32(binary.LittleEndian.Uint32(dims[i:]))))
+		}
+		_, name, pos := element(pos)
+		realType, real, _ := element(pos)
+
+		switch realType {
+		case miUint16:
+			for i := 0; i < len(real); i += 2 {
+				v.text += string(rune(binary.LittleEndian.Uint16(real[i:])))
+			}
+		case miSingle:
+			for i := 0; i < len(real); i += 4 {
+				v.values = append(v.values, float64(math.Float32frombits(binary.LittleEndian.Uint32(real[i:]))))
+			}
+		case miDouble:
+			for i := 0; i < len(real); i += 8 {
+				v.values = append(v.values, math.Float64frombits(binary.LittleEndian.Uint64(real[i:])))
+			}
+		default:
+			t.Fatalf("variable %s has data type %d", name, realType)
+		}
+
+		vars[string(name)] = v
+		offset = next
+	}
+	return vars
+}
+
+// matAt will get the value at the index in the column order values.
+func matAt(v matReadVar, index ...int) float64 {
+	pos := 0
+	for d := len(index) - 1; d >= 0; d-- {
+		pos = pos*v.dims[d] + index[d]
+	}
+	return v.values[pos]
+}
+
+func TestMatColumnOrder(t *testing.T) {
+	// 2 x 3 values 0 1 2 / 3 4 5 are 0 3 1 4 2 5 in column order
+	want := []int{0, 3, 1, 4, 2, 5}
+	got := matColumnOrder([]int{2, 3})
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("matColumnOrder = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestEnsembleMat(t *testing.T) {
+	first := pd0TestEnsemble()
+	first.BeamVelocityData.Velocity = nil
+	second := pd0TestEnsemble()
+	second.EnsembleData.EnsembleNumber++
+	second.EnsembleData.Second++
+	second.AncillaryData.Heading = 90
+	second.EarthVelocityData.Velocity = [][]float32{{9, 8, 7, 6}}
+	ensembles := []rti.Ensemble{first, second}
+
+	var buf bytes.Buffer
+	if err := newEnsembleMat(ensembles).write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%8 != 0 {
+		t.Errorf("file size %d is not padded to 8 bytes", buf.Len())
+	}
+	vars := readMat(t, buf.Bytes())
+
+	if v := vars["SerialNumber"]; v.class != mxCharClass || v.text != "12345" {
+		t.Errorf("SerialNumber = %q class %d", v.text, v.class)
+	}
+
+	// Profile dimensions and values
+	amp := vars["Amplitude"]
+	if amp.class != mxSingleClass || len(amp.dims) != 3 || amp.dims[0] != 2 || amp.dims[1] != 5 || amp.dims[2] != 4 {
+		t.Fatalf("Amplitude dims = %v class %d, want [2 5 4]", amp.dims, amp.class)
+	}
+	for e, ens := range ensembles {
+		for bin := 0; bin < 5; bin++ {
+			for beam := 0; beam < 4; beam++ {
+				if got := matAt(amp, e, bin, beam); float32(got) != ens.AmplitudeData.Amplitude[bin][beam] {
+					t.Errorf("Amplitude(%d,%d,%d) = %v, want %v", e, bin, beam, got, ens.AmplitudeData.Amplitude[bin][beam])
+				}
+			}
+		}
+	}
+
+	// Bad and missing values are NaN
+	vel := vars["EarthVelocity"]
+	if got := matAt(vel, 0, 1, 2); float32(got) != first.EarthVelocityData.Velocity[1][2] {
+		t.Errorf("EarthVelocity(0,1,2) = %v, want %v", got, first.EarthVelocityData.Velocity[1][2])
+	}
+	if got := matAt(vel, 1, 0, 3); got != 6 {
+		t.Errorf("EarthVelocity(1,0,3) = %v, want 6", got)
+	}
+	if got := matAt(vel, 0, 4, 3); !math.IsNaN(got) {
+		t.Errorf("bad EarthVelocity = %v, want NaN", got)
+	}
+	if got := matAt(vel, 1, 2, 0); !math.IsNaN(got) {
+		t.Errorf("missing EarthVelocity = %v, want NaN", got)
+	}
+	for _, v := range vars["BeamVelocity"].values {
+		if !math.IsNaN(v) {
+			t.Fatal("missing BeamVelocity is not NaN")
+		}
+	}
+
+	// Series and bin depths
+	if h := vars["Heading"]; h.dims[0] != 2 || h.dims[1] != 1 || float32(h.values[0]) != first.AncillaryData.Heading || h.values[1] != 90 {
+		t.Errorf("Heading = %v dims %v", h.values, h.dims)
+	}
+	depth := vars["BinDepth"]
+	for bin, got := range depth.values {
+		if float32(got) != binDepth(first, bin) {
+			t.Errorf("BinDepth(%d) = %v, want %v", bin, got, binDepth(first, bin))
+		}
+	}
+
+	// Bottom track [ens x beam]
+	btRange := vars["BottomTrackRange"]
+	if got := matAt(btRange, 1, 2); float32(got) != second.BottomTrackData.Range[2] {
+		t.Errorf("BottomTrackRange(1,2) = %v, want %v", got, second.BottomTrackData.Range[2])
+	}
+	if got := matAt(vars["BottomTrackEarthVelocity"], 0, 3); !math.IsNaN(got) {
+		t.Errorf("bad BottomTrackEarthVelocity = %v, want NaN", got)
+	}
+
+	// Ensemble times are 1 second apart
+	times := vars["DateTime"].values
+	if diff := (times[1] - times[0]) * 24 * 60 * 60; math.Abs(diff-1) > 0.001 {
+		t.Errorf("DateTime difference = %v seconds, want 1", diff)
+	}
+}
+
+func TestExportMatHandlerSingleADCP(t *testing.T) {
+	for _, query := range []string{"", "?serial=12345", "?config=1"} {
+		rec := httptest.NewRecorder()
+		exportMatHandler(rec, httptest.NewRequest(http.MethodGet, "/export/mat"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("/export/mat%s status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMatlabDatenum(t *testing.T) {
+	got := matlabDatenum(time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC))
+	if got != 730486.5 {
+		t.Errorf("matlabDatenum = %v, want 730486.5", got)
+	}
+}
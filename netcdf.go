@@ -0,0 +1,604 @@
+///
+/// Write netCDF-4 files.
+///
+/// A netCDF-4 file is an HDF5 file.  Each dimension is an HDF5 dimension
+/// scale dataset and each variable is a dataset with a DIMENSION_LIST
+/// attribute referencing the scales of its dimensions.  Only the parts of
+/// HDF5 that netCDF-4 needs are written: a version 2 superblock, a root
+/// group with compact links, contiguous datasets and compact attributes.
+///
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// ncDim is a netCDF dimension.
+type ncDim struct {
+	name   string // Dimension name
+	length int    // Dimension length
+}
+
+// ncAttr is a netCDF attribute.
+// The value is a string, float32, float64, int32 or a slice of them.
+type ncAttr struct {
+	name  string      // Attribute name
+	value interface{} // Attribute value
+}
+
+// ncVar is a netCDF variable.
+// The data is a []float32, []float64 or []int32 with all the values
+// in the order of the dimensions.
+type ncVar struct {
+	name  string      // Variable name
+	dims  []int       // Index of each dimension
+	attrs []ncAttr    // Variable attributes
+	data  interface{} // Variable data
+}
+
+// ncFile is a netCDF file.
+type ncFile struct {
+	dims  []ncDim  // Dimensions
+	attrs []ncAttr // Global attributes
+	vars  []*ncVar // Variables
+}
+
+// addDim will add the dimension and return its index.
+func (nc *ncFile) addDim(name string, length int) int {
+	nc.dims = append(nc.dims, ncDim{name: name, length: length})
+	return len(nc.dims) - 1
+}
+
+// addVar will add the variable.
+func (nc *ncFile) addVar(name string, dims []int, data interface{}, attrs ...ncAttr) {
+	nc.vars = append(nc.vars, &ncVar{name: name, dims: dims, data: data, attrs: attrs})
+}
+
+// HDF5 object header message types.
+const (
+	h5DataspaceMessage = 0x01 // Dataspace
+	h5LinkInfoMessage  = 0x02 // Link info
+	h5DatatypeMessage  = 0x03 // Datatype
+	h5FillValueMessage = 0x05 // Fill value
+	h5LinkMessage      = 0x06 // Link
+	h5LayoutMessage    = 0x08 // Data layout
+	h5GroupInfoMessage = 0x0A // Group info
+	h5AttributeMessage = 0x0C // Attribute
+	h5AttrInfoMessage  = 0x15 // Attribute info
+)
+
+// HDF5 sizes and addresses.
+const (
+	h5SuperblockSize = 48                  // Version 2 superblock
+	h5HeapMinSize    = 4096                // Smallest global heap collection
+	h5HeapHeaderSize = 16                  // Global heap collection header
+	h5HeapObjectSize = 16                  // Global heap object header
+	h5MinCompact     = 8                   // Default largest number of compact links and attributes
+	h5MinDense       = 6                   // Default smallest number of dense links and attributes
+	h5Undefined      = ^uint64(0)          // Undefined address
+	h5Signature      = "\x89HDF\r\n\x1a\n" // Superblock signature
+)
+
+// ncDimWithoutVariable is the dimension scale name netCDF-4 uses for a
+// dimension that is not also a variable.
+const ncDimWithoutVariable = "This is a netCDF dimension but not a netCDF variable."
+
+// h5Writer will write the little endian HDF5 values.
+type h5Writer struct {
+	bytes.Buffer
+}
+
+// write will write the values in little endian.
+func (w *h5Writer) write(values ...interface{}) {
+	for _, v := range values {
+		binary.Write(w, binary.LittleEndian, v)
+	}
+}
+
+// h5NewType will get the version 1 HDF5 datatype of the class.
+func h5NewType(class uint8, fields [3]byte, size int, properties ...interface{}) []byte {
+	var w h5Writer
+	w.write(0x10|class, fields, uint32(size))
+	w.write(properties...)
+	return w.Bytes()
+}
+
+// HDF5 datatypes.
+var (
+	h5Int32Type   = h5NewType(0, [3]byte{0x08}, 4, uint16(0), uint16(32))
+	h5Float32Type = h5NewType(1, [3]byte{0x20, 31}, 4, uint16(0), uint16(32), uint8(23), uint8(8), uint8(0), uint8(23), uint32(127))
+	h5Float64Type = h5NewType(1, [3]byte{0x20, 63}, 8, uint16(0), uint16(64), uint8(52), uint8(11), uint8(0), uint8(52), uint32(1023))
+	h5RefType     = h5NewType(7, [3]byte{}, 8)
+
+	// A DIMENSION_LIST value is a variable length sequence of object
+	// references stored in the global heap.
+	h5DimListType = h5NewType(9, [3]byte{}, 16, h5RefType)
+
+	// A REFERENCE_LIST value is the dataset using the dimension scale and
+	// the index of the dimension in the dataset.
+	h5RefListType = h5NewType(6, [3]byte{2}, 12,
+		[]byte("dataset\x00"), uint32(0), [28]byte{}, h5RefType,
+		[]byte("dimension\x00\x00\x00\x00\x00\x00\x00"), uint32(8), [28]byte{}, h5Int32Type)
+)
+
+// h5StringType will get the null terminated ASCII string datatype.
+func h5StringType(size int) []byte {
+	return h5NewType(3, [3]byte{}, size)
+}
+
+// h5TypeSize will get the size in bytes of a value of the datatype.
+func h5TypeSize(datatype []byte) int {
+	return int(binary.LittleEndian.Uint32(datatype[4:]))
+}
+
+// h5Type will get the HDF5 datatype and number of values of the data.
+func h5Type(data interface{}) ([]byte, int, error) {
+	switch v := data.(type) {
+	case float32:
+		return h5Float32Type, 1, nil
+	case []float32:
+		return h5Float32Type, len(v), nil
+	case float64:
+		return h5Float64Type, 1, nil
+	case []float64:
+		return h5Float64Type, len(v), nil
+	case int32:
+		return h5Int32Type, 1, nil
+	case []int32:
+		return h5Int32Type, len(v), nil
+	}
+	return nil, 0, errors.New("unsupported netCDF data type")
+}
+
+// h5Space will get the dataspace with the dimension lengths.
+// No lengths is a scalar.
+func h5Space(lengths ...int) []byte {
+	var w h5Writer
+	spaceType := uint8(1)
+	if len(lengths) == 0 {
+		spaceType = 0
+	}
+	w.write(uint8(2), uint8(len(lengths)), uint8(0), spaceType)
+	for _, length := range lengths {
+		w.write(uint64(length))
+	}
+	return w.Bytes()
+}
+
+// h5NullSpace is the dataspace of an attribute without a value.
+var h5NullSpace = []byte{2, 0, 0, 2}
+
+// h5Attr is an HDF5 attribute.
+type h5Attr struct {
+	name     string // Attribute name
+	datatype []byte // Datatype of the values
+	space    []byte // Dataspace of the values
+	data     []byte // Values
+}
+
+// h5StringAttr will create the attribute of the null terminated string.
+func h5StringAttr(name string, value string) h5Attr {
+	return h5Attr{name, h5StringType(len(value) + 1), h5Space(), append([]byte(value), 0)}
+}
+
+// h5Int32Attr will create the scalar integer attribute.
+func h5Int32Attr(name string, value int32) h5Attr {
+	var w h5Writer
+	w.write(value)
+	return h5Attr{name, h5Int32Type, h5Space(), w.Bytes()}
+}
+
+// newH5Attr will create the attribute of the netCDF attribute the way
+// netCDF-4 does.  Text is a fixed length string and numbers are a one
+// dimension array.
+func newH5Attr(attr ncAttr) (h5Attr, error) {
+	if s, ok := attr.value.(string); ok {
+		if s == "" {
+			return h5Attr{attr.name, h5StringType(1), h5NullSpace, nil}, nil
+		}
+		return h5Attr{attr.name, h5StringType(len(s)), h5Space(), []byte(s)}, nil
+	}
+
+	datatype, count, err := h5Type(attr.value)
+	if err != nil {
+		return h5Attr{}, errors.New("attribute " + attr.name + ": " + err.Error())
+	}
+	var w h5Writer
+	w.write(attr.value)
+	return h5Attr{attr.name, datatype, h5Space(count), w.Bytes()}, nil
+}
+
+// h5Header is a version 2 HDF5 object header.
+// The attribute creation order is tracked so netCDF-4 reads the
+// attributes in the order they were added.
+type h5Header struct {
+	messages h5Writer // Header messages
+	attrs    int      // Number of attributes
+	err      error    // First message that is too large
+}
+
+// add will add the message with the attribute creation order.
+func (h *h5Header) add(msgType uint8, order int, data []byte) {
+	if len(data) > math.MaxUint16 && h.err == nil {
+		h.err = fmt.Errorf("HDF5 message of %d bytes is too large", len(data))
+	}
+	h.messages.write(msgType, uint16(len(data)), uint8(0), uint16(order))
+	h.messages.write(data)
+}
+
+// addAttr will add the attribute message.
+func (h *h5Header) addAttr(attr h5Attr) {
+	var w h5Writer
+	w.write(uint8(3), uint8(0), uint16(len(attr.name)+1), uint16(len(attr.datatype)), uint16(len(attr.space)), uint8(0))
+	w.write([]byte(attr.name), uint8(0), attr.datatype, attr.space, attr.data)
+	h.add(h5AttributeMessage, h.attrs, w.Bytes())
+	h.attrs++
+}
+
+// bytes will get the object header with the attribute info and checksum.
+func (h *h5Header) bytes() ([]byte, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	// Attribute info with creation order tracked and compact storage
+	var info h5Writer
+	info.write(uint8(0), uint8(1), uint16(h.attrs), h5Undefined, h5Undefined)
+
+	maxCompact := h.attrs
+	if maxCompact < h5MinCompact {
+		maxCompact = h5MinCompact
+	}
+
+	// Flags are a 4 byte chunk size, attribute creation order tracked
+	// and the attribute phase change values stored
+	var w h5Writer
+	w.write([]byte("OHDR"), uint8(2), uint8(0x02|0x04|0x10), uint16(maxCompact), uint16(h5MinDense))
+	w.write(uint32(6 + info.Len() + h.messages.Len()))
+	w.write(uint8(h5AttrInfoMessage), uint16(info.Len()), uint8(0), uint16(0), info.Bytes())
+	w.write(h.messages.Bytes())
+	w.write(h5Checksum(w.Bytes()))
+	return w.Bytes(), nil
+}
+
+// h5Checksum will get the Jenkins lookup3 hash HDF5 uses for checksums.
+func h5Checksum(data []byte) uint32 {
+	a := 0xdeadbeef + uint32(len(data))
+	b, c := a, a
+	if len(data) == 0 {
+		return c
+	}
+
+	// mix will mix the 3 values reversibly.
+	mix := func() {
+		a -= c
+		a ^= bits.RotateLeft32(c, 4)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 6)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 8)
+		b += a
+		a -= c
+		a ^= bits.RotateLeft32(c, 16)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 19)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 4)
+		b += a
+	}
+
+	for len(data) > 12 {
+		a += binary.LittleEndian.Uint32(data)
+		b += binary.LittleEndian.Uint32(data[4:])
+		c += binary.LittleEndian.Uint32(data[8:])
+		mix()
+		data = data[12:]
+	}
+
+	// The last 1 to 12 bytes are padded with zeros
+	var last [12]byte
+	copy(last[:], data)
+	a += binary.LittleEndian.Uint32(last[:])
+	b += binary.LittleEndian.Uint32(last[4:])
+	c += binary.LittleEndian.Uint32(last[8:])
+
+	c ^= b
+	c -= bits.RotateLeft32(b, 14)
+	a ^= c
+	a -= bits.RotateLeft32(c, 11)
+	b ^= a
+	b -= bits.RotateLeft32(a, 25)
+	c ^= b
+	c -= bits.RotateLeft32(b, 16)
+	a ^= c
+	a -= bits.RotateLeft32(c, 4)
+	b ^= a
+	b -= bits.RotateLeft32(a, 14)
+	c ^= b
+	c -= bits.RotateLeft32(b, 24)
+	return c
+}
+
+// h5Heap will get the global heap collection with an object for each
+// address.  The object indexes start at 1.
+func h5Heap(addrs []uint64) []byte {
+	size := h5HeapHeaderSize + len(addrs)*(h5HeapObjectSize+8) + h5HeapObjectSize
+	if size < h5HeapMinSize {
+		size = h5HeapMinSize
+	}
+
+	var w h5Writer
+	w.write([]byte("GCOL"), uint8(1), [3]byte{}, uint64(size))
+	for i, addr := range addrs {
+		w.write(uint16(i+1), uint16(0), uint32(0), uint64(8), addr)
+	}
+
+	// The rest of the collection is the free space object
+	free := size - w.Len()
+	w.write(uint16(0), uint16(0), uint32(0), uint64(free))
+	w.write(make([]byte, free-h5HeapObjectSize))
+	return w.Bytes()
+}
+
+// ncDataset is a dataset in the netCDF-4 file.
+type ncDataset struct {
+	name  string      // Dataset name
+	dims  []int       // Index of each dimension
+	attrs []ncAttr    // Variable attributes
+	data  interface{} // Variable data.  nil for a dimension without a variable
+	scale int         // Index of the dimension if a dimension scale, otherwise -1
+}
+
+// datasets will get the datasets of the dimensions and variables.
+// A variable with the name of its only dimension is the dimension scale.
+// The other dimensions are a scale dataset without data.
+func (nc *ncFile) datasets() []*ncDataset {
+	var sets []*ncDataset
+	for d, dim := range nc.dims {
+		coordinate := false
+		for _, v := range nc.vars {
+			if v.name == dim.name && len(v.dims) == 1 && v.dims[0] == d {
+				coordinate = true
+			}
+		}
+		if !coordinate {
+			sets = append(sets, &ncDataset{name: dim.name, dims: []int{d}, scale: d})
+		}
+	}
+
+	for _, v := range nc.vars {
+		set := &ncDataset{name: v.name, dims: v.dims, attrs: v.attrs, data: v.data, scale: -1}
+		if len(v.dims) == 1 && nc.dims[v.dims[0]].name == v.name {
+			set.scale = v.dims[0]
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// ncLayout is the address of each part of the netCDF-4 file.
+type ncLayout struct {
+	sets []uint64 // Object header of each dataset
+	data []uint64 // Data of each dataset
+	heap uint64   // Global heap collection of the dimension lists
+}
+
+// headers will get the root group and dataset object headers.
+func (nc *ncFile) headers(sets []*ncDataset, layout ncLayout) ([]byte, [][]byte, error) {
+	scales := make([]int, len(nc.dims))
+	for i, set := range sets {
+		if set.scale >= 0 {
+			scales[set.scale] = i
+		}
+	}
+
+	// The root group links to each dataset in creation order
+	maxCompact := len(sets)
+	if maxCompact < h5MinCompact {
+		maxCompact = h5MinCompact
+	}
+	var root h5Header
+	var w h5Writer
+	w.write(uint8(0), uint8(1), uint64(len(sets)), h5Undefined, h5Undefined)
+	root.add(h5LinkInfoMessage, 0, w.Bytes())
+	w.Reset()
+	w.write(uint8(0), uint8(1), uint16(maxCompact), uint16(h5MinDense))
+	root.add(h5GroupInfoMessage, 0, w.Bytes())
+	for i, set := range sets {
+		w.Reset()
+		w.write(uint8(1), uint8(0x04|0x01), uint64(i), uint16(len(set.name)), []byte(set.name), layout.sets[i])
+		root.add(h5LinkMessage, 0, w.Bytes())
+	}
+	for _, attr := range nc.attrs {
+		h5attr, err := newH5Attr(attr)
+		if err != nil {
+			return nil, nil, err
+		}
+		root.addAttr(h5attr)
+	}
+	rootHeader, err := root.bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := make([][]byte, len(sets))
+	heapIndex := 1
+	for i, set := range sets {
+		datatype := h5Float32Type
+		if set.data != nil {
+			datatype, _, _ = h5Type(set.data)
+		}
+		lengths := make([]int, len(set.dims))
+		size := h5TypeSize(datatype)
+		for j, dim := range set.dims {
+			lengths[j] = nc.dims[dim].length
+			size *= lengths[j]
+		}
+
+		var h h5Header
+		h.add(h5DataspaceMessage, 0, h5Space(lengths...))
+		h.add(h5DatatypeMessage, 0, datatype)
+
+		// Late allocation and the fill value written only if set
+		h.add(h5FillValueMessage, 0, []byte{3, 0x02 | 0x08})
+
+		w.Reset()
+		w.write(uint8(3), uint8(1), layout.data[i], uint64(size))
+		h.add(h5LayoutMessage, 0, w.Bytes())
+
+		if set.scale >= 0 {
+			// Dimension scale with the variables using it
+			name := set.name
+			if set.data == nil {
+				name = fmt.Sprintf("%s%10d", ncDimWithoutVariable, nc.dims[set.scale].length)
+			}
+			h.addAttr(h5StringAttr("CLASS", "DIMENSION_SCALE"))
+			h.addAttr(h5StringAttr("NAME", name))
+			h.addAttr(h5Int32Attr("_Netcdf4Dimid", int32(set.scale)))
+
+			w.Reset()
+			count := 0
+			for k, other := range sets {
+				for j, dim := range other.dims {
+					if other.scale < 0 && dim == set.scale {
+						w.write(layout.sets[k], int32(j))
+						count++
+					}
+				}
+			}
+			if count > 0 {
+				h.addAttr(h5Attr{"REFERENCE_LIST", h5RefListType, h5Space(count), append([]byte(nil), w.Bytes()...)})
+			}
+		} else {
+			// Heap object of the reference to the scale of each dimension
+			w.Reset()
+			for range set.dims {
+				w.write(uint32(1), layout.heap, uint32(heapIndex))
+				heapIndex++
+			}
+			h.addAttr(h5Attr{"DIMENSION_LIST", h5DimListType, h5Space(len(set.dims)), append([]byte(nil), w.Bytes()...)})
+		}
+
+		for _, attr := range set.attrs {
+			h5attr, err := newH5Attr(attr)
+			if err != nil {
+				return nil, nil, errors.New("variable " + set.name + ": " + err.Error())
+			}
+			h.addAttr(h5attr)
+		}
+
+		if headers[i], err = h.bytes(); err != nil {
+			return nil, nil, errors.New("variable " + set.name + ": " + err.Error())
+		}
+	}
+	return rootHeader, headers, nil
+}
+
+// write will write the netCDF-4 file.
+func (nc *ncFile) write(out io.Writer) error {
+	// Verify the data matches the dimensions
+	for _, v := range nc.vars {
+		count := 1
+		for _, dim := range v.dims {
+			count *= nc.dims[dim].length
+		}
+		if _, n, err := h5Type(v.data); err != nil || n != count {
+			return errors.New("variable " + v.name + " does not match its dimensions")
+		}
+	}
+
+	sets := nc.datasets()
+	names := make(map[string]bool)
+	for _, set := range sets {
+		if names[set.name] {
+			return errors.New("variable " + set.name + " has the name of another variable or dimension")
+		}
+		names[set.name] = true
+	}
+
+	// Find the size of the headers with undefined addresses
+	layout := ncLayout{
+		sets: make([]uint64, len(sets)),
+		data: make([]uint64, len(sets)),
+		heap: h5Undefined,
+	}
+	rootHeader, headers, err := nc.headers(sets, layout)
+	if err != nil {
+		return err
+	}
+
+	// The headers, then the global heap and then the data
+	addr := uint64(h5SuperblockSize + len(rootHeader))
+	for i, header := range headers {
+		layout.sets[i] = addr
+		addr += uint64(len(header))
+	}
+
+	var refs []uint64
+	for _, set := range sets {
+		if set.scale < 0 {
+			for _, dim := range set.dims {
+				for k, scale := range sets {
+					if scale.scale == dim {
+						refs = append(refs, layout.sets[k])
+					}
+				}
+			}
+		}
+	}
+	var heap []byte
+	if len(refs) > 0 {
+		heap = h5Heap(refs)
+		layout.heap = addr
+		addr += uint64(len(heap))
+	}
+
+	for i, set := range sets {
+		layout.data[i] = h5Undefined
+		if set.data != nil {
+			datatype, count, _ := h5Type(set.data)
+			layout.data[i] = addr
+			addr += uint64(count * h5TypeSize(datatype))
+		}
+	}
+	if rootHeader, headers, err = nc.headers(sets, layout); err != nil {
+		return err
+	}
+
+	// Superblock with the end of file and the root group
+	var superblock h5Writer
+	superblock.write([]byte(h5Signature), uint8(2), uint8(8), uint8(8), uint8(0))
+	superblock.write(uint64(0), h5Undefined, addr, uint64(h5SuperblockSize))
+	superblock.write(h5Checksum(superblock.Bytes()))
+
+	w := bufio.NewWriter(out)
+	w.Write(superblock.Bytes())
+	w.Write(rootHeader)
+	for _, header := range headers {
+		w.Write(header)
+	}
+	w.Write(heap)
+	for _, set := range sets {
+		if set.data != nil {
+			if err := binary.Write(w, binary.LittleEndian, set.data); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// ncFillFloat is the fill value for missing float data.
+var ncFillFloat = float32(9.96921e+36)
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// h5ReadAttr is an attribute read back from an HDF5 file.
+type h5ReadAttr struct {
+	class int    // Datatype class
+	size  int    // Datatype size
+	dims  []int  // Dataspace lengths.  nil for a scalar or null dataspace
+	data  []byte // Values
+}
+
+// h5ReadObject is an object header read back from an HDF5 file.
+type h5ReadObject struct {
+	links    map[string]uint64     // Links of a group
+	attrs    map[string]h5ReadAttr // Attributes
+	order    []string              // Attribute names in creation order
+	class    int                   // Datatype class of a dataset
+	size     int                   // Datatype size of a dataset
+	dims     []int                 // Dataspace lengths of a dataset
+	addr     uint64                // Data address of a dataset
+	dataSize uint64                // Data size of a dataset
+}
+
+// readH5Space will get the lengths of the version 2 dataspace.
+func readH5Space(t *testing.T, p []byte) []int {
+	t.Helper()
+	if p[0] != 2 {
+		t.Fatalf("dataspace version %d, want 2", p[0])
+	}
+	var dims []int
+	for i := 0; i < int(p[1]); i++ {
+		dims = append(dims, int(binary.LittleEndian.Uint64(p[4+8*i:])))
+	}
+	return dims
+}
+
+// readH5Object is a minimal reader of the version 2 object headers
+// written by ncFile.
+func readH5Object(t *testing.T, data []byte, addr uint64) h5ReadObject {
+	t.Helper()
+	p := data[addr:]
+	if string(p[:4]) != "OHDR" || p[4] != 2 {
+		t.Fatalf("no version 2 object header at %d", addr)
+	}
+	flags := p[5]
+	pos := 6
+	if flags&0x10 != 0 {
+		pos += 4
+	}
+	if flags&0x20 != 0 {
+		pos += 16
+	}
+	sizeBytes := 1 << (flags & 0x03)
+	var chunkSize int
+	for i := 0; i < sizeBytes; i++ {
+		chunkSize |= int(p[pos+i]) << (8 * i)
+	}
+	pos += sizeBytes
+	end := pos + chunkSize
+	if checksum := binary.LittleEndian.Uint32(p[end:]); checksum != h5Checksum(p[:end]) {
+		t.Fatalf("object header at %d checksum = %08x, want %08x", addr, checksum, h5Checksum(p[:end]))
+	}
+
+	obj := h5ReadObject{links: make(map[string]uint64), attrs: make(map[string]h5ReadAttr), addr: h5Undefined}
+	var orders []int
+	for pos < end {
+		msgType := p[pos]
+		size := int(binary.LittleEndian.Uint16(p[pos+1:]))
+		pos += 4
+		order := 0
+		if flags&0x04 != 0 {
+			order = int(binary.LittleEndian.Uint16(p[pos:]))
+			pos += 2
+		}
+		msg := p[pos : pos+size]
+		pos += size
+
+		switch msgType {
+		case h5DataspaceMessage:
+			obj.dims = readH5Space(t, msg)
+		case h5DatatypeMessage:
+			obj.class = int(msg[0] & 0x0F)
+			obj.size = int(binary.LittleEndian.Uint32(msg[4:]))
+		case h5LayoutMessage:
+			if msg[0] != 3 || msg[1] != 1 {
+				t.Fatalf("layout version %d class %d, want contiguous", msg[0], msg[1])
+			}
+			obj.addr = binary.LittleEndian.Uint64(msg[2:])
+			obj.dataSize = binary.LittleEndian.Uint64(msg[10:])
+		case h5LinkMessage:
+			linkFlags := msg[1]
+			i := 2
+			if linkFlags&0x08 != 0 {
+				t.Fatal("link is not a hard link")
+			}
+			if linkFlags&0x04 != 0 {
+				i += 8
+			}
+			if linkFlags&0x10 != 0 {
+				i++
+			}
+			length := 0
+			for b := 0; b < 1<<(linkFlags&0x03); b++ {
+				length |= int(msg[i]) << (8 * b)
+				i++
+			}
+			obj.links[string(msg[i:i+length])] = binary.LittleEndian.Uint64(msg[i+length:])
+		case h5AttributeMessage:
+			if msg[0] != 3 {
+				t.Fatalf("attribute version %d, want 3", msg[0])
+			}
+			nameSize := int(binary.LittleEndian.Uint16(msg[2:]))
+			typeSize := int(binary.LittleEndian.Uint16(msg[4:]))
+			spaceSize := int(binary.LittleEndian.Uint16(msg[6:]))
+			name := string(msg[9 : 9+nameSize-1])
+			datatype := msg[9+nameSize:]
+			space := datatype[typeSize:]
+			obj.attrs[name] = h5ReadAttr{
+				class: int(datatype[0] & 0x0F),
+				size:  int(binary.LittleEndian.Uint32(datatype[4:])),
+				dims:  readH5Space(t, space),
+				data:  space[spaceSize:],
+			}
+			obj.order = append(obj.order, name)
+			orders = append(orders, order)
+		}
+	}
+
+	for i, order := range orders {
+		if order != i {
+			t.Errorf("attribute %s creation order %d, want %d", obj.order[i], order, i)
+		}
+	}
+	return obj
+}
+
+// readH5HeapAddr will get the object address in the global heap object.
+func readH5HeapAddr(t *testing.T, data []byte, heap uint64, index uint32) uint64 {
+	t.Helper()
+	p := data[heap:]
+	if string(p[:4]) != "GCOL" || p[4] != 1 {
+		t.Fatalf("no global heap collection at %d", heap)
+	}
+	size := int(binary.LittleEndian.Uint64(p[8:]))
+	pos := h5HeapHeaderSize
+	for pos+h5HeapObjectSize <= size {
+		i := binary.LittleEndian.Uint16(p[pos:])
+		objSize := int(binary.LittleEndian.Uint64(p[pos+8:]))
+		if i == 0 {
+			break
+		}
+		if uint32(i) == index {
+			return binary.LittleEndian.Uint64(p[pos+h5HeapObjectSize:])
+		}
+		pos += h5HeapObjectSize + (objSize+7)/8*8
+	}
+	t.Fatalf("global heap object %d not found", index)
+	return 0
+}
+
+// readH5Float32 will get the float values of the dataset.
+func readH5Float32(t *testing.T, data []byte, obj h5ReadObject) []float32 {
+	t.Helper()
+	if obj.class != 1 || obj.size != 4 {
+		t.Fatalf("datatype class %d size %d, want float", obj.class, obj.size)
+	}
+	values := make([]float32, obj.dataSize/4)
+	for i := range values {
+		values[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[obj.addr+uint64(4*i):]))
+	}
+	return values
+}
+
+func TestH5Checksum(t *testing.T) {
+	// Test vectors of lookup3.c
+	tests := []struct {
+		data string
+		want uint32
+	}{
+		{"", 0xdeadbeef},
+		{"Four score and seven years ago", 0x17770551},
+	}
+	for _, test := range tests {
+		if got := h5Checksum([]byte(test.data)); got != test.want {
+			t.Errorf("h5Checksum(%q) = %08x, want %08x", test.data, got, test.want)
+		}
+	}
+}
+
+func TestEnsembleNetCDF(t *testing.T) {
+	first := pd0TestEnsemble()
+	second := pd0TestEnsemble()
+	second.EnsembleData.EnsembleNumber++
+	second.EnsembleData.Second++
+	second.EarthVelocityData.Velocity = [][]float32{{9, 8, 7, 6}}
+	ensembles := []rti.Ensemble{first, second}
+
+	var buf bytes.Buffer
+	if err := newEnsembleNetCDF(ensembles).write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// Superblock
+	if !bytes.HasPrefix(data, []byte(h5Signature)) || data[8] != 2 {
+		t.Fatal("missing version 2 HDF5 superblock")
+	}
+	if checksum := binary.LittleEndian.Uint32(data[44:]); checksum != h5Checksum(data[:44]) {
+		t.Fatalf("superblock checksum = %08x, want %08x", checksum, h5Checksum(data[:44]))
+	}
+	if eof := binary.LittleEndian.Uint64(data[28:]); eof != uint64(len(data)) {
+		t.Errorf("end of file = %d, want %d", eof, len(data))
+	}
+	root := readH5Object(t, data, binary.LittleEndian.Uint64(data[36:]))
+
+	if attr := root.attrs["serial_number"]; attr.class != 3 || string(attr.data) != "12345" {
+		t.Errorf("serial_number = %q class %d", attr.data, attr.class)
+	}
+	objects := make(map[string]h5ReadObject)
+	for name, addr := range root.links {
+		objects[name] = readH5Object(t, data, addr)
+	}
+
+	// Dimension scales
+	for _, name := range []string{"time", "bin", "beam"} {
+		if class := objects[name].attrs["CLASS"]; string(class.data) != "DIMENSION_SCALE\x00" {
+			t.Errorf("%s CLASS = %q", name, class.data)
+		}
+	}
+	bin := objects["bin"]
+	if !strings.HasPrefix(string(bin.attrs["NAME"].data), ncDimWithoutVariable) {
+		t.Errorf("bin NAME = %q", bin.attrs["NAME"].data)
+	}
+	if len(bin.dims) != 1 || bin.dims[0] != 5 || bin.addr != h5Undefined {
+		t.Errorf("bin dims = %v address %x, want [5] without data", bin.dims, bin.addr)
+	}
+
+	// Profile dimensions and values
+	amp := objects["amplitude"]
+	if len(amp.dims) != 3 || amp.dims[0] != 2 || amp.dims[1] != 5 || amp.dims[2] != 4 {
+		t.Fatalf("amplitude dims = %v, want [2 5 4]", amp.dims)
+	}
+	values := readH5Float32(t, data, amp)
+	for e, ens := range ensembles {
+		for bin := 0; bin < 5; bin++ {
+			for beam := 0; beam < 4; beam++ {
+				if got := values[(e*5+bin)*4+beam]; got != ens.AmplitudeData.Amplitude[bin][beam] {
+					t.Errorf("amplitude[%d][%d][%d] = %v, want %v", e, bin, beam, got, ens.AmplitudeData.Amplitude[bin][beam])
+				}
+			}
+		}
+	}
+	want := []string{"DIMENSION_LIST", "long_name", "units", "_FillValue", "coordinates"}
+	if strings.Join(amp.order, " ") != strings.Join(want, " ") {
+		t.Errorf("amplitude attributes = %v, want %v", amp.order, want)
+	}
+
+	// The dimension list references the scales in the global heap and
+	// the scales reference the variable
+	dimList := amp.attrs["DIMENSION_LIST"]
+	for d, name := range []string{"time", "bin", "beam"} {
+		entry := dimList.data[16*d:]
+		if binary.LittleEndian.Uint32(entry) != 1 {
+			t.Fatalf("DIMENSION_LIST[%d] has %d references, want 1", d, binary.LittleEndian.Uint32(entry))
+		}
+		addr := readH5HeapAddr(t, data, binary.LittleEndian.Uint64(entry[4:]), binary.LittleEndian.Uint32(entry[12:]))
+		if addr != root.links[name] {
+			t.Errorf("DIMENSION_LIST[%d] = %d, want %s at %d", d, addr, name, root.links[name])
+		}
+
+		refs := objects[name].attrs["REFERENCE_LIST"].data
+		found := false
+		for i := 0; i+12 <= len(refs); i += 12 {
+			if binary.LittleEndian.Uint64(refs[i:]) == root.links["amplitude"] && int32(binary.LittleEndian.Uint32(refs[i+8:])) == int32(d) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s REFERENCE_LIST does not reference amplitude dimension %d", name, d)
+		}
+	}
+
+	// Bad and missing values are the fill value
+	east := readH5Float32(t, data, objects["eastward_velocity"])
+	if east[0] != first.EarthVelocityData.Velocity[0][0] || east[1*5+0] != 9 || east[1*5+2] != ncFillFloat {
+		t.Errorf("eastward_velocity = %v", east)
+	}
+	if fill := objects["eastward_velocity"].attrs["_FillValue"]; math.Float32frombits(binary.LittleEndian.Uint32(fill.data)) != ncFillFloat {
+		t.Errorf("_FillValue = %v", fill.data)
+	}
+}
+
+func TestWriteEnsembleNetCDFSingleADCP(t *testing.T) {
+	if err := writeEnsembleNetCDF(io.Discard, nil, ensembleFilter{serialNum: "12345"}); err == nil {
+		t.Error("no error without the subsystem configuration")
+	}
+}
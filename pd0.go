@@ -0,0 +1,657 @@
+///
+/// Decode and encode the Teledyne RDI PD0 ensemble format.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/ricorx7/go-rti"
+)
+
+const (
+	pd0HeaderID      = 0x7F   // Header ID and data source ID
+	pd0HeaderSize    = 6      // Size of the header without the data type offsets
+	pd0ChecksumSize  = 2      // Size of the checksum at the end of the ensemble
+	pd0BadVelocity   = -32768 // Value of a bad velocity
+	pd0AmpScale      = 0.45   // dB for each echo intensity count
+	pd0FixedSize     = 59     // Size of the fixed leader
+	pd0VariableSize  = 65     // Size of the variable leader
+	pd0BottomSize    = 85     // Size of the bottom track data
+	pd0MaxBeams      = 4      // Number of beams in the bottom track data
+	pd0DefaultPings  = 1      // Pings used for percent good if the ping count is not known
+	pd0CorrMaxCounts = 255    // Correlation counts of a perfect correlation
+)
+
+// PD0 data type IDs.
+const (
+	pd0FixedLeaderID    = 0x0000 // Fixed leader
+	pd0VariableLeaderID = 0x0080 // Variable leader
+	pd0VelocityID       = 0x0100 // Velocity
+	pd0CorrelationID    = 0x0200 // Correlation
+	pd0EchoIntensityID  = 0x0300 // Echo intensity
+	pd0PercentGoodID    = 0x0400 // Percent good
+	pd0BottomTrackID    = 0x0600 // Bottom track
+)
+
+// PD0 coordinate transform bits in the fixed leader.
+const (
+	pd0CoordMask         = 0x18 // Coordinate transform bits
+	pd0CoordBeam         = 0x00 // Beam coordinates
+	pd0CoordInstrument   = 0x08 // Instrument coordinates
+	pd0CoordShip         = 0x10 // Ship coordinates
+	pd0CoordEarth        = 0x18 // Earth coordinates
+	pd0CoordTiltsAndBins = 0x07 // Tilts used, 3 beam solutions and bin mapping
+)
+
+// pd0Codec will reassemble the PD0 ensembles from a stream of data.
+// The data can be split across any number of messages.
+type pd0Codec struct {
+	buffer []byte  // Data waiting to be decoded
+	offset int64   // Offset in the stream of the start of the buffer
+	starts []int64 // Offset in the stream of each ensemble from the last add
+}
+
+// skip will remove the bytes from the start of the buffer.
+func (codec *pd0Codec) skip(n int) {
+	codec.buffer = codec.buffer[n:]
+	codec.offset += int64(n)
+}
+
+// add will add the data to the buffer and return all the
+// complete ensembles found in the buffer.  Any ensemble with a bad
+// checksum is dropped.
+func (codec *pd0Codec) add(data []byte) []rti.Ensemble {
+	codec.buffer = append(codec.buffer, data...)
+	codec.starts = codec.starts[:0]
+
+	var ensembles []rti.Ensemble
+	for {
+		// Find the start of the header
+		start := bytes.Index(codec.buffer, []byte{pd0HeaderID, pd0HeaderID})
+		if start < 0 {
+			// Keep the last byte in case the header is split
+			if len(codec.buffer) > 1 {
+				codec.skip(len(codec.buffer) - 1)
+			}
+			return ensembles
+		}
+		codec.skip(start)
+
+		// Wait for the rest of the header
+		if len(codec.buffer) < pd0HeaderSize {
+			return ensembles
+		}
+
+		// Wait for the entire ensemble
+		size := int(binary.LittleEndian.Uint16(codec.buffer[2:]))
+		if size < pd0HeaderSize {
+			codec.skip(1)
+			continue
+		}
+		if len(codec.buffer) < size+pd0ChecksumSize {
+			return ensembles
+		}
+
+		// Verify the checksum
+		checksum := binary.LittleEndian.Uint16(codec.buffer[size:])
+		if pd0Checksum(codec.buffer[:size]) != checksum {
+			codec.skip(1)
+			continue
+		}
+
+		// Decode the ensemble
+		ens, err := decodePd0(codec.buffer[:size])
+		if err != nil {
+			log.Print("Error decoding PD0 ensemble: ", err)
+		} else {
+			ensembles = append(ensembles, ens)
+			codec.starts = append(codec.starts, codec.offset)
+		}
+
+		// Remove the ensemble from the buffer
+		codec.skip(size + pd0ChecksumSize)
+	}
+}
+
+// ensembleCodecResync is the number of bytes without an ensemble before
+// the stream is no longer locked to its format.  This is larger than a
+// few of the largest RTI ensembles.
+const ensembleCodecResync = 4 * rtiMaxPayloadSize
+
+// Stream formats of the ensemble codec.
+const (
+	streamUnknown = iota // Format not found yet
+	streamRti            // RTI binary
+	streamPd0            // PD0
+)
+
+// ensembleCodec will decode a stream of RTI binary or PD0 ensembles.
+// Until an ensemble is found, both formats look for their header, so
+// the sender can use either format.  The stream is then locked to the
+// format of the first ensemble.  The PD0 header and checksum are weak,
+// so they can be found inside RTI ensembles.
+type ensembleCodec struct {
+	rti      rtiBinaryCodec // RTI binary ensembles
+	pd0      pd0Codec       // PD0 ensembles
+	format   int            // Format the stream is locked to
+	unsynced int            // Bytes since the last ensemble
+	length   int64          // Bytes added to the stream
+}
+
+// add will add the data to the stream and return all the complete
+// ensembles found in the format of the stream.
+func (codec *ensembleCodec) add(data []byte) []rti.Ensemble {
+	codec.length += int64(len(data))
+	var ensembles []rti.Ensemble
+	switch codec.format {
+	case streamRti:
+		ensembles = codec.rti.add(data)
+	case streamPd0:
+		ensembles = codec.pd0.add(data)
+	default:
+		// Lock to the first format with an ensemble.  RTI has the
+		// stronger checksum, so it is used if both are found.
+		if ensembles = codec.rti.add(data); len(ensembles) > 0 {
+			codec.format = streamRti
+			codec.pd0 = pd0Codec{}
+		} else if ensembles = codec.pd0.add(data); len(ensembles) > 0 {
+			codec.format = streamPd0
+			codec.rti = rtiBinaryCodec{}
+		}
+	}
+
+	if len(ensembles) > 0 {
+		codec.unsynced = 0
+		return ensembles
+	}
+
+	// Look for either format again after a long run without an ensemble
+	codec.unsynced += len(data)
+	if codec.format != streamUnknown && codec.unsynced > ensembleCodecResync {
+		log.Print("Ensemble stream lost its format, looking for RTI and PD0")
+		*codec = ensembleCodec{
+			rti:    rtiBinaryCodec{offset: codec.length},
+			pd0:    pd0Codec{offset: codec.length},
+			length: codec.length,
+		}
+	}
+	return nil
+}
+
+// offsets will get the offset in the stream of each ensemble returned
+// by the last add.
+func (codec *ensembleCodec) offsets() []int64 {
+	if codec.format == streamPd0 {
+		return codec.pd0.starts
+	}
+	return codec.rti.starts
+}
+
+// pd0SerialNumber will get the PD0 serial number of the ADCP.  A decimal
+// serial number that fits is used as is.  Other serial numbers, such as
+// the 32 character RTI serial numbers, are hashed so each ADCP keeps its
+// own serial number when the PD0 file is read again.
+func pd0SerialNumber(serialNum string) uint32 {
+	if serial, err := strconv.ParseUint(serialNum, 10, 32); err == nil {
+		return uint32(serial)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(serialNum))
+	return hash.Sum32()
+}
+
+// pd0Checksum will calculate the checksum of the ensemble.
+// It is the sum of all the bytes.
+func pd0Checksum(data []byte) uint16 {
+	var sum uint16
+	for _, b := range data {
+		sum += uint16(b)
+	}
+	return sum
+}
+
+// decodePd0 will decode the PD0 ensemble without the checksum.
+func decodePd0(data []byte) (rti.Ensemble, error) {
+	var ens rti.Ensemble
+
+	numTypes := int(data[5])
+	if pd0HeaderSize+numTypes*2 > len(data) {
+		return ens, errors.New("data type offsets are larger than the ensemble")
+	}
+
+	// Find the offset of each data type
+	offsets := make(map[uint16][]byte)
+	for i := 0; i < numTypes; i++ {
+		offset := int(binary.LittleEndian.Uint16(data[pd0HeaderSize+i*2:]))
+		if offset+2 > len(data) {
+			return ens, fmt.Errorf("data type %d is beyond the ensemble", i)
+		}
+		offsets[binary.LittleEndian.Uint16(data[offset:])] = data[offset:]
+	}
+
+	// Fixed leader is needed for the size of the data
+	fixed, ok := offsets[pd0FixedLeaderID]
+	if !ok || len(fixed) < pd0FixedSize {
+		return ens, errors.New("no fixed leader")
+	}
+	numBeams := int(fixed[8])
+	numBins := int(fixed[9])
+	pings := int(binary.LittleEndian.Uint16(fixed[10:]))
+	coord := fixed[25] & pd0CoordMask
+	decodePd0FixedLeader(fixed, &ens)
+
+	if vl, ok := offsets[pd0VariableLeaderID]; ok && len(vl) >= pd0VariableSize {
+		decodePd0VariableLeader(vl, &ens)
+	}
+
+	// Bin and beam data
+	if vel, ok := offsets[pd0VelocityID]; ok && len(vel) >= 2+numBins*numBeams*2 {
+		values := make([][]float32, numBins)
+		for bin := range values {
+			values[bin] = make([]float32, numBeams)
+			for beam := range values[bin] {
+				val := int16(binary.LittleEndian.Uint16(vel[2+(bin*numBeams+beam)*2:]))
+				values[bin][beam] = pd0ToVelocity(val)
+			}
+		}
+		base := rtiBase(rtiDataTypeFloat, numBins, numBeams, "")
+		switch coord {
+		case pd0CoordEarth:
+			base.Name = rtiEarthVelocityID
+			ens.EarthVelocityData.Base = base
+			ens.EarthVelocityData.Velocity = values
+			ens.EarthVelocityData.Vectors = earthVelocityVectors(values)
+		case pd0CoordBeam:
+			base.Name = rtiBeamVelocityID
+			ens.BeamVelocityData.Base = base
+			ens.BeamVelocityData.Velocity = values
+		default:
+			base.Name = rtiInstrumentVelocityID
+			ens.InstrumentVelocityData.Base = base
+			ens.InstrumentVelocityData.Velocity = values
+		}
+	}
+
+	if corr, ok := offsets[pd0CorrelationID]; ok && len(corr) >= 2+numBins*numBeams {
+		ens.CorrelationData.Base = rtiBase(rtiDataTypeFloat, numBins, numBeams, rtiCorrelationID)
+		ens.CorrelationData.Correlation = decodePd0Bytes(corr[2:], numBins, numBeams, func(b byte) float32 {
+			return float32(b) / pd0CorrMaxCounts
+		})
+	}
+
+	if amp, ok := offsets[pd0EchoIntensityID]; ok && len(amp) >= 2+numBins*numBeams {
+		ens.AmplitudeData.Base = rtiBase(rtiDataTypeFloat, numBins, numBeams, rtiAmplitudeID)
+		ens.AmplitudeData.Amplitude = decodePd0Bytes(amp[2:], numBins, numBeams, func(b byte) float32 {
+			return float32(b) * pd0AmpScale
+		})
+	}
+
+	if pg, ok := offsets[pd0PercentGoodID]; ok && len(pg) >= 2+numBins*numBeams {
+		good := make([][]int, numBins)
+		for bin := range good {
+			good[bin] = make([]int, numBeams)
+			for beam := range good[bin] {
+				good[bin][beam] = int(math.Floor(float64(pg[2+bin*numBeams+beam])*float64(pings)/100 + 0.5))
+			}
+		}
+		if coord == pd0CoordEarth {
+			ens.GoodEarthData.Base = rtiBase(rtiDataTypeInt, numBins, numBeams, rtiGoodEarthID)
+			ens.GoodEarthData.GoodEarth = good
+		} else {
+			ens.GoodBeamData.Base = rtiBase(rtiDataTypeInt, numBins, numBeams, rtiGoodBeamID)
+			ens.GoodBeamData.GoodBeam = good
+		}
+	}
+
+	if bt, ok := offsets[pd0BottomTrackID]; ok && len(bt) >= pd0BottomSize {
+		decodePd0BottomTrack(bt, coord, &ens)
+	}
+
+	// Set the data set sizes
+	ens.EnsembleData.Base = rtiBase(rtiDataTypeInt, 23, 1, rtiEnsembleDataID)
+	ens.AncillaryData.Base = rtiBase(rtiDataTypeFloat, 13, 1, rtiAncillaryID)
+	ens.EnsembleData.NumBins = uint32(numBins)
+	ens.EnsembleData.NumBeams = uint32(numBeams)
+
+	return ens, nil
+}
+
+// rtiBase will create the base data set values.
+func rtiBase(dsType int, numElements int, elementMultiplier int, name string) rti.BaseDataSet {
+	return rti.BaseDataSet{
+		DsType:            uint32(dsType),
+		NumElements:       uint32(numElements),
+		ElementMultiplier: uint32(elementMultiplier),
+		NameLen:           8,
+		Name:              name,
+	}
+}
+
+// pd0ToVelocity will convert the mm/s velocity to m/s.
+// Bad velocities are set to the RTI bad velocity.
+func pd0ToVelocity(val int16) float32 {
+	if val == pd0BadVelocity {
+		return rtiBadVelocity
+	}
+	return float32(val) / 1000.0
+}
+
+// velocityToPd0 will convert the m/s velocity to mm/s.
+// Bad velocities are set to the PD0 bad velocity.
+func velocityToPd0(val float32) int16 {
+	if val == rtiBadVelocity || math.IsNaN(float64(val)) {
+		return pd0BadVelocity
+	}
+	mm := math.Floor(float64(val)*1000.0 + 0.5)
+	if mm > math.MaxInt16 || mm <= pd0BadVelocity {
+		return pd0BadVelocity
+	}
+	return int16(mm)
+}
+
+// decodePd0Bytes will decode the byte values for each bin and beam.
+// The data is stored bin by bin.
+func decodePd0Bytes(data []byte, numBins int, numBeams int, convert func(b byte) float32) [][]float32 {
+	values := make([][]float32, numBins)
+	for bin := range values {
+		values[bin] = make([]float32, numBeams)
+		for beam := range values[bin] {
+			values[bin][beam] = convert(data[bin*numBeams+beam])
+		}
+	}
+	return values
+}
+
+// decodePd0FixedLeader will decode the fixed leader.
+func decodePd0FixedLeader(fl []byte, ens *rti.Ensemble) {
+	ens.EnsembleData.SysFirmware.FirmwareMajor = fl[2]
+	ens.EnsembleData.SysFirmware.FirmwareMinor = fl[3]
+	ens.EnsembleData.DesiredPingCount = uint32(binary.LittleEndian.Uint16(fl[10:]))
+	ens.EnsembleData.ActualPingCount = uint32(binary.LittleEndian.Uint16(fl[10:]))
+	ens.AncillaryData.BinSize = float32(binary.LittleEndian.Uint16(fl[12:])) / 100.0
+	ens.AncillaryData.FirstBinRange = float32(binary.LittleEndian.Uint16(fl[32:])) / 100.0
+	ens.EnsembleData.SerialNumber.SerialNumber = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(fl[54:])), 10)
+}
+
+// decodePd0VariableLeader will decode the variable leader.
+func decodePd0VariableLeader(vl []byte, ens *rti.Ensemble) {
+	ens.EnsembleData.EnsembleNumber = uint32(binary.LittleEndian.Uint16(vl[2:])) + uint32(vl[11])<<16
+	ens.EnsembleData.Year = uint32(vl[57])*100 + uint32(vl[58])
+	ens.EnsembleData.Month = uint32(vl[59])
+	ens.EnsembleData.Day = uint32(vl[60])
+	ens.EnsembleData.Hour = uint32(vl[61])
+	ens.EnsembleData.Minute = uint32(vl[62])
+	ens.EnsembleData.Second = uint32(vl[63])
+	ens.EnsembleData.HSec = uint32(vl[64])
+
+	ens.AncillaryData.SpeedOfSound = float32(binary.LittleEndian.Uint16(vl[14:]))
+	ens.AncillaryData.TransducerDepth = float32(binary.LittleEndian.Uint16(vl[16:])) / 10.0
+	ens.AncillaryData.Heading = float32(binary.LittleEndian.Uint16(vl[18:])) / 100.0
+	ens.AncillaryData.Pitch = float32(int16(binary.LittleEndian.Uint16(vl[20:]))) / 100.0
+	ens.AncillaryData.Roll = float32(int16(binary.LittleEndian.Uint16(vl[22:]))) / 100.0
+	ens.AncillaryData.Salinity = float32(binary.LittleEndian.Uint16(vl[24:]))
+	ens.AncillaryData.WaterTemp = float32(int16(binary.LittleEndian.Uint16(vl[26:]))) / 100.0
+	ens.AncillaryData.Pressure = float32(binary.LittleEndian.Uint32(vl[48:])) * 10.0
+}
+
+// decodePd0BottomTrack will decode the bottom track.  The velocity is
+// in the coordinate system of the water profile.
+func decodePd0BottomTrack(bt []byte, coord byte, ens *rti.Ensemble) {
+	pings := binary.LittleEndian.Uint16(bt[2:])
+	b := &ens.BottomTrackData
+	b.Base = rtiBase(rtiDataTypeFloat, 14+10*pd0MaxBeams, 1, rtiBottomTrackID)
+	b.NumBeams = pd0MaxBeams
+	b.ActualPingCount = float32(pings)
+	b.Heading = ens.AncillaryData.Heading
+	b.Pitch = ens.AncillaryData.Pitch
+	b.Roll = ens.AncillaryData.Roll
+	b.WaterTemp = ens.AncillaryData.WaterTemp
+	b.Salinity = ens.AncillaryData.Salinity
+	b.Pressure = ens.AncillaryData.Pressure
+	b.TransducerDepth = ens.AncillaryData.TransducerDepth
+	b.SpeedOfSound = ens.AncillaryData.SpeedOfSound
+
+	b.Range = make([]float32, pd0MaxBeams)
+	b.SNR = make([]float32, pd0MaxBeams)
+	b.Amplitude = make([]float32, pd0MaxBeams)
+	b.Correlation = make([]float32, pd0MaxBeams)
+	b.BeamVelocity = make([]float32, pd0MaxBeams)
+	b.BeamGood = make([]float32, pd0MaxBeams)
+	b.InstrumentVelocity = make([]float32, pd0MaxBeams)
+	b.InstrumentGood = make([]float32, pd0MaxBeams)
+	b.EarthVelocity = make([]float32, pd0MaxBeams)
+	b.EarthGood = make([]float32, pd0MaxBeams)
+
+	for beam := 0; beam < pd0MaxBeams; beam++ {
+		rangeCm := uint32(binary.LittleEndian.Uint16(bt[16+beam*2:])) + uint32(bt[77+beam])<<16
+		b.Range[beam] = float32(rangeCm) / 100.0
+		b.Correlation[beam] = float32(bt[32+beam]) / pd0CorrMaxCounts
+		b.Amplitude[beam] = float32(bt[36+beam]) * pd0AmpScale
+		b.SNR[beam] = b.Amplitude[beam]
+
+		vel := pd0ToVelocity(int16(binary.LittleEndian.Uint16(bt[24+beam*2:])))
+		good := float32(math.Floor(float64(bt[40+beam])*float64(pings)/100 + 0.5))
+		switch coord {
+		case pd0CoordEarth:
+			b.EarthVelocity[beam] = vel
+			b.EarthGood[beam] = good
+		case pd0CoordBeam:
+			b.BeamVelocity[beam] = vel
+			b.BeamGood[beam] = good
+		default:
+			b.InstrumentVelocity[beam] = vel
+			b.InstrumentGood[beam] = good
+		}
+	}
+}
+
+// encodePd0 will encode the ensemble to the PD0 format.
+// The velocity is written in earth coordinates if the ensemble has
+// earth velocity, then instrument and then beam coordinates.
+func encodePd0(ens rti.Ensemble) []byte {
+	// Choose the velocity to write
+	coord := byte(pd0CoordBeam)
+	vel := ens.BeamVelocityData.Velocity
+	good := ens.GoodBeamData.GoodBeam
+	btVel := ens.BottomTrackData.BeamVelocity
+	btGood := ens.BottomTrackData.BeamGood
+	if len(ens.EarthVelocityData.Velocity) > 0 {
+		coord = pd0CoordEarth
+		vel = ens.EarthVelocityData.Velocity
+		good = ens.GoodEarthData.GoodEarth
+		btVel = ens.BottomTrackData.EarthVelocity
+		btGood = ens.BottomTrackData.EarthGood
+	} else if len(ens.InstrumentVelocityData.Velocity) > 0 {
+		coord = pd0CoordInstrument
+		vel = ens.InstrumentVelocityData.Velocity
+		btVel = ens.BottomTrackData.InstrumentVelocity
+		btGood = ens.BottomTrackData.InstrumentGood
+	}
+
+	// Number of bins and beams from the largest data set
+	numBins, numBeams := exportDims([]rti.Ensemble{ens})
+	pings := int(ens.EnsembleData.ActualPingCount)
+	if pings <= 0 {
+		pings = pd0DefaultPings
+	}
+
+	// Fixed leader
+	fl := make([]byte, pd0FixedSize)
+	binary.LittleEndian.PutUint16(fl[0:], pd0FixedLeaderID)
+	fl[2] = ens.EnsembleData.SysFirmware.FirmwareMajor
+	fl[3] = ens.EnsembleData.SysFirmware.FirmwareMinor
+	fl[8] = byte(numBeams)
+	fl[9] = byte(numBins)
+	binary.LittleEndian.PutUint16(fl[10:], uint16(pings))
+	binary.LittleEndian.PutUint16(fl[12:], uint16(math.Floor(float64(ens.AncillaryData.BinSize)*100+0.5)))
+	fl[25] = coord | pd0CoordTiltsAndBins
+	binary.LittleEndian.PutUint16(fl[32:], uint16(math.Floor(float64(ens.AncillaryData.FirstBinRange)*100+0.5)))
+	binary.LittleEndian.PutUint32(fl[54:], pd0SerialNumber(ens.EnsembleData.SerialNumber.SerialNumber))
+
+	// Variable leader
+	vl := make([]byte, pd0VariableSize)
+	ed := ens.EnsembleData
+	anc := ens.AncillaryData
+	binary.LittleEndian.PutUint16(vl[0:], pd0VariableLeaderID)
+	binary.LittleEndian.PutUint16(vl[2:], uint16(ed.EnsembleNumber))
+	vl[4] = byte(ed.Year % 100)
+	vl[5] = byte(ed.Month)
+	vl[6] = byte(ed.Day)
+	vl[7] = byte(ed.Hour)
+	vl[8] = byte(ed.Minute)
+	vl[9] = byte(ed.Second)
+	vl[10] = byte(ed.HSec)
+	vl[11] = byte(ed.EnsembleNumber >> 16)
+	binary.LittleEndian.PutUint16(vl[14:], uint16(math.Floor(float64(anc.SpeedOfSound)+0.5)))
+	binary.LittleEndian.PutUint16(vl[16:], uint16(math.Floor(float64(anc.TransducerDepth)*10+0.5)))
+	binary.LittleEndian.PutUint16(vl[18:], uint16(math.Floor(float64(anc.Heading)*100+0.5)))
+	binary.LittleEndian.PutUint16(vl[20:], uint16(int16(math.Floor(float64(anc.Pitch)*100+0.5))))
+	binary.LittleEndian.PutUint16(vl[22:], uint16(int16(math.Floor(float64(anc.Roll)*100+0.5))))
+	binary.LittleEndian.PutUint16(vl[24:], uint16(math.Floor(float64(anc.Salinity)+0.5)))
+	binary.LittleEndian.PutUint16(vl[26:], uint16(int16(math.Floor(float64(anc.WaterTemp)*100+0.5))))
+	binary.LittleEndian.PutUint32(vl[48:], uint32(math.Floor(float64(anc.Pressure)/10+0.5)))
+	vl[57] = byte(ed.Year / 100)
+	vl[58] = byte(ed.Year % 100)
+	vl[59] = byte(ed.Month)
+	vl[60] = byte(ed.Day)
+	vl[61] = byte(ed.Hour)
+	vl[62] = byte(ed.Minute)
+	vl[63] = byte(ed.Second)
+	vl[64] = byte(ed.HSec)
+
+	types := [][]byte{fl, vl}
+
+	// Velocity
+	if len(vel) > 0 {
+		data := make([]byte, 2+numBins*numBeams*2)
+		binary.LittleEndian.PutUint16(data, pd0VelocityID)
+		for bin := 0; bin < numBins; bin++ {
+			for beam := 0; beam < numBeams; beam++ {
+				val := int16(pd0BadVelocity)
+				if bin < len(vel) && beam < len(vel[bin]) {
+					val = velocityToPd0(vel[bin][beam])
+				}
+				binary.LittleEndian.PutUint16(data[2+(bin*numBeams+beam)*2:], uint16(val))
+			}
+		}
+		types = append(types, data)
+	}
+
+	// Correlation
+	if len(ens.CorrelationData.Correlation) > 0 {
+		types = append(types, encodePd0Bytes(pd0CorrelationID, ens.CorrelationData.Correlation, numBins, numBeams, func(val float32) float64 {
+			return float64(val) * pd0CorrMaxCounts
+		}))
+	}
+
+	// Echo intensity
+	if len(ens.AmplitudeData.Amplitude) > 0 {
+		types = append(types, encodePd0Bytes(pd0EchoIntensityID, ens.AmplitudeData.Amplitude, numBins, numBeams, func(val float32) float64 {
+			return float64(val) / pd0AmpScale
+		}))
+	}
+
+	// Percent good
+	if len(good) > 0 {
+		pg := make([][]float32, len(good))
+		for bin := range good {
+			pg[bin] = make([]float32, len(good[bin]))
+			for beam := range good[bin] {
+				pg[bin][beam] = float32(good[bin][beam])
+			}
+		}
+		types = append(types, encodePd0Bytes(pd0PercentGoodID, pg, numBins, numBeams, func(val float32) float64 {
+			return float64(val) * 100 / float64(pings)
+		}))
+	}
+
+	// Bottom track
+	bt := ens.BottomTrackData
+	if len(bt.Range) > 0 {
+		data := make([]byte, pd0BottomSize)
+		binary.LittleEndian.PutUint16(data[0:], pd0BottomTrackID)
+		btPings := int(bt.ActualPingCount)
+		if btPings <= 0 {
+			btPings = pd0DefaultPings
+		}
+		binary.LittleEndian.PutUint16(data[2:], uint16(btPings))
+		for beam := 0; beam < pd0MaxBeams; beam++ {
+			if beam < len(bt.Range) {
+				rangeCm := uint32(math.Floor(float64(bt.Range[beam])*100 + 0.5))
+				binary.LittleEndian.PutUint16(data[16+beam*2:], uint16(rangeCm))
+				data[77+beam] = byte(rangeCm >> 16)
+			}
+			val := int16(pd0BadVelocity)
+			if beam < len(btVel) {
+				val = velocityToPd0(btVel[beam])
+			}
+			binary.LittleEndian.PutUint16(data[24+beam*2:], uint16(val))
+			if beam < len(bt.Correlation) {
+				data[32+beam] = pd0Byte(float64(bt.Correlation[beam]) * pd0CorrMaxCounts)
+			}
+			if beam < len(bt.Amplitude) {
+				data[36+beam] = pd0Byte(float64(bt.Amplitude[beam]) / pd0AmpScale)
+			}
+			if beam < len(btGood) {
+				data[40+beam] = pd0Byte(float64(btGood[beam]) * 100 / float64(btPings))
+			}
+		}
+		types = append(types, data)
+	}
+
+	// Header with the offset to each data type
+	headerSize := pd0HeaderSize + len(types)*2
+	size := headerSize
+	for _, t := range types {
+		size += len(t)
+	}
+	buf := make([]byte, headerSize, size+pd0ChecksumSize)
+	buf[0] = pd0HeaderID
+	buf[1] = pd0HeaderID
+	binary.LittleEndian.PutUint16(buf[2:], uint16(size))
+	buf[5] = byte(len(types))
+	offset := headerSize
+	for i, t := range types {
+		binary.LittleEndian.PutUint16(buf[pd0HeaderSize+i*2:], uint16(offset))
+		offset += len(t)
+		buf = append(buf, t...)
+	}
+
+	checksum := make([]byte, pd0ChecksumSize)
+	binary.LittleEndian.PutUint16(checksum, pd0Checksum(buf))
+	return append(buf, checksum...)
+}
+
+// encodePd0Bytes will encode the byte values for each bin and beam.
+// Missing values are 0.
+func encodePd0Bytes(id uint16, values [][]float32, numBins int, numBeams int, convert func(val float32) float64) []byte {
+	data := make([]byte, 2+numBins*numBeams)
+	binary.LittleEndian.PutUint16(data, id)
+	for bin := 0; bin < numBins && bin < len(values); bin++ {
+		for beam := 0; beam < numBeams && beam < len(values[bin]); beam++ {
+			data[2+bin*numBeams+beam] = pd0Byte(convert(values[bin][beam]))
+		}
+	}
+	return data
+}
+
+// pd0Byte will round the value and limit it to a byte.
+func pd0Byte(val float64) byte {
+	val = math.Floor(val + 0.5)
+	if val < 0 || math.IsNaN(val) {
+		return 0
+	}
+	if val > 255 {
+		return 255
+	}
+	return byte(val)
+}
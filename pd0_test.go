@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// pd0TestEnsemble will create a synthetic ensemble with earth velocity
+// and bottom track.  The values can all be stored exactly in PD0.
+func pd0TestEnsemble() rti.Ensemble {
+	const numBins = 5
+	const numBeams = 4
+
+	var ens rti.Ensemble
+	ens.EnsembleData.EnsembleNumber = 70000
+	ens.EnsembleData.NumBins = numBins
+	ens.EnsembleData.NumBeams = numBeams
+	ens.EnsembleData.ActualPingCount = 10
+	ens.EnsembleData.SerialNumber.SerialNumber = "12345"
+	ens.EnsembleData.SysFirmware.FirmwareMajor = 51
+	ens.EnsembleData.SysFirmware.FirmwareMinor = 40
+	ens.EnsembleData.Year = 2019
+	ens.EnsembleData.Month = 6
+	ens.EnsembleData.Day = 21
+	ens.EnsembleData.Hour = 13
+	ens.EnsembleData.Minute = 45
+	ens.EnsembleData.Second = 30
+	ens.EnsembleData.HSec = 25
+
+	ens.AncillaryData.FirstBinRange = 1.5
+	ens.AncillaryData.BinSize = 0.5
+	ens.AncillaryData.Heading = 123.45
+	ens.AncillaryData.Pitch = -2.5
+	ens.AncillaryData.Roll = 1.25
+	ens.AncillaryData.WaterTemp = 15.75
+	ens.AncillaryData.Salinity = 35
+	ens.AncillaryData.Pressure = 20000
+	ens.AncillaryData.TransducerDepth = 2.5
+	ens.AncillaryData.SpeedOfSound = 1500
+
+	ens.EarthVelocityData.Velocity = make([][]float32, numBins)
+	ens.AmplitudeData.Amplitude = make([][]float32, numBins)
+	ens.CorrelationData.Correlation = make([][]float32, numBins)
+	ens.GoodEarthData.GoodEarth = make([][]int, numBins)
+	for bin := 0; bin < numBins; bin++ {
+		ens.EarthVelocityData.Velocity[bin] = make([]float32, numBeams)
+		ens.AmplitudeData.Amplitude[bin] = make([]float32, numBeams)
+		ens.CorrelationData.Correlation[bin] = make([]float32, numBeams)
+		ens.GoodEarthData.GoodEarth[bin] = make([]int, numBeams)
+		for beam := 0; beam < numBeams; beam++ {
+			ens.EarthVelocityData.Velocity[bin][beam] = float32(bin*numBeams+beam)*0.125 - 1
+			ens.AmplitudeData.Amplitude[bin][beam] = float32(100-bin*10) * pd0AmpScale
+			ens.CorrelationData.Correlation[bin][beam] = float32(200+beam) / pd0CorrMaxCounts
+			ens.GoodEarthData.GoodEarth[bin][beam] = 10 - bin
+		}
+	}
+	ens.EarthVelocityData.Velocity[numBins-1][numBeams-1] = rtiBadVelocity
+
+	ens.BottomTrackData.ActualPingCount = 4
+	ens.BottomTrackData.Range = []float32{700.25, 12.5, 12.75, 13}
+	ens.BottomTrackData.EarthVelocity = []float32{0.5, -0.25, 0.01, rtiBadVelocity}
+	ens.BottomTrackData.EarthGood = []float32{4, 3, 2, 1}
+	ens.BottomTrackData.Correlation = []float32{1, 1, 1, 1}
+	ens.BottomTrackData.Amplitude = []float32{45, 45, 45, 45}
+
+	return ens
+}
+
+// assertFloat will fail the test if the values are not within 0.0001.
+func assertFloat(t *testing.T, name string, got float32, want float32) {
+	t.Helper()
+	if math.Abs(float64(got-want)) > 0.0001 {
+		t.Errorf("%s = %v, want %v", name, got, want)
+	}
+}
+
+// decodeOnePd0 will decode the PD0 data and fail the test if it
+// is not a single ensemble.
+func decodeOnePd0(t *testing.T, data []byte) rti.Ensemble {
+	t.Helper()
+	var codec pd0Codec
+	ensembles := codec.add(data)
+	if len(ensembles) != 1 {
+		t.Fatalf("decoded %d ensembles, want 1", len(ensembles))
+	}
+	return ensembles[0]
+}
+
+func TestPd0RoundTrip(t *testing.T) {
+	want := pd0TestEnsemble()
+	got := decodeOnePd0(t, encodePd0(want))
+
+	if got.EnsembleData.EnsembleNumber != want.EnsembleData.EnsembleNumber {
+		t.Errorf("EnsembleNumber = %d, want %d", got.EnsembleData.EnsembleNumber, want.EnsembleData.EnsembleNumber)
+	}
+	if got.EnsembleData.NumBins != want.EnsembleData.NumBins || got.EnsembleData.NumBeams != want.EnsembleData.NumBeams {
+		t.Errorf("bins and beams = %d %d, want %d %d", got.EnsembleData.NumBins, got.EnsembleData.NumBeams,
+			want.EnsembleData.NumBins, want.EnsembleData.NumBeams)
+	}
+	if got.EnsembleData.SerialNumber.SerialNumber != want.EnsembleData.SerialNumber.SerialNumber {
+		t.Errorf("SerialNumber = %q, want %q", got.EnsembleData.SerialNumber.SerialNumber, want.EnsembleData.SerialNumber.SerialNumber)
+	}
+	if got.EnsembleData.SysFirmware != want.EnsembleData.SysFirmware {
+		t.Errorf("SysFirmware = %v, want %v", got.EnsembleData.SysFirmware, want.EnsembleData.SysFirmware)
+	}
+	if !ensembleTime(got).Equal(ensembleTime(want)) {
+		t.Errorf("time = %v, want %v", ensembleTime(got), ensembleTime(want))
+	}
+
+	anc := []struct {
+		name      string
+		got, want float32
+	}{
+		{"FirstBinRange", got.AncillaryData.FirstBinRange, want.AncillaryData.FirstBinRange},
+		{"BinSize", got.AncillaryData.BinSize, want.AncillaryData.BinSize},
+		{"Heading", got.AncillaryData.Heading, want.AncillaryData.Heading},
+		{"Pitch", got.AncillaryData.Pitch, want.AncillaryData.Pitch},
+		{"Roll", got.AncillaryData.Roll, want.AncillaryData.Roll},
+		{"WaterTemp", got.AncillaryData.WaterTemp, want.AncillaryData.WaterTemp},
+		{"Salinity", got.AncillaryData.Salinity, want.AncillaryData.Salinity},
+		{"Pressure", got.AncillaryData.Pressure, want.AncillaryData.Pressure},
+		{"TransducerDepth", got.AncillaryData.TransducerDepth, want.AncillaryData.TransducerDepth},
+		{"SpeedOfSound", got.AncillaryData.SpeedOfSound, want.AncillaryData.SpeedOfSound},
+	}
+	for _, a := range anc {
+		assertFloat(t, a.name, a.got, a.want)
+	}
+
+	if len(got.BeamVelocityData.Velocity) != 0 || len(got.InstrumentVelocityData.Velocity) != 0 {
+		t.Error("earth velocity decoded as beam or instrument velocity")
+	}
+	for bin := range want.EarthVelocityData.Velocity {
+		for beam := range want.EarthVelocityData.Velocity[bin] {
+			assertFloat(t, "EarthVelocity", got.EarthVelocityData.Velocity[bin][beam], want.EarthVelocityData.Velocity[bin][beam])
+			assertFloat(t, "Amplitude", got.AmplitudeData.Amplitude[bin][beam], want.AmplitudeData.Amplitude[bin][beam])
+			assertFloat(t, "Correlation", got.CorrelationData.Correlation[bin][beam], want.CorrelationData.Correlation[bin][beam])
+			if got.GoodEarthData.GoodEarth[bin][beam] != want.GoodEarthData.GoodEarth[bin][beam] {
+				t.Errorf("GoodEarth[%d][%d] = %d, want %d", bin, beam, got.GoodEarthData.GoodEarth[bin][beam], want.GoodEarthData.GoodEarth[bin][beam])
+			}
+		}
+	}
+
+	bt := got.BottomTrackData
+	for beam := 0; beam < pd0MaxBeams; beam++ {
+		assertFloat(t, "BT Range", bt.Range[beam], want.BottomTrackData.Range[beam])
+		assertFloat(t, "BT EarthVelocity", bt.EarthVelocity[beam], want.BottomTrackData.EarthVelocity[beam])
+		assertFloat(t, "BT EarthGood", bt.EarthGood[beam], want.BottomTrackData.EarthGood[beam])
+		assertFloat(t, "BT Correlation", bt.Correlation[beam], want.BottomTrackData.Correlation[beam])
+		assertFloat(t, "BT Amplitude", bt.Amplitude[beam], want.BottomTrackData.Amplitude[beam])
+	}
+}
+
+func TestPd0ReEncode(t *testing.T) {
+	data := encodePd0(pd0TestEnsemble())
+	again := encodePd0(decodeOnePd0(t, data))
+	if !bytes.Equal(data, again) {
+		t.Error("re-encoded PD0 ensemble does not match the original")
+	}
+}
+
+func TestPd0BeamVelocity(t *testing.T) {
+	ens := pd0TestEnsemble()
+	ens.BeamVelocityData.Velocity = ens.EarthVelocityData.Velocity
+	ens.EarthVelocityData.Velocity = nil
+	ens.GoodBeamData.GoodBeam = ens.GoodEarthData.GoodEarth
+	ens.GoodEarthData.GoodEarth = nil
+
+	got := decodeOnePd0(t, encodePd0(ens))
+	if len(got.EarthVelocityData.Velocity) != 0 {
+		t.Fatal("beam velocity decoded as earth velocity")
+	}
+	last := len(ens.BeamVelocityData.Velocity) - 1
+	assertFloat(t, "bad velocity", got.BeamVelocityData.Velocity[last][3], rtiBadVelocity)
+	assertFloat(t, "BeamVelocity", got.BeamVelocityData.Velocity[1][2], ens.BeamVelocityData.Velocity[1][2])
+	if got.GoodBeamData.GoodBeam[2][0] != ens.GoodBeamData.GoodBeam[2][0] {
+		t.Errorf("GoodBeam = %d, want %d", got.GoodBeamData.GoodBeam[2][0], ens.GoodBeamData.GoodBeam[2][0])
+	}
+}
+
+func TestPd0CodecStream(t *testing.T) {
+	first := pd0TestEnsemble()
+	second := pd0TestEnsemble()
+	second.EnsembleData.EnsembleNumber++
+
+	bad := encodePd0(first)
+	bad[len(bad)/2]++
+
+	// Garbage, a bad checksum and two good ensembles
+	stream := append([]byte{0x7F, 0x01, 0x02}, bad...)
+	stream = append(stream, encodePd0(first)...)
+	stream = append(stream, encodePd0(second)...)
+
+	// Add the stream a few bytes at a time
+	var codec pd0Codec
+	var ensembles []rti.Ensemble
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		ensembles = append(ensembles, codec.add(stream[i:end])...)
+	}
+
+	if len(ensembles) != 2 {
+		t.Fatalf("decoded %d ensembles, want 2", len(ensembles))
+	}
+	if ensembles[0].EnsembleData.EnsembleNumber != first.EnsembleData.EnsembleNumber ||
+		ensembles[1].EnsembleData.EnsembleNumber != second.EnsembleData.EnsembleNumber {
+		t.Errorf("ensemble numbers = %d %d, want %d %d", ensembles[0].EnsembleData.EnsembleNumber,
+			ensembles[1].EnsembleData.EnsembleNumber, first.EnsembleData.EnsembleNumber, second.EnsembleData.EnsembleNumber)
+	}
+}
+
+func TestEnsembleCodecLocksFormat(t *testing.T) {
+	first := pd0TestEnsemble()
+	second := pd0TestEnsemble()
+	second.EnsembleData.EnsembleNumber++
+
+	// A PD0 ensemble after the first RTI ensemble is not decoded
+	stream := encodeRtiEnsemble(first)
+	stream = append(stream, encodePd0(first)...)
+	stream = append(stream, encodeRtiEnsemble(second)...)
+
+	var codec ensembleCodec
+	ensembles := codec.add(stream)
+	if len(ensembles) != 2 {
+		t.Fatalf("decoded %d ensembles, want the 2 RTI ensembles", len(ensembles))
+	}
+	if codec.format != streamRti {
+		t.Errorf("format = %d, want RTI", codec.format)
+	}
+
+	// A PD0 stream is found again after a long run without RTI
+	codec.add(make([]byte, ensembleCodecResync+1))
+	if ensembles := codec.add(encodePd0(first)); len(ensembles) != 1 || codec.format != streamPd0 {
+		t.Errorf("decoded %d PD0 ensembles with format %d after the resync, want 1 with PD0", len(ensembles), codec.format)
+	}
+}
+
+func TestPd0SerialNumber(t *testing.T) {
+	if got := pd0SerialNumber("12345"); got != 12345 {
+		t.Errorf("decimal serial = %d, want 12345", got)
+	}
+
+	// RTI serial numbers keep a separate serial number for each ADCP
+	first := pd0SerialNumber("01400000000000000000000000000001")
+	second := pd0SerialNumber("01400000000000000000000000000002")
+	if first == 0 || first == second || first != pd0SerialNumber("01400000000000000000000000000001") {
+		t.Errorf("RTI serials = %d and %d, want different and repeatable", first, second)
+	}
+
+	ens := pd0TestEnsemble()
+	ens.EnsembleData.SerialNumber.SerialNumber = "01400000000000000000000000000001"
+	got := decodeOnePd0(t, encodePd0(ens))
+	if want := strconv.FormatUint(uint64(first), 10); got.EnsembleData.SerialNumber.SerialNumber != want {
+		t.Errorf("decoded serial = %q, want %q", got.EnsembleData.SerialNumber.SerialNumber, want)
+	}
+}
@@ -0,0 +1,281 @@
+///
+/// Record the incoming ensembles to disk.
+///
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// Recording formats.
+const (
+	recordFormatRti  = "rti"  // RTI binary
+	recordFormatJSON = "json" // JSON-lines
+	recordFormatPd0  = "pd0"  // Teledyne RDI PD0
+)
+
+// recordFile is the file an ADCP is recording to.
+type recordFile struct {
+	file    *os.File  // Open file
+	size    int64     // Bytes written to the file
+	created time.Time // Time the file was created
+}
+
+// recorder will write every ensemble to a file for each
+// serial number and subsystem configuration.
+type recorder struct {
+	mutex     sync.Mutex             // Lock the state
+	dir       string                 // Folder to record to
+	format    string                 // Recording format
+	maxSize   int64                  // Largest file size before a new file is started
+	maxAge    time.Duration          // Longest time to write to a file before a new file is started
+	recording bool                   // Flag if recording
+	files     map[string]*recordFile // Open files.  Key is the serial number and subsystem configuration
+}
+
+// recordStatus is the status of the recorder.
+type recordStatus struct {
+	Recording bool   // Flag if recording
+	Format    string // Recording format
+	Files     int    // Number of open files
+}
+
+// recordedFile is a file in the recording folder.
+type recordedFile struct {
+	Name    string    // File name
+	Size    int64     // File size in bytes
+	ModTime time.Time // Last time the file was written
+}
+
+// record is the recorder of all the live ensembles.
+var record = &recorder{
+	format: recordFormatRti,              // RTI binary
+	files:  make(map[string]*recordFile), // Open files
+}
+
+// configure will set the recording folder, format and when to start a new file.
+func (r *recorder) configure(dir string, format string, maxSize int64, maxAge time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.dir = dir
+	r.format = format
+	r.maxSize = maxSize
+	r.maxAge = maxAge
+}
+
+// start will start recording.
+func (r *recorder) start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	r.recording = true
+	log.Printf("Recording to %s", r.dir)
+	return nil
+}
+
+// stop will stop recording and close all the files.
+func (r *recorder) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.recording = false
+	for key, f := range r.files {
+		f.file.Close()
+		delete(r.files, key)
+	}
+	log.Print("Recording stopped")
+}
+
+// status will get the status of the recorder.
+func (r *recorder) status() recordStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return recordStatus{
+		Recording: r.recording,
+		Format:    r.format,
+		Files:     len(r.files),
+	}
+}
+
+// write will write the ensemble to the ADCP's file.
+// A new file is started when the file is too large or too old.
+func (r *recorder) write(ens rti.Ensemble) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.recording {
+		return
+	}
+
+	// Encode the ensemble
+	var data []byte
+	switch r.format {
+	case recordFormatJSON:
+		b, err := json.Marshal(ens)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		data = append(b, '\n')
+	case recordFormatPd0:
+		data = encodePd0(ens)
+	default:
+		data = encodeRtiEnsemble(ens)
+	}
+
+	// Close the file if it is full
+	key := adcpKey(ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens))
+	f, ok := r.files[key]
+	if ok && ((r.maxSize > 0 && f.size+int64(len(data)) > r.maxSize) || (r.maxAge > 0 && time.Since(f.created) > r.maxAge)) {
+		f.file.Close()
+		delete(r.files, key)
+		ok = false
+	}
+
+	// Start a new file
+	if !ok {
+		ext := ".ens"
+		switch r.format {
+		case recordFormatJSON:
+			ext = ".jsonl"
+		case recordFormatPd0:
+			ext = ".pd0"
+		}
+		name := fmt.Sprintf("%s_%s_%d%s", safeFileName(key), time.Now().Format("20060102150405"), ens.EnsembleData.EnsembleNumber, ext)
+		file, err := os.Create(filepath.Join(r.dir, name))
+		if err != nil {
+			log.Println("Error creating recording file: " + err.Error())
+			return
+		}
+		f = &recordFile{file: file, created: time.Now()}
+		r.files[key] = f
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	if err != nil {
+		log.Println("Error writing recording file: " + err.Error())
+	}
+}
+
+// safeFileName will replace all the characters in the name that are not
+// letters, numbers, '-', '_' or '.' with '_'.
+func safeFileName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// list will get all the files in the recording folder.
+func (r *recorder) list() ([]recordedFile, error) {
+	r.mutex.Lock()
+	dir := r.dir
+	r.mutex.Unlock()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []recordedFile{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, recordedFile{
+			Name:    info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	// Newest files first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	return files, nil
+}
+
+// path will get the path to the recorded file.
+// Only files in the recording folder can be accessed.
+func (r *recorder) path(name string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return filepath.Join(r.dir, filepath.Base(name))
+}
+
+// recordHandler will control the recorder.
+//
+//	/record/status               Get the status
+//	/record/start                Start recording.  Must be a POST
+//	/record/stop                 Stop recording.  Must be a POST
+//	/record/files                List the recorded files
+//	/record/download?file=name   Download a recorded file
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/record/") {
+	case "status":
+		result = record.status()
+	case "start":
+		if !requirePost(w, r) {
+			return
+		}
+		if err := record.start(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = record.status()
+	case "stop":
+		if !requirePost(w, r) {
+			return
+		}
+		record.stop()
+		result = record.status()
+	case "files":
+		files, err := record.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = files
+	case "download":
+		if r.FormValue("file") == "" {
+			http.Error(w, "No file given", http.StatusBadRequest)
+			return
+		}
+		// Only serve files, not the listing of a folder such as ..
+		file := record.path(r.FormValue("file"))
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(file))
+		http.ServeFile(w, r, file)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, result)
+}
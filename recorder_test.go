@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordDownload(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "record")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "adcp.ens"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := record.dir
+	record.dir = dir
+	defer func() { record.dir = saved }()
+
+	tests := []struct {
+		file string
+		want int
+	}{
+		{"adcp.ens", http.StatusOK},
+		{"../record/adcp.ens", http.StatusOK},
+		{"missing.ens", http.StatusNotFound},
+		{".", http.StatusNotFound},
+		{"..", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		recordHandler(rec, httptest.NewRequest(http.MethodGet, "/record/download?file="+test.file, nil))
+		if rec.Code != test.want {
+			t.Errorf("download %s status = %d, want %d", test.file, rec.Code, test.want)
+		}
+	}
+}
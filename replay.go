@@ -0,0 +1,282 @@
+///
+/// Replay a recorded ensemble file to the displays.
+///
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// Longest time to wait between replayed ensembles.
+// Large gaps in the recording are shortened to this time.
+const replayMaxDelay = 60 * time.Second
+
+// replayEntry is where an ensemble is in the loaded files.
+type replayEntry struct {
+	path   string    // Data file
+	offset int64     // Offset of the ensemble in the file
+	time   time.Time // Ensemble time
+}
+
+// replayer will hold the index of the ensembles in the loaded file
+// and the state of the replay.  Each ensemble is read from the file
+// when it is replayed.
+type replayer struct {
+	mutex   sync.Mutex    // Lock the state
+	file    string        // File loaded
+	entries []replayEntry // Ensembles in the file
+	index   int           // Index of the next ensemble to replay
+	playing bool          // Flag if the replay is playing
+	speed   float64       // Speed multiplier
+	wake    chan bool     // Wake the replay when the state changes
+}
+
+// replayStatus is the status of the replay.
+type replayStatus struct {
+	File    string  // File loaded
+	Index   int     // Index of the next ensemble to replay
+	Count   int     // Number of ensembles in the file
+	Playing bool    // Flag if the replay is playing
+	Speed   float64 // Speed multiplier
+}
+
+// replay is the replay of the loaded file.
+var replay = &replayer{
+	speed: 1.0,                // Original cadence
+	wake:  make(chan bool, 1), // Wake the replay
+}
+
+// load will index the ensembles in the files selected by the filter.
+// The replay is paused at the start of the ensembles.
+func (r *replayer) load(paths []string, filter ensembleFilter) error {
+	file := strings.Join(paths, ", ")
+	var entries []replayEntry
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = readEnsembleOffsets(f, func(ens rti.Ensemble, offset int64) error {
+			if filter.match(ens) {
+				entries = append(entries, replayEntry{path: path, offset: offset, time: ensembleTime(ens)})
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(entries) == 0 {
+		return errors.New("no ensembles found in " + file)
+	}
+
+	r.mutex.Lock()
+	r.file = file
+	r.entries = entries
+	r.index = 0
+	r.playing = false
+	r.mutex.Unlock()
+	r.notify()
+
+	log.Printf("Replay loaded %d ensembles from %s", len(entries), file)
+	return nil
+}
+
+// send will read the ensemble from its file and send it to the server.
+func (r *replayer) send(entry replayEntry) {
+	ens, err := readEnsembleAt(entry.path, entry.offset)
+	if err != nil {
+		log.Println("Error reading replay ensemble: " + err.Error())
+		return
+	}
+	server.replay <- ens
+}
+
+// notify will wake the replay to check the new state.
+func (r *replayer) notify() {
+	select {
+	case r.wake <- true:
+	default:
+	}
+}
+
+// status will get the current state of the replay.
+func (r *replayer) status() replayStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return replayStatus{
+		File:    r.file,
+		Index:   r.index,
+		Count:   len(r.entries),
+		Playing: r.playing,
+		Speed:   r.speed,
+	}
+}
+
+// play will start the replay at the speed multiplier.
+func (r *replayer) play(speed float64) {
+	r.mutex.Lock()
+	if speed > 0 {
+		r.speed = speed
+	}
+	r.playing = true
+	r.mutex.Unlock()
+	r.notify()
+}
+
+// pause will stop the replay at the current ensemble.
+func (r *replayer) pause() {
+	r.mutex.Lock()
+	r.playing = false
+	r.mutex.Unlock()
+	r.notify()
+}
+
+// seek will move the replay to the ensemble index.
+func (r *replayer) seek(index int) {
+	r.mutex.Lock()
+	if index < 0 {
+		index = 0
+	}
+	if index > len(r.entries) {
+		index = len(r.entries)
+	}
+	r.index = index
+	r.mutex.Unlock()
+	r.notify()
+}
+
+// step will pause the replay and send the next ensemble.
+func (r *replayer) step() {
+	r.mutex.Lock()
+	r.playing = false
+	if r.index >= len(r.entries) {
+		r.mutex.Unlock()
+		return
+	}
+	entry := r.entries[r.index]
+	r.index++
+	r.mutex.Unlock()
+	r.notify()
+
+	r.send(entry)
+}
+
+// run will send the ensembles to the server while the replay is playing.
+// The time between ensembles is the time between the ensembles in the
+// file divided by the speed multiplier.
+func (r *replayer) run() {
+	for {
+		r.mutex.Lock()
+		if !r.playing || r.index >= len(r.entries) {
+			// Wait for the state to change
+			r.playing = false
+			r.mutex.Unlock()
+			<-r.wake
+			continue
+		}
+
+		// Get the ensemble and the time until the next ensemble
+		entry := r.entries[r.index]
+		var delay time.Duration
+		if r.index+1 < len(r.entries) {
+			delay = r.entries[r.index+1].time.Sub(entry.time)
+			delay = time.Duration(float64(delay) / r.speed)
+		}
+		if delay < 0 {
+			delay = 0
+		}
+		if delay > replayMaxDelay {
+			delay = replayMaxDelay
+		}
+		r.index++
+		r.mutex.Unlock()
+
+		r.send(entry)
+
+		// Wait for the next ensemble or the state to change
+		select {
+		case <-time.After(delay):
+		case <-r.wake:
+		}
+	}
+}
+
+// replayHandler will control the replay.
+//
+//	/replay/status                                 Get the status
+//	/replay/load?file=name                         Load a file from the recording or upload folder
+//	/replay/load?serial=&config=&start=&end=       Load the ingested ensembles of an ADCP
+//	/replay/play?speed=multiplier                  Play the replay
+//	/replay/pause                                  Pause the replay
+//	/replay/seek?index=ensemble                    Move to the ensemble index
+//	/replay/step                                   Send the next ensemble
+//
+// Every action except status changes the replay, so it must be a POST.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/replay/") {
+	case "status":
+	case "load":
+		if !requirePost(w, r) {
+			return
+		}
+		filter, err := parseEnsembleFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		paths, err := parseDataFiles(r, filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := replay.load(paths, filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "play":
+		if !requirePost(w, r) {
+			return
+		}
+		speed, _ := strconv.ParseFloat(r.FormValue("speed"), 64)
+		replay.play(speed)
+	case "pause":
+		if !requirePost(w, r) {
+			return
+		}
+		replay.pause()
+	case "seek":
+		if !requirePost(w, r) {
+			return
+		}
+		index, err := strconv.Atoi(r.FormValue("index"))
+		if err != nil {
+			http.Error(w, "Bad index", http.StatusBadRequest)
+			return
+		}
+		replay.seek(index)
+	case "step":
+		if !requirePost(w, r) {
+			return
+		}
+		replay.step()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// Send the status
+	writeJSON(w, replay.status())
+}
@@ -0,0 +1,525 @@
+///
+/// Decode and encode the RTI binary ensemble format.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/ricorx7/go-rti"
+)
+
+const (
+	rtiHeaderByte        = 0x80        // Value of every byte in the ensemble header
+	rtiHeaderStartSize   = 16          // Number of 0x80 bytes at the start of the header
+	rtiHeaderSize        = 32          // Size of the ensemble header
+	rtiChecksumSize      = 4           // Size of the checksum at the end of the ensemble
+	rtiDataSetHeaderSize = 28          // Size of the header for each data set
+	rtiMaxPayloadSize    = 1024 * 1024 // Largest payload accepted before the header is considered bad
+	rtiBadVelocity       = 88.888      // Value of a bad velocity
+)
+
+// RTI data set types.
+const (
+	rtiDataTypeFloat = 10 // Float data
+	rtiDataTypeInt   = 20 // Integer data
+	rtiDataTypeByte  = 50 // Byte data
+)
+
+// RTI data set names.
+const (
+	rtiBeamVelocityID       = "E000001" // Beam velocity data set
+	rtiInstrumentVelocityID = "E000002" // Instrument velocity data set
+	rtiEarthVelocityID      = "E000003" // Earth velocity data set
+	rtiAmplitudeID          = "E000004" // Amplitude data set
+	rtiCorrelationID        = "E000005" // Correlation data set
+	rtiGoodBeamID           = "E000006" // Good beam data set
+	rtiGoodEarthID          = "E000007" // Good earth data set
+	rtiEnsembleDataID       = "E000008" // Ensemble data set
+	rtiAncillaryID          = "E000009" // Ancillary data set
+	rtiBottomTrackID        = "E000010" // Bottom track data set
+)
+
+// rtiHeaderStart is the start of every RTI ensemble.
+var rtiHeaderStart = bytes.Repeat([]byte{rtiHeaderByte}, rtiHeaderStartSize)
+
+// rtiBinaryCodec will reassemble the RTI binary ensembles
+// from a stream of data.  The data can be split across any
+// number of messages.
+type rtiBinaryCodec struct {
+	buffer []byte  // Data waiting to be decoded
+	offset int64   // Offset in the stream of the start of the buffer
+	starts []int64 // Offset in the stream of each ensemble from the last add
+}
+
+// skip will remove the bytes from the start of the buffer.
+func (codec *rtiBinaryCodec) skip(n int) {
+	codec.buffer = codec.buffer[n:]
+	codec.offset += int64(n)
+}
+
+// add will add the data to the buffer and return all the
+// complete ensembles found in the buffer.  Any ensemble with a bad
+// checksum is dropped.
+func (codec *rtiBinaryCodec) add(data []byte) []rti.Ensemble {
+	codec.buffer = append(codec.buffer, data...)
+	codec.starts = codec.starts[:0]
+
+	var ensembles []rti.Ensemble
+	for {
+		// Find the start of the header
+		start := bytes.Index(codec.buffer, rtiHeaderStart)
+		if start < 0 {
+			// Keep the end of the buffer in case the header is split
+			if len(codec.buffer) > rtiHeaderStartSize {
+				codec.skip(len(codec.buffer) - rtiHeaderStartSize)
+			}
+			return ensembles
+		}
+		codec.skip(start)
+
+		// Wait for the rest of the header
+		if len(codec.buffer) < rtiHeaderSize {
+			return ensembles
+		}
+
+		// Verify the ensemble number and payload size with their inverse
+		ensNum := binary.LittleEndian.Uint32(codec.buffer[16:])
+		ensNumInv := binary.LittleEndian.Uint32(codec.buffer[20:])
+		payloadSize := binary.LittleEndian.Uint32(codec.buffer[24:])
+		payloadSizeInv := binary.LittleEndian.Uint32(codec.buffer[28:])
+		if ensNum != ^ensNumInv || payloadSize != ^payloadSizeInv || payloadSize > rtiMaxPayloadSize {
+			// Bad header, look for the next one
+			codec.skip(1)
+			continue
+		}
+
+		// Wait for the entire ensemble
+		ensSize := rtiHeaderSize + int(payloadSize) + rtiChecksumSize
+		if len(codec.buffer) < ensSize {
+			return ensembles
+		}
+
+		// Verify the checksum
+		payload := codec.buffer[rtiHeaderSize : rtiHeaderSize+int(payloadSize)]
+		checksum := binary.LittleEndian.Uint32(codec.buffer[rtiHeaderSize+int(payloadSize):])
+		if uint32(rtiChecksum(payload)) != checksum {
+			log.Printf("Bad checksum for ensemble %d", ensNum)
+			codec.skip(1)
+			continue
+		}
+
+		// Decode the ensemble
+		ens, err := decodeRtiPayload(payload)
+		if err != nil {
+			log.Printf("Error decoding ensemble %d: %v", ensNum, err)
+		} else {
+			ensembles = append(ensembles, ens)
+			codec.starts = append(codec.starts, codec.offset)
+		}
+
+		// Remove the ensemble from the buffer
+		codec.skip(ensSize)
+	}
+}
+
+// rtiChecksum will calculate the CRC-16 CCITT checksum
+// of the payload.
+func rtiChecksum(payload []byte) uint16 {
+	var crc uint16
+	for _, b := range payload {
+		crc = (crc >> 8) | (crc << 8)
+		crc ^= uint16(b)
+		crc ^= (crc & 0xff) >> 4
+		crc ^= (crc << 8) << 4
+		crc ^= ((crc & 0xff) << 4) << 1
+	}
+	return crc
+}
+
+// decodeRtiPayload will decode all the data sets in the payload
+// into an ensemble.
+func decodeRtiPayload(payload []byte) (rti.Ensemble, error) {
+	var ens rti.Ensemble
+
+	for len(payload) >= rtiDataSetHeaderSize {
+		// Data set header
+		var base rti.BaseDataSet
+		base.DsType = binary.LittleEndian.Uint32(payload[0:])
+		base.NumElements = binary.LittleEndian.Uint32(payload[4:])
+		base.ElementMultiplier = binary.LittleEndian.Uint32(payload[8:])
+		base.Imag = binary.LittleEndian.Uint32(payload[12:])
+		base.NameLen = binary.LittleEndian.Uint32(payload[16:])
+		base.Name = strings.TrimRight(string(payload[20:rtiDataSetHeaderSize]), "\x00")
+
+		// Size of the data in the data set.  Each count is checked on its
+		// own so a bad header can not overflow the size or allocate
+		// more than the payload holds.
+		var elementSize uint64 = 4
+		if base.DsType == rtiDataTypeByte {
+			elementSize = 1
+		}
+		available := uint64(len(payload) - rtiDataSetHeaderSize)
+		if base.NumElements > 0 && base.ElementMultiplier == 0 {
+			return ens, errors.New("data set " + base.Name + " has elements without an element multiplier")
+		}
+		if uint64(base.NumElements) > available || uint64(base.ElementMultiplier) > available ||
+			uint64(base.NumElements)*uint64(base.ElementMultiplier)*elementSize > available {
+			return ens, errors.New("data set " + base.Name + " is larger than the payload")
+		}
+		dataSize := int(uint64(base.NumElements) * uint64(base.ElementMultiplier) * elementSize)
+		data := payload[rtiDataSetHeaderSize : rtiDataSetHeaderSize+dataSize]
+
+		switch base.Name {
+		case rtiBeamVelocityID:
+			ens.BeamVelocityData.Base = base
+			ens.BeamVelocityData.Velocity = decodeRtiFloatArray(data, base)
+		case rtiInstrumentVelocityID:
+			ens.InstrumentVelocityData.Base = base
+			ens.InstrumentVelocityData.Velocity = decodeRtiFloatArray(data, base)
+		case rtiEarthVelocityID:
+			ens.EarthVelocityData.Base = base
+			ens.EarthVelocityData.Velocity = decodeRtiFloatArray(data, base)
+			ens.EarthVelocityData.Vectors = earthVelocityVectors(ens.EarthVelocityData.Velocity)
+		case rtiAmplitudeID:
+			ens.AmplitudeData.Base = base
+			ens.AmplitudeData.Amplitude = decodeRtiFloatArray(data, base)
+		case rtiCorrelationID:
+			ens.CorrelationData.Base = base
+			ens.CorrelationData.Correlation = decodeRtiFloatArray(data, base)
+		case rtiGoodBeamID:
+			ens.GoodBeamData.Base = base
+			ens.GoodBeamData.GoodBeam = decodeRtiIntArray(data, base)
+		case rtiGoodEarthID:
+			ens.GoodEarthData.Base = base
+			ens.GoodEarthData.GoodEarth = decodeRtiIntArray(data, base)
+		case rtiEnsembleDataID:
+			ens.EnsembleData.Base = base
+			decodeRtiEnsembleData(data, &ens.EnsembleData)
+		case rtiAncillaryID:
+			ens.AncillaryData.Base = base
+			decodeRtiAncillaryData(data, &ens.AncillaryData)
+		case rtiBottomTrackID:
+			ens.BottomTrackData.Base = base
+			decodeRtiBottomTrackData(data, &ens.BottomTrackData)
+		}
+
+		// Move to the next data set
+		payload = payload[rtiDataSetHeaderSize+dataSize:]
+	}
+
+	return ens, nil
+}
+
+// rtiFloat will get the float value at the given element index.
+// If the index is beyond the data, 0 is returned.
+func rtiFloat(data []byte, index int) float32 {
+	if (index+1)*4 > len(data) {
+		return 0
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(data[index*4:]))
+}
+
+// rtiInt will get the integer value at the given element index.
+// If the index is beyond the data, 0 is returned.
+func rtiInt(data []byte, index int) uint32 {
+	if (index+1)*4 > len(data) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(data[index*4:])
+}
+
+// decodeRtiFloatArray will decode the bin and beam data.
+// The data is stored beam by beam.  The result is [bin][beam].
+func decodeRtiFloatArray(data []byte, base rti.BaseDataSet) [][]float32 {
+	numBins := int(base.NumElements)
+	numBeams := int(base.ElementMultiplier)
+
+	values := make([][]float32, numBins)
+	for bin := 0; bin < numBins; bin++ {
+		values[bin] = make([]float32, numBeams)
+		for beam := 0; beam < numBeams; beam++ {
+			values[bin][beam] = rtiFloat(data, beam*numBins+bin)
+		}
+	}
+	return values
+}
+
+// decodeRtiIntArray will decode the bin and beam data.
+// The data is stored beam by beam.  The result is [bin][beam].
+func decodeRtiIntArray(data []byte, base rti.BaseDataSet) [][]int {
+	numBins := int(base.NumElements)
+	numBeams := int(base.ElementMultiplier)
+
+	values := make([][]int, numBins)
+	for bin := 0; bin < numBins; bin++ {
+		values[bin] = make([]int, numBeams)
+		for beam := 0; beam < numBeams; beam++ {
+			values[bin][beam] = int(int32(rtiInt(data, beam*numBins+bin)))
+		}
+	}
+	return values
+}
+
+// earthVelocityVectors will calculate the magnitude and direction
+// of the water for each bin.
+func earthVelocityVectors(vel [][]float32) []rti.VelocityVector {
+	vectors := make([]rti.VelocityVector, len(vel))
+	for bin := range vel {
+		// Bad velocity if any of the East, North or Vertical values are bad
+		if len(vel[bin]) < 3 || vel[bin][0] == rtiBadVelocity || vel[bin][1] == rtiBadVelocity || vel[bin][2] == rtiBadVelocity {
+			vectors[bin].Magnitude = rtiBadVelocity
+			vectors[bin].DirectionXNorth = rtiBadVelocity
+			vectors[bin].DirectionYNorth = rtiBadVelocity
+			continue
+		}
+
+		east := float64(vel[bin][0])
+		north := float64(vel[bin][1])
+		vert := float64(vel[bin][2])
+		vectors[bin].Magnitude = math.Sqrt(east*east + north*north + vert*vert)
+		vectors[bin].DirectionXNorth = math.Atan2(north, east) * 180.0 / math.Pi
+		vectors[bin].DirectionYNorth = math.Atan2(east, north) * 180.0 / math.Pi
+	}
+	return vectors
+}
+
+// decodeRtiEnsembleData will decode the ensemble data set.
+func decodeRtiEnsembleData(data []byte, ensData *rti.EnsembleDataSet) {
+	ensData.EnsembleNumber = rtiInt(data, 0)
+	ensData.NumBins = rtiInt(data, 1)
+	ensData.NumBeams = rtiInt(data, 2)
+	ensData.DesiredPingCount = rtiInt(data, 3)
+	ensData.ActualPingCount = rtiInt(data, 4)
+	ensData.Status = rtiInt(data, 5)
+	ensData.Year = rtiInt(data, 6)
+	ensData.Month = rtiInt(data, 7)
+	ensData.Day = rtiInt(data, 8)
+	ensData.Hour = rtiInt(data, 9)
+	ensData.Minute = rtiInt(data, 10)
+	ensData.Second = rtiInt(data, 11)
+	ensData.HSec = rtiInt(data, 12)
+
+	// Serial number is 32 bytes
+	if len(data) >= 84 {
+		ensData.SerialNumber.SerialNumber = strings.TrimRight(string(data[52:84]), "\x00")
+	}
+
+	// Firmware is 4 bytes
+	if len(data) >= 88 {
+		ensData.SysFirmware.FirmwareRevision = data[84]
+		ensData.SysFirmware.FirmwareMinor = data[85]
+		ensData.SysFirmware.FirmwareMajor = data[86]
+		ensData.SysFirmware.SubsystemCode = data[87]
+	}
+
+	// Subsystem configuration is 4 bytes
+	if len(data) >= 92 {
+		ensData.SubsystemConfig.CepoIndex = data[88]
+	}
+}
+
+// decodeRtiAncillaryData will decode the ancillary data set.
+func decodeRtiAncillaryData(data []byte, anc *rti.AncillaryDataSet) {
+	anc.FirstBinRange = rtiFloat(data, 0)
+	anc.BinSize = rtiFloat(data, 1)
+	anc.FirstPingTime = rtiFloat(data, 2)
+	anc.LastPingTime = rtiFloat(data, 3)
+	anc.Heading = rtiFloat(data, 4)
+	anc.Pitch = rtiFloat(data, 5)
+	anc.Roll = rtiFloat(data, 6)
+	anc.WaterTemp = rtiFloat(data, 7)
+	anc.SystemTemp = rtiFloat(data, 8)
+	anc.Salinity = rtiFloat(data, 9)
+	anc.Pressure = rtiFloat(data, 10)
+	anc.TransducerDepth = rtiFloat(data, 11)
+	anc.SpeedOfSound = rtiFloat(data, 12)
+}
+
+// decodeRtiBottomTrackData will decode the bottom track data set.
+func decodeRtiBottomTrackData(data []byte, bt *rti.BottomTrackDataSet) {
+	bt.FirstPingTime = rtiFloat(data, 0)
+	bt.LastPingTime = rtiFloat(data, 1)
+	bt.Heading = rtiFloat(data, 2)
+	bt.Pitch = rtiFloat(data, 3)
+	bt.Roll = rtiFloat(data, 4)
+	bt.WaterTemp = rtiFloat(data, 5)
+	bt.SystemTemp = rtiFloat(data, 6)
+	bt.Salinity = rtiFloat(data, 7)
+	bt.Pressure = rtiFloat(data, 8)
+	bt.TransducerDepth = rtiFloat(data, 9)
+	bt.SpeedOfSound = rtiFloat(data, 10)
+	bt.Status = rtiFloat(data, 11)
+	bt.NumBeams = rtiFloat(data, 12)
+	bt.ActualPingCount = rtiFloat(data, 13)
+
+	// Each value is an array with a value for each beam
+	numBeams := int(bt.NumBeams)
+	if numBeams < 0 || 14+10*numBeams > len(data)/4 {
+		return
+	}
+	beamValues := func(index int) []float32 {
+		values := make([]float32, numBeams)
+		for beam := 0; beam < numBeams; beam++ {
+			values[beam] = rtiFloat(data, 14+index*numBeams+beam)
+		}
+		return values
+	}
+	bt.Range = beamValues(0)
+	bt.SNR = beamValues(1)
+	bt.Amplitude = beamValues(2)
+	bt.Correlation = beamValues(3)
+	bt.BeamVelocity = beamValues(4)
+	bt.BeamGood = beamValues(5)
+	bt.InstrumentVelocity = beamValues(6)
+	bt.InstrumentGood = beamValues(7)
+	bt.EarthVelocity = beamValues(8)
+	bt.EarthGood = beamValues(9)
+}
+
+// isJSONData will check if the data is JSON data.
+// JSON data will start with a { or [.
+func isJSONData(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && (data[0] == '{' || data[0] == '[')
+}
+
+// decodeJSONEnsemble will decode the JSON data to an ensemble.
+func decodeJSONEnsemble(data []byte) (rti.Ensemble, error) {
+	var ens rti.Ensemble
+	err := json.Unmarshal(data, &ens)
+	return ens, err
+}
+
+// encodeRtiEnsemble will encode the ensemble to the RTI binary format.
+// Only the data sets that contain data are encoded.
+func encodeRtiEnsemble(ens rti.Ensemble) []byte {
+	var payload bytes.Buffer
+
+	// Ensemble data set
+	ensData := make([]byte, 92)
+	ed := ens.EnsembleData
+	for i, val := range []uint32{ed.EnsembleNumber, ed.NumBins, ed.NumBeams, ed.DesiredPingCount, ed.ActualPingCount, ed.Status,
+		ed.Year, ed.Month, ed.Day, ed.Hour, ed.Minute, ed.Second, ed.HSec} {
+		binary.LittleEndian.PutUint32(ensData[i*4:], uint32(val))
+	}
+	copy(ensData[52:84], ed.SerialNumber.SerialNumber)
+	ensData[84] = ed.SysFirmware.FirmwareRevision
+	ensData[85] = ed.SysFirmware.FirmwareMinor
+	ensData[86] = ed.SysFirmware.FirmwareMajor
+	ensData[87] = ed.SysFirmware.SubsystemCode
+	ensData[88] = ed.SubsystemConfig.CepoIndex
+	writeRtiDataSet(&payload, rtiEnsembleDataID, rtiDataTypeInt, len(ensData)/4, 1, ensData)
+
+	// Ancillary data set
+	anc := ens.AncillaryData
+	writeRtiFloats(&payload, rtiAncillaryID, []float32{anc.FirstBinRange, anc.BinSize, anc.FirstPingTime, anc.LastPingTime,
+		anc.Heading, anc.Pitch, anc.Roll, anc.WaterTemp, anc.SystemTemp, anc.Salinity, anc.Pressure,
+		anc.TransducerDepth, anc.SpeedOfSound})
+
+	// Bin and beam data sets
+	writeRtiFloatArray(&payload, rtiBeamVelocityID, ens.BeamVelocityData.Velocity)
+	writeRtiFloatArray(&payload, rtiInstrumentVelocityID, ens.InstrumentVelocityData.Velocity)
+	writeRtiFloatArray(&payload, rtiEarthVelocityID, ens.EarthVelocityData.Velocity)
+	writeRtiFloatArray(&payload, rtiAmplitudeID, ens.AmplitudeData.Amplitude)
+	writeRtiFloatArray(&payload, rtiCorrelationID, ens.CorrelationData.Correlation)
+	writeRtiIntArray(&payload, rtiGoodBeamID, ens.GoodBeamData.GoodBeam)
+	writeRtiIntArray(&payload, rtiGoodEarthID, ens.GoodEarthData.GoodEarth)
+
+	// Bottom track data set
+	bt := ens.BottomTrackData
+	if len(bt.Range) > 0 {
+		values := []float32{bt.FirstPingTime, bt.LastPingTime, bt.Heading, bt.Pitch, bt.Roll, bt.WaterTemp,
+			bt.SystemTemp, bt.Salinity, bt.Pressure, bt.TransducerDepth, bt.SpeedOfSound, bt.Status,
+			float32(len(bt.Range)), bt.ActualPingCount}
+		for _, beamValues := range [][]float32{bt.Range, bt.SNR, bt.Amplitude, bt.Correlation, bt.BeamVelocity,
+			bt.BeamGood, bt.InstrumentVelocity, bt.InstrumentGood, bt.EarthVelocity, bt.EarthGood} {
+			for beam := 0; beam < len(bt.Range); beam++ {
+				var val float32
+				if beam < len(beamValues) {
+					val = beamValues[beam]
+				}
+				values = append(values, val)
+			}
+		}
+		writeRtiFloats(&payload, rtiBottomTrackID, values)
+	}
+
+	// Header, payload and checksum
+	buf := make([]byte, rtiHeaderSize, rtiHeaderSize+payload.Len()+rtiChecksumSize)
+	copy(buf, rtiHeaderStart)
+	binary.LittleEndian.PutUint32(buf[16:], uint32(ed.EnsembleNumber))
+	binary.LittleEndian.PutUint32(buf[20:], ^uint32(ed.EnsembleNumber))
+	binary.LittleEndian.PutUint32(buf[24:], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(buf[28:], ^uint32(payload.Len()))
+	buf = append(buf, payload.Bytes()...)
+
+	checksum := make([]byte, rtiChecksumSize)
+	binary.LittleEndian.PutUint32(checksum, uint32(rtiChecksum(payload.Bytes())))
+	return append(buf, checksum...)
+}
+
+// writeRtiDataSet will write the data set header and data.
+func writeRtiDataSet(buf *bytes.Buffer, name string, dsType int, numElements int, elementMultiplier int, data []byte) {
+	header := make([]byte, rtiDataSetHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(dsType))
+	binary.LittleEndian.PutUint32(header[4:], uint32(numElements))
+	binary.LittleEndian.PutUint32(header[8:], uint32(elementMultiplier))
+	binary.LittleEndian.PutUint32(header[12:], 0)
+	binary.LittleEndian.PutUint32(header[16:], 8)
+	copy(header[20:], name)
+	buf.Write(header)
+	buf.Write(data)
+}
+
+// writeRtiFloats will write a data set with a single column of values.
+func writeRtiFloats(buf *bytes.Buffer, name string, values []float32) {
+	data := make([]byte, len(values)*4)
+	for i, val := range values {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(val))
+	}
+	writeRtiDataSet(buf, name, rtiDataTypeFloat, len(values), 1, data)
+}
+
+// writeRtiFloatArray will write the [bin][beam] values beam by beam.
+// Nothing is written if there is no data.
+func writeRtiFloatArray(buf *bytes.Buffer, name string, values [][]float32) {
+	if len(values) == 0 || len(values[0]) == 0 {
+		return
+	}
+	numBins := len(values)
+	numBeams := len(values[0])
+
+	data := make([]byte, numBins*numBeams*4)
+	for bin := range values {
+		for beam := 0; beam < numBeams && beam < len(values[bin]); beam++ {
+			binary.LittleEndian.PutUint32(data[(beam*numBins+bin)*4:], math.Float32bits(values[bin][beam]))
+		}
+	}
+	writeRtiDataSet(buf, name, rtiDataTypeFloat, numBins, numBeams, data)
+}
+
+// writeRtiIntArray will write the [bin][beam] values beam by beam.
+// Nothing is written if there is no data.
+func writeRtiIntArray(buf *bytes.Buffer, name string, values [][]int) {
+	if len(values) == 0 || len(values[0]) == 0 {
+		return
+	}
+	numBins := len(values)
+	numBeams := len(values[0])
+
+	data := make([]byte, numBins*numBeams*4)
+	for bin := range values {
+		for beam := 0; beam < numBeams && beam < len(values[bin]); beam++ {
+			binary.LittleEndian.PutUint32(data[(beam*numBins+bin)*4:], uint32(int32(values[bin][beam])))
+		}
+	}
+	writeRtiDataSet(buf, name, rtiDataTypeInt, numBins, numBeams, data)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// rtiTestPayload will get the payload of the encoded ensemble after
+// checking the header and checksum.
+func rtiTestPayload(t *testing.T, data []byte) []byte {
+	t.Helper()
+	if !bytes.HasPrefix(data, rtiHeaderStart) {
+		t.Fatal("ensemble does not start with the header")
+	}
+	payloadSize := int(binary.LittleEndian.Uint32(data[24:]))
+	if len(data) != rtiHeaderSize+payloadSize+rtiChecksumSize {
+		t.Fatalf("ensemble size = %d, want %d", len(data), rtiHeaderSize+payloadSize+rtiChecksumSize)
+	}
+	payload := data[rtiHeaderSize : rtiHeaderSize+payloadSize]
+	if checksum := binary.LittleEndian.Uint32(data[rtiHeaderSize+payloadSize:]); checksum != uint32(rtiChecksum(payload)) {
+		t.Fatalf("checksum = %04x, want %04x", checksum, rtiChecksum(payload))
+	}
+	return payload
+}
+
+func TestRtiChecksum(t *testing.T) {
+	// CRC-16 CCITT with a 0 start value
+	tests := []struct {
+		data []byte
+		want uint16
+	}{
+		{nil, 0},
+		{[]byte("123456789"), 0x31C3},
+	}
+	for _, test := range tests {
+		if got := rtiChecksum(test.data); got != test.want {
+			t.Errorf("rtiChecksum(%q) = %04x, want %04x", test.data, got, test.want)
+		}
+	}
+	if rtiChecksum([]byte{1, 2}) == rtiChecksum([]byte{2, 1}) {
+		t.Error("checksum does not depend on the byte order")
+	}
+}
+
+func TestRtiRoundTrip(t *testing.T) {
+	want := pd0TestEnsemble()
+	want.BeamVelocityData.Velocity = want.EarthVelocityData.Velocity
+	want.GoodBeamData.GoodBeam = want.GoodEarthData.GoodEarth
+
+	got, err := decodeRtiPayload(rtiTestPayload(t, encodeRtiEnsemble(want)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.EnsembleData.EnsembleNumber != want.EnsembleData.EnsembleNumber {
+		t.Errorf("EnsembleNumber = %d, want %d", got.EnsembleData.EnsembleNumber, want.EnsembleData.EnsembleNumber)
+	}
+	if got.EnsembleData.SerialNumber.SerialNumber != want.EnsembleData.SerialNumber.SerialNumber {
+		t.Errorf("SerialNumber = %q, want %q", got.EnsembleData.SerialNumber.SerialNumber, want.EnsembleData.SerialNumber.SerialNumber)
+	}
+	if got.EnsembleData.SysFirmware != want.EnsembleData.SysFirmware {
+		t.Errorf("SysFirmware = %v, want %v", got.EnsembleData.SysFirmware, want.EnsembleData.SysFirmware)
+	}
+	if !ensembleTime(got).Equal(ensembleTime(want)) {
+		t.Errorf("time = %v, want %v", ensembleTime(got), ensembleTime(want))
+	}
+
+	assertFloat(t, "Heading", got.AncillaryData.Heading, want.AncillaryData.Heading)
+	assertFloat(t, "Pressure", got.AncillaryData.Pressure, want.AncillaryData.Pressure)
+	assertFloat(t, "BinSize", got.AncillaryData.BinSize, want.AncillaryData.BinSize)
+
+	for bin := range want.EarthVelocityData.Velocity {
+		for beam := range want.EarthVelocityData.Velocity[bin] {
+			assertFloat(t, "EarthVelocity", got.EarthVelocityData.Velocity[bin][beam], want.EarthVelocityData.Velocity[bin][beam])
+			assertFloat(t, "BeamVelocity", got.BeamVelocityData.Velocity[bin][beam], want.BeamVelocityData.Velocity[bin][beam])
+			assertFloat(t, "Amplitude", got.AmplitudeData.Amplitude[bin][beam], want.AmplitudeData.Amplitude[bin][beam])
+			assertFloat(t, "Correlation", got.CorrelationData.Correlation[bin][beam], want.CorrelationData.Correlation[bin][beam])
+			if got.GoodEarthData.GoodEarth[bin][beam] != want.GoodEarthData.GoodEarth[bin][beam] {
+				t.Errorf("GoodEarth[%d][%d] = %d, want %d", bin, beam, got.GoodEarthData.GoodEarth[bin][beam], want.GoodEarthData.GoodEarth[bin][beam])
+			}
+			if got.GoodBeamData.GoodBeam[bin][beam] != want.GoodBeamData.GoodBeam[bin][beam] {
+				t.Errorf("GoodBeam[%d][%d] = %d, want %d", bin, beam, got.GoodBeamData.GoodBeam[bin][beam], want.GoodBeamData.GoodBeam[bin][beam])
+			}
+		}
+	}
+	if len(got.InstrumentVelocityData.Velocity) != 0 {
+		t.Error("instrument velocity decoded without the data set")
+	}
+
+	for beam := range want.BottomTrackData.Range {
+		assertFloat(t, "BT Range", got.BottomTrackData.Range[beam], want.BottomTrackData.Range[beam])
+		assertFloat(t, "BT EarthVelocity", got.BottomTrackData.EarthVelocity[beam], want.BottomTrackData.EarthVelocity[beam])
+	}
+
+	// Encoding the decoded ensemble is the same
+	if !bytes.Equal(encodeRtiEnsemble(got), encodeRtiEnsemble(want)) {
+		t.Error("re-encoded RTI ensemble does not match the original")
+	}
+}
+
+func TestDecodeRtiPayloadTruncated(t *testing.T) {
+	payload := rtiTestPayload(t, encodeRtiEnsemble(pd0TestEnsemble()))
+	if _, err := decodeRtiPayload(payload[:len(payload)-10]); err == nil {
+		t.Error("no error for a truncated data set")
+	}
+}
+
+func TestDecodeRtiPayloadBadSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		numElements uint32
+		multiplier  uint32
+	}{
+		{"no multiplier", 0xFFFFFFFF, 0},
+		{"size overflow", 1 << 31, 1 << 31},
+	}
+	for _, test := range tests {
+		header := make([]byte, rtiDataSetHeaderSize)
+		binary.LittleEndian.PutUint32(header[0:], rtiDataTypeFloat)
+		binary.LittleEndian.PutUint32(header[4:], test.numElements)
+		binary.LittleEndian.PutUint32(header[8:], test.multiplier)
+		binary.LittleEndian.PutUint32(header[16:], uint32(len(rtiBeamVelocityID)+1))
+		copy(header[20:], rtiBeamVelocityID)
+		if _, err := decodeRtiPayload(header); err == nil {
+			t.Errorf("%s: no error for the data set size", test.name)
+		}
+	}
+}
+
+func TestRtiCodecSplitFrames(t *testing.T) {
+	first := pd0TestEnsemble()
+	second := pd0TestEnsemble()
+	second.EnsembleData.EnsembleNumber++
+
+	bad := encodeRtiEnsemble(first)
+	bad[len(bad)/2]++
+
+	// Garbage, a bad checksum and two good ensembles
+	stream := append([]byte{0x80, 0x80, '{', 0x01}, bad...)
+	stream = append(stream, encodeRtiEnsemble(first)...)
+	stream = append(stream, encodeRtiEnsemble(second)...)
+
+	// Every frame size splits the headers, data sets and checksums
+	for _, size := range []int{1, 3, 7, 16, 33, 100, 1000, len(stream)} {
+		var codec rtiBinaryCodec
+		var ensembles []rti.Ensemble
+		for i := 0; i < len(stream); i += size {
+			end := i + size
+			if end > len(stream) {
+				end = len(stream)
+			}
+			ensembles = append(ensembles, codec.add(stream[i:end])...)
+		}
+
+		if len(ensembles) != 2 {
+			t.Errorf("frame size %d: decoded %d ensembles, want 2", size, len(ensembles))
+			continue
+		}
+		if ensembles[0].EnsembleData.EnsembleNumber != first.EnsembleData.EnsembleNumber ||
+			ensembles[1].EnsembleData.EnsembleNumber != second.EnsembleData.EnsembleNumber {
+			t.Errorf("frame size %d: ensemble numbers = %d %d, want %d %d", size,
+				ensembles[0].EnsembleData.EnsembleNumber, ensembles[1].EnsembleData.EnsembleNumber,
+				first.EnsembleData.EnsembleNumber, second.EnsembleData.EnsembleNumber)
+		}
+	}
+}
+
+func TestRtiCodecJSONContinuation(t *testing.T) {
+	// A frame that continues an ensemble can start with a { like JSON.
+	// The split is in the values of the last data set.
+	data := encodeRtiEnsemble(pd0TestEnsemble())
+	split := len(data) - rtiChecksumSize - 8
+	frame := append([]byte{'{'}, data[split+1:]...)
+	data[split] = '{'
+
+	var codec rtiBinaryCodec
+	if ensembles := codec.add(data[:split]); len(ensembles) != 0 {
+		t.Fatalf("decoded %d ensembles from the first frame, want 0", len(ensembles))
+	}
+	payload := data[rtiHeaderSize : len(data)-rtiChecksumSize]
+	binary.LittleEndian.PutUint32(frame[len(frame)-rtiChecksumSize:], uint32(rtiChecksum(payload)))
+	if ensembles := codec.add(frame); len(ensembles) != 1 {
+		t.Fatalf("decoded %d ensembles after the continuation frame, want 1", len(ensembles))
+	}
+}
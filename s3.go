@@ -0,0 +1,249 @@
+///
+/// Store objects in an S3-compatible object store such as MinIO.
+///
+/// The requests are signed with AWS signature version 4 and use
+/// path-style URLs, http://endpoint/bucket/key.
+///
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm      = "AWS4-HMAC-SHA256" // Signing algorithm
+	s3Service        = "s3"               // Service name in the signing scope
+	s3DateFormat     = "20060102T150405Z" // Format of the request time
+	s3DayFormat      = "20060102"         // Format of the day in the signing scope
+	s3RequestTimeout = 10 * time.Minute   // Longest time for a request, including large uploads
+)
+
+// s3EmptyHash is the SHA256 of an empty payload.
+var s3EmptyHash = sha256Hex(nil)
+
+// s3Client will store objects in a bucket.
+type s3Client struct {
+	endpoint  *url.URL     // Endpoint of the object store
+	bucket    string       // Bucket name
+	region    string       // Region used to sign the requests
+	accessKey string       // Access key ID
+	secretKey string       // Secret access key
+	client    *http.Client // HTTP client
+}
+
+// newS3Client will create the client for the bucket.
+func newS3Client(endpoint string, bucket string, region string, accessKey string, secretKey string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("S3 endpoint must be a URL, e.g. http://localhost:9000")
+	}
+	if bucket == "" {
+		return nil, errors.New("no S3 bucket given")
+	}
+	return &s3Client{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: s3RequestTimeout},
+	}, nil
+}
+
+// sha256Hex will get the hex SHA256 of the data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 will get the HMAC-SHA256 of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape will URI encode the value as required by the signature.
+// Only letters, numbers, '-', '_', '.' and '~' are not encoded.
+// The '/' is not encoded in paths.
+func s3Escape(value string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// newRequest will create the signed request for the object.
+// The payload hash is the hex SHA256 of the body.
+func (c *s3Client) newRequest(method string, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	// Canonical path and query
+	path := s3Escape("/"+c.bucket+"/"+key, true)
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(params)
+	rawQuery := strings.Join(params, "&")
+
+	u := *c.endpoint
+	u.Path = "/" + c.bucket + "/" + key
+	u.RawPath = path
+	u.RawQuery = rawQuery
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	c.sign(req, path, rawQuery, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// sign will add the signature version 4 headers to the request.
+// The path and query must be the canonical encoded values.
+func (c *s3Client) sign(req *http.Request, path string, rawQuery string, payloadHash string, now time.Time) {
+	amzDate := now.Format(s3DateFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// Canonical request
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{req.Method, path, rawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	// String to sign and the signing key for the day, region and service
+	scope := now.Format(s3DayFormat) + "/" + c.region + "/" + s3Service + "/aws4_request"
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretKey), now.Format(s3DayFormat))
+	signingKey = hmacSHA256(signingKey, c.region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, c.accessKey, scope, signedHeaders, signature))
+}
+
+// do will send the request and return an error if it failed.
+// The response body must be closed if there is no error.
+func (c *s3Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// put will store the object.  The payload hash is the hex SHA256 of the data.
+func (c *s3Client) put(key string, body io.Reader, size int64, payloadHash string) error {
+	req, err := c.newRequest(http.MethodPut, key, nil, body, payloadHash)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// get will get the object.  The caller must close the object.
+func (c *s3Client) get(key string) (io.ReadCloser, error) {
+	req, err := c.newRequest(http.MethodGet, key, nil, nil, s3EmptyHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// remove will delete the object.
+func (c *s3Client) remove(key string) error {
+	req, err := c.newRequest(http.MethodDelete, key, nil, nil, s3EmptyHash)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3ListResult is the result of listing the objects.
+type s3ListResult struct {
+	Contents []struct {
+		Key string // Object key
+	}
+	IsTruncated           bool   // Flag if there are more objects
+	NextContinuationToken string // Token to get the next objects
+}
+
+// list will get the keys of all the objects with the prefix.
+func (c *s3Client) list(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := c.newRequest(http.MethodGet, "", query, nil, s3EmptyHash)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,293 @@
+///
+/// Screen the ensembles for bad data before they are displayed.
+///
+/// Velocities that fail a threshold are marked bad with the RTI
+/// bad velocity value, so every display stream and the last
+/// ensemble of each ADCP show the same screened data.  The recorded
+/// ensembles are not screened.
+///
+///	GET    /api/screen                      Default thresholds
+///	GET    /api/screen?serial=&config=      Thresholds of an ADCP
+///	POST   /api/screen?serial=&config=      Set the thresholds from the JSON body.  Without serial, set the defaults
+///	DELETE /api/screen?serial=&config=      Use the default thresholds for the ADCP
+///
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// screenConfig is the thresholds to screen an ensemble.
+// A threshold of 0 is not used.
+type screenConfig struct {
+	MinCorrelation   float32 // Lowest correlation, 0 to 1
+	MinAmplitude     float32 // Lowest amplitude in dB
+	MaxErrorVelocity float32 // Largest absolute error velocity in m/s
+	MinPercentGood   float32 // Lowest percent of good pings
+	BelowBottom      bool    // Screen the bins below the bottom track range
+	MaxTilt          float32 // Largest tilt from the pitch and roll in degrees
+}
+
+// screener will keep the thresholds of each ADCP.
+type screener struct {
+	mutex    sync.RWMutex            // Lock the thresholds
+	defaults screenConfig            // Thresholds of the ADCP without their own
+	adcps    map[string]screenConfig // Thresholds of each ADCP.  Key is the ADCP key
+}
+
+// screens is the screening of all the ADCP.
+var screens = &screener{
+	adcps: make(map[string]screenConfig), // Thresholds of each ADCP
+}
+
+// config will get the thresholds of the ADCP.
+func (s *screener) config(key string) screenConfig {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if config, ok := s.adcps[key]; ok {
+		return config
+	}
+	return s.defaults
+}
+
+// setDefaults will set the thresholds of the ADCP without their own.
+func (s *screener) setDefaults(config screenConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.defaults = config
+}
+
+// set will set the thresholds of the ADCP.
+func (s *screener) set(key string, config screenConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.adcps[key] = config
+}
+
+// remove will use the default thresholds for the ADCP.
+func (s *screener) remove(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.adcps, key)
+}
+
+// screenEnsemble will screen the ensemble with the thresholds of its ADCP.
+// The velocities are copied so the given ensemble is not changed.
+func screenEnsemble(ens rti.Ensemble) rti.Ensemble {
+	config := screens.config(adcpKey(ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens)))
+	return config.screen(ens)
+}
+
+// copyValues will copy the [bin][beam] values.
+func copyValues(values [][]float32) [][]float32 {
+	if values == nil {
+		return nil
+	}
+	c := make([][]float32, len(values))
+	for bin := range values {
+		c[bin] = append([]float32(nil), values[bin]...)
+	}
+	return c
+}
+
+// screen will mark the velocities that fail the thresholds as bad.
+// A beam that fails marks its beam velocity.  A bin with any beam
+// that fails marks the instrument and earth velocity of the bin.
+func (config screenConfig) screen(ens rti.Ensemble) rti.Ensemble {
+	ens.BeamVelocityData.Velocity = copyValues(ens.BeamVelocityData.Velocity)
+	ens.InstrumentVelocityData.Velocity = copyValues(ens.InstrumentVelocityData.Velocity)
+	ens.EarthVelocityData.Velocity = copyValues(ens.EarthVelocityData.Velocity)
+
+	numBins := len(ens.BeamVelocityData.Velocity)
+	if len(ens.EarthVelocityData.Velocity) > numBins {
+		numBins = len(ens.EarthVelocityData.Velocity)
+	}
+	if len(ens.InstrumentVelocityData.Velocity) > numBins {
+		numBins = len(ens.InstrumentVelocityData.Velocity)
+	}
+
+	tilted := config.tilted(ens)
+	bottom := config.bottom(ens)
+	for bin := 0; bin < numBins; bin++ {
+		// Whole bin is bad
+		badBin := tilted || binDepth(ens, bin) > bottom || config.badEarth(ens, bin)
+
+		// Each beam of the bin
+		badBeam := false
+		for beam := 0; beam < screenNumBeams(ens, bin); beam++ {
+			if badBin || config.badBeam(ens, bin, beam) {
+				badBeam = true
+				markBadVelocity(ens.BeamVelocityData.Velocity, bin, beam)
+			}
+		}
+
+		if badBin || badBeam {
+			markBadBin(ens.InstrumentVelocityData.Velocity, bin)
+			markBadBin(ens.EarthVelocityData.Velocity, bin)
+		}
+	}
+
+	// Magnitude and direction of the screened velocities
+	if ens.EarthVelocityData.Velocity != nil {
+		ens.EarthVelocityData.Vectors = earthVelocityVectors(ens.EarthVelocityData.Velocity)
+	}
+	return ens
+}
+
+// screenNumBeams will get the most beams of the bin in the beam
+// velocity, amplitude and correlation.
+func screenNumBeams(ens rti.Ensemble, bin int) int {
+	numBeams := 0
+	for _, values := range [][][]float32{ens.BeamVelocityData.Velocity, ens.AmplitudeData.Amplitude, ens.CorrelationData.Correlation} {
+		if bin < len(values) && len(values[bin]) > numBeams {
+			numBeams = len(values[bin])
+		}
+	}
+	return numBeams
+}
+
+// tilted will check if the pitch and roll are more than the largest tilt.
+func (config screenConfig) tilted(ens rti.Ensemble) bool {
+	if config.MaxTilt <= 0 {
+		return false
+	}
+	pitch := float64(ens.AncillaryData.Pitch) * math.Pi / 180
+	roll := float64(ens.AncillaryData.Roll) * math.Pi / 180
+	tilt := math.Acos(math.Cos(pitch)*math.Cos(roll)) * 180 / math.Pi
+	return tilt > float64(config.MaxTilt)
+}
+
+// bottom will get the depth below which the bins are screened.  This is the
+// shallowest bottom track range less the side lobe of the -beamangle beams.
+// If there is no bottom, no bins are screened.
+func (config screenConfig) bottom(ens rti.Ensemble) float32 {
+	bottom := float32(math.MaxFloat32)
+	if !config.BelowBottom {
+		return bottom
+	}
+	for _, btRange := range ens.BottomTrackData.Range {
+		if btRange > 0 && btRange != rtiBadVelocity && btRange < bottom {
+			bottom = btRange
+		}
+	}
+	if bottom == math.MaxFloat32 {
+		return bottom
+	}
+	return bottom * float32(math.Cos(transform.beamAngle*math.Pi/180))
+}
+
+// badBeam will check if the beam of the bin fails the correlation,
+// amplitude or percent good thresholds.
+func (config screenConfig) badBeam(ens rti.Ensemble, bin int, beam int) bool {
+	if config.MinCorrelation > 0 {
+		if corr, ok := binValue(ens.CorrelationData.Correlation, bin, beam); ok && corr < config.MinCorrelation {
+			return true
+		}
+	}
+	if config.MinAmplitude > 0 {
+		if amp, ok := binValue(ens.AmplitudeData.Amplitude, bin, beam); ok && amp < config.MinAmplitude {
+			return true
+		}
+	}
+	if config.MinPercentGood > 0 && bin < len(ens.GoodBeamData.GoodBeam) && beam < len(ens.GoodBeamData.GoodBeam[bin]) {
+		if percentGood(ens, ens.GoodBeamData.GoodBeam[bin][beam]) < config.MinPercentGood {
+			return true
+		}
+	}
+	return false
+}
+
+// badEarth will check if the bin fails the error velocity or the
+// percent good of the earth velocity.
+func (config screenConfig) badEarth(ens rti.Ensemble, bin int) bool {
+	if config.MaxErrorVelocity > 0 {
+		if errVel, ok := binValue(ens.EarthVelocityData.Velocity, bin, 3); ok && errVel != rtiBadVelocity &&
+			math.Abs(float64(errVel)) > float64(config.MaxErrorVelocity) {
+			return true
+		}
+	}
+	if config.MinPercentGood > 0 && bin < len(ens.GoodEarthData.GoodEarth) {
+		for _, good := range ens.GoodEarthData.GoodEarth[bin] {
+			if percentGood(ens, good) < config.MinPercentGood {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// binValue will get the value of the beam in the bin.
+func binValue(values [][]float32, bin int, beam int) (float32, bool) {
+	if bin >= len(values) || beam >= len(values[bin]) {
+		return 0, false
+	}
+	return values[bin][beam], true
+}
+
+// percentGood will get the percent of the pings that are good.
+func percentGood(ens rti.Ensemble, goodPings int) float32 {
+	if ens.EnsembleData.ActualPingCount == 0 {
+		return 100
+	}
+	return float32(goodPings) * 100 / float32(ens.EnsembleData.ActualPingCount)
+}
+
+// markBadVelocity will mark the velocity of the beam in the bin as bad.
+func markBadVelocity(values [][]float32, bin int, beam int) {
+	if bin < len(values) && beam < len(values[bin]) {
+		values[bin][beam] = rtiBadVelocity
+	}
+}
+
+// markBadBin will mark all the velocities of the bin as bad.
+func markBadBin(values [][]float32, bin int) {
+	if bin < len(values) {
+		for beam := range values[bin] {
+			values[bin][beam] = rtiBadVelocity
+		}
+	}
+}
+
+// screenHandler will get and set the screening thresholds.  The thresholds
+// of an ADCP need the serial and config.  Without them the default
+// thresholds are used.
+func screenHandler(w http.ResponseWriter, r *http.Request) {
+	serialNum := r.FormValue("serial")
+	if serialNum != "" && r.FormValue("config") == "" {
+		http.Error(w, "config is required with serial", http.StatusBadRequest)
+		return
+	}
+	key := adcpKey(serialNum, r.FormValue("config"))
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, screens.config(key))
+	case http.MethodPost:
+		var config screenConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, "Bad thresholds: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if serialNum == "" {
+			screens.setDefaults(config)
+		} else {
+			screens.set(key, config)
+		}
+		writeJSON(w, config)
+	case http.MethodDelete:
+		screens.remove(key)
+		writeJSON(w, screens.config(key))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/ricorx7/go-rti"
 )
@@ -18,8 +22,13 @@ type adcpIO struct {
 	wsAdcpDisplayConn     map[*websocketAdcpDisplay]bool // Registered Adcp Display connections.
 	registerAdcpDisplay   chan *websocketAdcpDisplay     // Register requests from Adcp Display connections.
 	unregisterAdcpDisplay chan *websocketAdcpDisplay     // Unregister requests from Adcp Display connections.
+	adcpDisplayCmd        chan adcpDisplayCommand        // Commands from Adcp Display connections.
 	broadcast             chan []byte                    // Broadcast data
-	adcp                  map[string]*adcp               // List of ADCP data.  Key is the serial number of the ADCP
+	ensembles             chan rti.Ensemble              // Decoded ensembles
+	replay                chan rti.Ensemble              // Replayed ensembles
+	adcp                  map[string]*adcp               // List of ADCP data.  Key is the serial number and subsystem configuration of the ADCP
+	adcpMutex             sync.RWMutex                   // Lock the ADCP data for the HTTP handlers
+	transects             map[string]*dischargeTransect  // Discharge transects in progress.  Key is the serial number and subsystem configuration
 }
 
 // echo initializes the values.
@@ -32,15 +41,102 @@ var server = adcpIO{
 	websocketConn:         make(map[*websocketConn]bool),        // Websocket connection map
 	registerAdcpDisplay:   make(chan *websocketAdcpDisplay),     // Register a websocket connections
 	unregisterAdcpDisplay: make(chan *websocketAdcpDisplay),     // Unregister a websocket connection
+	adcpDisplayCmd:        make(chan adcpDisplayCommand),        // Adcp Display commands
 	wsAdcpDisplayConn:     make(map[*websocketAdcpDisplay]bool), // Websocket connection map
 	broadcast:             make(chan []byte),                    // Broadcast the data
+	ensembles:             make(chan rti.Ensemble),              // Decoded ensembles
+	replay:                make(chan rti.Ensemble),              // Replayed ensembles
 	adcp:                  make(map[string]*adcp),               // ADCP Data map
+	transects:             make(map[string]*dischargeTransect),  // Discharge transects
 }
 
 // adcp will store all the ADCP it is monitoring and also the last ensemble.
 type adcp struct {
-	serialNum string       // Serial number
-	lastEns   rti.Ensemble // Last ensemble
+	serialNum       string       // Serial number
+	subsystemConfig string       // Subsystem configuration
+	lastEns         rti.Ensemble // Last ensemble
+	lastSeen        time.Time    // Time the last ensemble was received
+	lastReplay      bool         // Flag if the last ensemble was replayed
+	ensCount        int          // Number of ensembles received
+
+	average *ensembleAverager // Average the ensembles
+	raw     displaySeries     // Display history of the ensembles
+	avg     displaySeries     // Display history of the averaged ensembles
+}
+
+// displaySeries will store the display history of a channel of an ADCP.
+type displaySeries struct {
+	heading timeSeriesData // Heading history
+	pitch   timeSeriesData // Pitch history
+	roll    timeSeriesData // Roll history
+
+	btRange    []timeSeriesData // Bottom track range history of each beam
+	btEarthVel []timeSeriesData // Bottom track East, North and Vertical velocity history
+	boatSpeed  timeSeriesData   // Boat speed history
+	boatDir    timeSeriesData   // Boat direction history
+
+	velBeam []velBeamEnsemble // Beam velocity of the last ensembles
+}
+
+// newAdcp will create the ADCP for the ensemble's serial number
+// and subsystem configuration.
+func newAdcp(ens rti.Ensemble) *adcp {
+	return &adcp{
+		serialNum:       ens.EnsembleData.SerialNumber.SerialNumber,       // Serial number
+		subsystemConfig: subsystemConfig(ens),                             // Subsystem configuration
+		lastEns:         ens,                                              // Last ensemble
+		average:         newEnsembleAverager(*averageCount, *averageTime), // Average the ensembles
+		raw:             newDisplaySeries(),                               // Display history of the ensembles
+		avg:             newDisplaySeries(),                               // Display history of the averaged ensembles
+	}
+}
+
+// newDisplaySeries will create the display history of a channel.
+func newDisplaySeries() displaySeries {
+	return displaySeries{
+		heading: timeSeriesData{
+			Color: "#ff7f0e", // Color of the plot
+			Key:   "Heading", // Key for the data
+			Area:  false,     // Flag for area plot
+		},
+		pitch: timeSeriesData{
+			Color: "#2ca02c", // Color of the plot
+			Key:   "Pitch",   // Key for the data
+			Area:  false,     // Flag for area plot
+		},
+		roll: timeSeriesData{
+			Color: "#7777ff", // Color of the plot
+			Key:   "Roll",    // Key for the data
+			Area:  false,     // Flag for area plot
+		},
+		btEarthVel: []timeSeriesData{
+			{Color: beamColor(0), Key: "East", Area: false},     // East velocity
+			{Color: beamColor(1), Key: "North", Area: false},    // North velocity
+			{Color: beamColor(2), Key: "Vertical", Area: false}, // Vertical velocity
+		},
+		boatSpeed: timeSeriesData{
+			Color: "#ff7f0e",    // Color of the plot
+			Key:   "Boat Speed", // Key for the data
+			Area:  false,        // Flag for area plot
+		},
+		boatDir: timeSeriesData{
+			Color: "#2ca02c",        // Color of the plot
+			Key:   "Boat Direction", // Key for the data
+			Area:  false,            // Flag for area plot
+		},
+	}
+}
+
+// adcpKey will create the key for the ADCP map from the serial number
+// and subsystem configuration.
+func adcpKey(serialNum string, subsystemConfig string) string {
+	return serialNum + "_" + subsystemConfig
+}
+
+// subsystemConfig will get the subsystem configuration of the ensemble.
+// This is the CEPO index of the configuration.
+func subsystemConfig(ens rti.Ensemble) string {
+	return strconv.Itoa(int(ens.EnsembleData.SubsystemConfig.CepoIndex))
 }
 
 // run the server process
@@ -49,6 +145,8 @@ type adcp struct {
 // and disconnects.
 func (server *adcpIO) run() {
 	log.Print("Echo Hub running")
+	flush := time.NewTicker(averageFlushInterval)
+	defer flush.Stop()
 	for {
 		select {
 
@@ -90,50 +188,110 @@ func (server *adcpIO) run() {
 				sendAdcpList()
 			}
 
+		// Command from Adcp Display websocket
+		case c := <-server.adcpDisplayCmd:
+			if _, ok := server.wsAdcpDisplayConn[c.conn]; ok {
+				c.conn.handleCommand(c.cmd)
+			}
+
 			// Broadcast message to all listeners
 		case m := <-server.broadcast:
 			//log.Printf("Message broadcast: %d", len(m))
 			//log.Print(string(m))
 
 			// Convert the message to JSON
-			var ens rti.Ensemble
-			err := json.Unmarshal(m, &ens)
+			ens, err := decodeJSONEnsemble(m)
 			if err != nil {
 				log.Print("Err converting JSON: ", err)
+				continue
 			}
 			//log.Printf("Ensemble Number: %d", ens.EnsembleData.EnsembleNumber)
 
-			// Process the ensemble
+			// Record the live ensembles
+			record.write(ens)
+
+			// Process the transformed and screened ensemble
 			// Pass the data to all the registered displays
-			processEnsemble(server, ens)
+			processEnsemble(server, displayEnsemble(ens), false)
+
+			// Decoded ensemble
+		case ens := <-server.ensembles:
+			// Record the live ensembles
+			record.write(ens)
+
+			// Process the transformed and screened ensemble
+			// Pass the data to all the registered displays
+			processEnsemble(server, displayEnsemble(ens), false)
+
+			// Replayed ensemble
+		case ens := <-server.replay:
+			// Process the transformed and screened ensemble
+			// Pass the data to all the registered displays
+			processEnsemble(server, displayEnsemble(ens), true)
+
+			// Send the partial averages of the ADCP that stopped sending
+		case now := <-flush.C:
+			flushAverages(server, now)
 		}
 	}
 }
 
+// displayEnsemble will transform and screen the ensemble for the displays.
+func displayEnsemble(ens rti.Ensemble) rti.Ensemble {
+	return screenEnsemble(transformEnsemble(ens))
+}
+
 // sendDataToDisplays will send data to all the registered displays.
 func sendDataToDisplays(b []byte) {
 	for c := range server.wsAdcpDisplayConn {
-		select {
-		case c.send <- b:
-		default:
-			log.Print("Close Adcp Display websocket send")
-			close(c.send)
-			delete(server.wsAdcpDisplayConn, c)
+		sendDataToDisplay(c, b)
+	}
+}
+
+// sendAdcpDataToDisplays will send the ADCP data to all the registered
+// displays subscribed to the data.  Average is set for the averaged data.
+func sendAdcpDataToDisplays(id string, serialNum string, subsystemConfig string, average bool, b []byte) {
+	for c := range server.wsAdcpDisplayConn {
+		if c.isSubscribed(id, serialNum, subsystemConfig, average) {
+			sendDataToDisplay(c, b)
 		}
 	}
 }
 
+// sendDataToDisplay will send the data to the display.
+// If the display is not keeping up, it is closed.
+func sendDataToDisplay(c *websocketAdcpDisplay, b []byte) {
+	select {
+	case c.send <- b:
+	default:
+		log.Print("Close Adcp Display websocket send")
+		close(c.send)
+		delete(server.wsAdcpDisplayConn, c)
+	}
+}
+
 // sendAdcpList will send list of ADCP connected
 // to all the registered displays.
 func sendAdcpList() {
 	var list []string
-	for key, _ := range server.adcp {
-		list = append(list, key)
+	configs := make(map[string][]string)
+	for _, val := range server.adcp {
+		if _, ok := configs[val.serialNum]; !ok {
+			list = append(list, val.serialNum)
+		}
+		configs[val.serialNum] = append(configs[val.serialNum], val.subsystemConfig)
+	}
+
+	// Keep the order the same every time
+	sort.Strings(list)
+	for _, c := range configs {
+		sort.Strings(c)
 	}
 
 	adcps := adcpList{
-		ID:            adcpListID, // ID
-		SerialNumList: list,       // List of serial numbers
+		ID:               adcpListID, // ID
+		SerialNumList:    list,       // List of serial numbers
+		SubsystemConfigs: configs,    // Subsystem configurations for each serial number
 	}
 
 	// Convert the JSON to byte array
@@ -0,0 +1,506 @@
+///
+/// Store the uploaded files.
+///
+/// The files are written to the upload folder with their metadata in
+/// the .meta folder.  If an S3-compatible store is configured, each
+/// file and its metadata are also stored in the bucket, and the upload
+/// folder is a cache of the bucket.
+///
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Folder in the upload folder and prefix in the bucket for the metadata.
+const storageMetaDir = ".meta"
+
+// errUploadTooLarge is returned when a file is larger than the limit.
+var errUploadTooLarge = errors.New("file is larger than the upload limit")
+
+// storedFile is the metadata of an uploaded file.
+type storedFile struct {
+	Name     string    // Stored file name
+	Original string    // File name given by the uploader
+	Size     int64     // File size in bytes
+	SHA256   string    // Hex SHA256 checksum of the file
+	Uploader string    // Who uploaded the file
+	Uploaded time.Time // Time the file was uploaded
+	Format   string    // Detected format, rti, pd0 or json.  Empty if unknown
+}
+
+// uploadStore will store the uploaded files.
+type uploadStore struct {
+	mutex    sync.Mutex             // Lock the files
+	dir      string                 // Upload folder
+	maxSize  int64                  // Largest file size.  0 for no limit
+	s3       *s3Client              // Bucket to store the files.  Nil for only the upload folder
+	files    map[string]*storedFile // Stored files.  Key is the file name
+	fetching map[string]*storeFetch // Files being copied from the bucket.  Key is the file name
+}
+
+// storeFetch is a file being copied from the bucket.  Every request
+// for the file waits for the same copy.
+type storeFetch struct {
+	done chan struct{} // Closed when the copy is finished
+	err  error         // Error copying the file
+}
+
+// uploads is the store of all the uploaded files.
+var uploads = &uploadStore{
+	files:    make(map[string]*storedFile), // Stored files
+	fetching: make(map[string]*storeFetch), // Files being copied from the bucket
+}
+
+// configure will set the upload folder, the largest file size and the bucket.
+func (s *uploadStore) configure(dir string, maxSize int64, s3 *s3Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.dir = dir
+	s.maxSize = maxSize
+	s.s3 = s3
+}
+
+// metaPath will get the path to the metadata of the file.
+func (s *uploadStore) metaPath(name string) string {
+	return filepath.Join(s.dir, storageMetaDir, name+".json")
+}
+
+// metaKey will get the bucket key of the metadata of the file.
+func metaKey(name string) string {
+	return storageMetaDir + "/" + name + ".json"
+}
+
+// load will read the metadata of all the stored files.  The metadata
+// in the bucket is copied to the upload folder.  Files in the upload
+// folder without metadata are added with the metadata that can be found
+// from the file.
+func (s *uploadStore) load() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(s.dir, storageMetaDir), 0755); err != nil {
+		return err
+	}
+
+	// Copy the metadata from the bucket
+	if s.s3 != nil {
+		keys, err := s.s3.list(storageMetaDir + "/")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			name := strings.TrimSuffix(strings.TrimPrefix(key, storageMetaDir+"/"), ".json")
+			if _, err := os.Stat(s.metaPath(name)); err == nil {
+				continue
+			}
+			if err := s.download(key, s.metaPath(name)); err != nil {
+				log.Println("Error copying upload metadata: " + err.Error())
+			}
+		}
+	}
+
+	// Metadata of each file
+	metas, err := ioutil.ReadDir(filepath.Join(s.dir, storageMetaDir))
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, storageMetaDir, meta.Name()))
+		if err != nil {
+			log.Println("Error reading upload metadata: " + err.Error())
+			continue
+		}
+		var file storedFile
+		if err := json.Unmarshal(data, &file); err != nil || file.Name == "" {
+			log.Println("Bad upload metadata: " + meta.Name())
+			continue
+		}
+		s.files[file.Name] = &file
+	}
+
+	// Files uploaded before the metadata was kept
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if _, ok := s.files[info.Name()]; ok {
+			continue
+		}
+		format, _ := detectDataFormat(filepath.Join(s.dir, info.Name()))
+		s.files[info.Name()] = &storedFile{
+			Name:     info.Name(),
+			Original: info.Name(),
+			Size:     info.Size(),
+			Uploaded: info.ModTime(),
+			Format:   format,
+		}
+	}
+
+	log.Printf("Upload store has %d files in %s", len(s.files), s.dir)
+	return nil
+}
+
+// cleanUploadName will remove any folders from the file name given by the
+// uploader and replace the characters that are not safe in a file name.
+func cleanUploadName(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = safeFileName(filepath.Base(name))
+
+	// Hidden files are not allowed
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "upload"
+	}
+	return name
+}
+
+// create will create the file with a name that is not used.
+// A number is added to the name until it is not used.
+func (s *uploadStore) create(original string) (*os.File, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := cleanUploadName(original)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, ok := s.files[name]; !ok {
+			f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				return f, name, nil
+			}
+			if !os.IsExist(err) {
+				return nil, "", err
+			}
+		}
+		name = stem + "_" + strconv.Itoa(i) + ext
+	}
+}
+
+// save will write the file to the store.  The file is streamed to the
+// upload folder and then copied to the bucket.  The file is removed if
+// it is larger than the limit or cannot be stored.
+func (s *uploadStore) save(original string, uploader string, r io.Reader) (storedFile, error) {
+	f, name, err := s.create(original)
+	if err != nil {
+		return storedFile{}, err
+	}
+	path := filepath.Join(s.dir, name)
+
+	// Write the file and find the checksum
+	hash := sha256.New()
+	reader := r
+	if s.maxSize > 0 {
+		reader = io.LimitReader(r, s.maxSize+1)
+	}
+	size, err := io.Copy(io.MultiWriter(f, hash), reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && s.maxSize > 0 && size > s.maxSize {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(path)
+		return storedFile{}, err
+	}
+
+	return s.finish(name, original, uploader, size, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// adopt will move a file already in the upload folder, such as an
+// assembled chunked upload, into the store.  The size and checksum
+// are already found, so the file is not read again.
+func (s *uploadStore) adopt(original string, uploader string, src string, size int64, sum string) (storedFile, error) {
+	f, name, err := s.create(original)
+	if err != nil {
+		return storedFile{}, err
+	}
+	f.Close()
+	path := filepath.Join(s.dir, name)
+
+	if err := os.Rename(src, path); err != nil {
+		os.Remove(path)
+		return storedFile{}, err
+	}
+	return s.finish(name, original, uploader, size, sum)
+}
+
+// fileChecksum will get the size and hex SHA256 checksum of the file.
+func fileChecksum(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// finish will write the metadata of the file in the upload folder and
+// copy the file to the bucket.  The file is removed if it cannot be stored.
+func (s *uploadStore) finish(name string, original string, uploader string, size int64, sum string) (storedFile, error) {
+	path := filepath.Join(s.dir, name)
+	format, _ := detectDataFormat(path)
+	file := storedFile{
+		Name:     name,
+		Original: original,
+		Size:     size,
+		SHA256:   sum,
+		Uploader: uploader,
+		Uploaded: time.Now(),
+		Format:   format,
+	}
+
+	// Store the metadata and copy to the bucket
+	if err := s.writeMeta(file); err != nil {
+		os.Remove(path)
+		return storedFile{}, err
+	}
+	if s.s3 != nil {
+		if err := s.upload(file); err != nil {
+			os.Remove(path)
+			os.Remove(s.metaPath(name))
+			return storedFile{}, err
+		}
+	}
+
+	s.mutex.Lock()
+	s.files[name] = &file
+	s.mutex.Unlock()
+
+	log.Printf("Stored upload %s from %s, %d bytes", name, uploader, size)
+	return file, nil
+}
+
+// writeMeta will write the metadata of the file.
+func (s *uploadStore) writeMeta(file storedFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metaPath(file.Name), data, 0644)
+}
+
+// upload will copy the file and its metadata to the bucket.
+func (s *uploadStore) upload(file storedFile) error {
+	f, err := os.Open(filepath.Join(s.dir, file.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.s3.put(file.Name, f, file.Size, file.SHA256); err != nil {
+		return err
+	}
+
+	meta, err := ioutil.ReadFile(s.metaPath(file.Name))
+	if err != nil {
+		return err
+	}
+	return s.s3.put(metaKey(file.Name), bytes.NewReader(meta), int64(len(meta)), sha256Hex(meta))
+}
+
+// download will copy the object in the bucket to the path.
+func (s *uploadStore) download(key string, path string) error {
+	obj, err := s.s3.get(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	// Write to a temporary file so a partial file is never used
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, obj)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// list will get the metadata of all the stored files, newest first.
+func (s *uploadStore) list() []storedFile {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files := []storedFile{}
+	for _, file := range s.files {
+		files = append(files, *file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Uploaded.After(files[j].Uploaded) })
+	return files
+}
+
+// info will get the metadata of the stored file.
+func (s *uploadStore) info(name string) (storedFile, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, ok := s.files[filepath.Base(name)]
+	if !ok {
+		return storedFile{}, false
+	}
+	return *file, true
+}
+
+// path will get the path to the stored file in the upload folder.
+// The file is copied from the bucket if it is not in the upload folder.
+// The store is not locked during the copy, and requests for a file
+// being copied wait for that copy.
+func (s *uploadStore) path(name string) (string, error) {
+	s.mutex.Lock()
+	name = filepath.Base(name)
+	if _, ok := s.files[name]; !ok {
+		s.mutex.Unlock()
+		return "", errors.New("file not found: " + name)
+	}
+
+	path := filepath.Join(s.dir, name)
+	if _, err := os.Stat(path); err == nil || s.s3 == nil {
+		s.mutex.Unlock()
+		return path, err
+	}
+
+	// Wait for the copy in progress
+	if fetch, ok := s.fetching[name]; ok {
+		s.mutex.Unlock()
+		<-fetch.done
+		if fetch.err != nil {
+			return "", fetch.err
+		}
+		return path, nil
+	}
+	fetch := &storeFetch{done: make(chan struct{})}
+	s.fetching[name] = fetch
+	s.mutex.Unlock()
+
+	fetch.err = s.download(name, path)
+
+	s.mutex.Lock()
+	delete(s.fetching, name)
+	s.mutex.Unlock()
+	close(fetch.done)
+
+	if fetch.err != nil {
+		return "", fetch.err
+	}
+	return path, nil
+}
+
+// remove will delete the stored file and its metadata.
+func (s *uploadStore) remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name = filepath.Base(name)
+	if _, ok := s.files[name]; !ok {
+		return errors.New("file not found: " + name)
+	}
+
+	if s.s3 != nil {
+		if err := s.s3.remove(name); err != nil {
+			return err
+		}
+		if err := s.s3.remove(metaKey(name)); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.metaPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.files, name)
+
+	log.Printf("Deleted upload %s", name)
+	return nil
+}
+
+// storageHandler will list, download and delete the uploaded files.
+//
+//	/uploads/list                 List the uploaded files
+//	/uploads/info?name=file       Get the metadata of a file
+//	/uploads/download?name=file   Download a file
+//	/uploads/delete?name=file     Delete a file.  Must be a POST or DELETE
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	switch strings.TrimPrefix(r.URL.Path, "/uploads/") {
+	case "list":
+		writeJSON(w, uploads.list())
+	case "info":
+		file, ok := uploads.info(name)
+		if !ok {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, file)
+	case "download":
+		file, ok := uploads.info(name)
+		if !ok {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		path, err := uploads.path(file.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename="+file.Name)
+		if file.SHA256 != "" {
+			w.Header().Set("X-Checksum-Sha256", file.SHA256)
+		}
+		http.ServeFile(w, r, path)
+	case "delete":
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Delete must be a POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := uploads.info(name); !ok {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err := uploads.remove(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ingest.remove(filepath.Base(name))
+		writeJSON(w, uploads.list())
+	default:
+		http.NotFound(w, r)
+	}
+}
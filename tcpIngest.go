@@ -0,0 +1,157 @@
+///
+/// TCP connection to receive the RTI binary or PD0 stream
+/// from a serial-to-Ethernet bridge.
+///
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// Time to wait before reconnecting to a bridge the first time.
+	tcpMinBackoff = 1 * time.Second
+
+	// Longest time to wait before reconnecting to a bridge.
+	tcpMaxBackoff = 60 * time.Second
+
+	// Time to wait after the first temporary error accepting a connection.
+	tcpAcceptMinBackoff = 5 * time.Millisecond
+
+	// Longest time to wait after temporary errors accepting connections.
+	tcpAcceptMaxBackoff = 1 * time.Second
+
+	// Period of the TCP keepalive probes to find a lost bridge
+	// when the ADCP is not sending.
+	tcpKeepAlive = 30 * time.Second
+
+	// Size of the buffer to read from the TCP connection.
+	tcpReadSize = 1024 * 4
+)
+
+// startTCPIngest will start listening for ADCP connections on listenAddr
+// and connect to all the bridges in the comma separated dialAddrs.
+// Empty values are ignored.  A connection without data for the idle time
+// is dropped.  An idle time of 0 only drops the connection when the
+// keepalive finds the bridge is lost.
+func startTCPIngest(listenAddr string, dialAddrs string, idle time.Duration) {
+	if listenAddr != "" {
+		go listenTCP(listenAddr, idle)
+	}
+
+	for _, addr := range strings.Split(dialAddrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			go dialTCP(addr, idle)
+		}
+	}
+}
+
+// listenTCP will accept TCP connections from the ADCPs
+// and read the data from each connection.  Temporary errors, such as
+// running out of file descriptors, are retried with a backoff.  Other
+// errors stop the listener.
+func listenTCP(addr string, idle time.Duration) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Println("Error listening for TCP ingest: " + err.Error())
+		return
+	}
+	defer ln.Close()
+
+	log.Printf("TCP ingest listening on %s", addr)
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				log.Println("TCP ingest stopped listening: " + err.Error())
+				return
+			}
+
+			// Wait longer after each temporary error
+			if backoff == 0 {
+				backoff = tcpAcceptMinBackoff
+			} else if backoff *= 2; backoff > tcpAcceptMaxBackoff {
+				backoff = tcpAcceptMaxBackoff
+			}
+			log.Printf("Error accepting TCP ingest connection: %v.  Retry in %s", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		go func() {
+			log.Printf("TCP ingest connection from %s", conn.RemoteAddr())
+			if err := readTCP(conn, idle); err != nil {
+				log.Printf("TCP ingest connection %s closed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// dialTCP will connect to the bridge and read the data.
+// If the connection drops, it will reconnect with a backoff.
+func dialTCP(addr string, idle time.Duration) {
+	backoff := tcpMinBackoff
+	for {
+		log.Printf("TCP ingest connecting to %s", addr)
+		conn, err := net.DialTimeout("tcp", addr, writeWait)
+		if err == nil {
+			// Connected, so reset the backoff
+			backoff = tcpMinBackoff
+			err = readTCP(conn, idle)
+		}
+		log.Printf("TCP ingest connection to %s lost: %v.  Reconnect in %s", addr, err, backoff)
+
+		// Wait before reconnecting
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > tcpMaxBackoff {
+			backoff = tcpMaxBackoff
+		}
+	}
+}
+
+// readTCP will read the RTI binary or PD0 stream from the connection
+// and pass the decoded ensembles to the server.
+// It will return when the connection is closed or has no data
+// for the idle time.  An idle time of 0 is no limit.
+func readTCP(conn net.Conn, idle time.Duration) error {
+	defer conn.Close()
+
+	// Find a lost bridge even if the ADCP pings slowly
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(tcpKeepAlive)
+	}
+
+	var codec ensembleCodec
+	buf := make([]byte, tcpReadSize)
+	for {
+		// Drop the connection if the ADCP stops sending data
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
+
+		n, err := conn.Read(buf)
+		for _, ens := range codec.add(buf[:n]) {
+			server.ensembles <- ens
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
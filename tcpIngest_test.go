@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadTCPIdle(t *testing.T) {
+	// The connection is dropped after the idle time without data
+	conn, bridge := net.Pipe()
+	defer bridge.Close()
+	done := make(chan error, 1)
+	go func() { done <- readTCP(conn, 20*time.Millisecond) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("no error for an idle connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not dropped")
+	}
+
+	// Without an idle time the connection is kept until it is closed
+	conn, bridge = net.Pipe()
+	go func() { done <- readTCP(conn, 0) }()
+	select {
+	case err := <-done:
+		t.Fatalf("connection dropped without an idle time: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	bridge.Close()
+	if err := <-done; err != nil {
+		t.Errorf("closed connection error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,252 @@
+///
+/// Transform the velocities between the beam, instrument, earth
+/// and ship coordinates.
+///
+/// The beam velocities of a 4 beam Janus ADCP are transformed to
+/// instrument coordinates with the beam angle.  Beams 0 and 1 are the
+/// X pair and beams 2 and 3 are the Y pair.  If one beam is bad, a 3
+/// beam solution is used.  A 5th vertical beam is not used.
+///
+/// The instrument velocities are rotated to earth coordinates with
+/// the heading, pitch and roll and the magnetic declination.  The ship
+/// coordinates are the instrument velocities corrected for tilt and
+/// rotated by the alignment of the ADCP to the ship.
+///
+
+package main
+
+import (
+	"math"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// transformConfig is the configuration of the coordinate transforms.
+type transformConfig struct {
+	beamAngle   float64 // Angle of the beams from the ADCP axis in degrees
+	declination float64 // Magnetic declination in degrees added to the heading
+	shipOffset  float64 // Angle of the ADCP X axis from the ship's bow in degrees
+	binMapping  bool    // Map the bins of each beam to the same depth when tilted
+}
+
+// transform is the configuration of the coordinate transforms.
+var transform = transformConfig{
+	beamAngle: 20, // RTI beam angle
+}
+
+// configure will set the configuration of the coordinate transforms.
+func (t *transformConfig) configure(beamAngle float64, declination float64, shipOffset float64, binMapping bool) {
+	t.beamAngle = beamAngle
+	t.declination = declination
+	t.shipOffset = shipOffset
+	t.binMapping = binMapping
+}
+
+// transformEnsemble will add the instrument and earth velocities of the
+// ensemble from the beam velocities if the ADCP did not output them.
+// This is done for the profile and the bottom track.
+func transformEnsemble(ens rti.Ensemble) rti.Ensemble {
+	return transform.fill(ens)
+}
+
+// fill will add the missing instrument and earth velocities.
+func (t transformConfig) fill(ens rti.Ensemble) rti.Ensemble {
+	// Profile
+	if len(ens.BeamVelocityData.Velocity) > 0 {
+		numBins := len(ens.BeamVelocityData.Velocity)
+		if len(ens.InstrumentVelocityData.Velocity) == 0 {
+			if vel := t.instrumentVelocity(ens); vel != nil {
+				ens.InstrumentVelocityData.Base = rtiBase(rtiDataTypeFloat, numBins, 4, rtiInstrumentVelocityID)
+				ens.InstrumentVelocityData.Velocity = vel
+			}
+		}
+		if len(ens.EarthVelocityData.Velocity) == 0 && len(ens.InstrumentVelocityData.Velocity) > 0 {
+			ens.EarthVelocityData.Base = rtiBase(rtiDataTypeFloat, numBins, 4, rtiEarthVelocityID)
+			ens.EarthVelocityData.Velocity = t.earthVelocity(ens.InstrumentVelocityData.Velocity, ens.AncillaryData.Heading, ens.AncillaryData.Pitch, ens.AncillaryData.Roll)
+			ens.EarthVelocityData.Vectors = earthVelocityVectors(ens.EarthVelocityData.Velocity)
+		}
+	}
+
+	// Bottom track
+	bt := &ens.BottomTrackData
+	if len(bt.BeamVelocity) >= 4 {
+		if len(bt.InstrumentVelocity) == 0 {
+			bt.InstrumentVelocity = t.beamToInstrument(bt.BeamVelocity)
+		}
+		if len(bt.EarthVelocity) == 0 {
+			bt.EarthVelocity = t.earthVelocity([][]float32{bt.InstrumentVelocity}, bt.Heading, bt.Pitch, bt.Roll)[0]
+		}
+	}
+	return ens
+}
+
+// instrumentVelocity will transform the beam velocities of the ensemble to
+// instrument coordinates.  The bins are mapped for tilt if selected.  If there
+// are not 4 beams, nil is returned.
+func (t transformConfig) instrumentVelocity(ens rti.Ensemble) [][]float32 {
+	beamVel := ens.BeamVelocityData.Velocity
+	for bin := range beamVel {
+		if len(beamVel[bin]) < 4 {
+			return nil
+		}
+	}
+	if t.binMapping {
+		beamVel = t.mapBins(ens)
+	}
+
+	vel := make([][]float32, len(beamVel))
+	for bin := range beamVel {
+		vel[bin] = t.beamToInstrument(beamVel[bin])
+	}
+	return vel
+}
+
+// beamToInstrument will transform the velocity of the 4 beams to the
+// X, Y, Z and error velocity.  If one beam is bad, it is replaced so the
+// error velocity is 0.  If more beams are bad, the velocities are bad.
+func (t transformConfig) beamToInstrument(beams []float32) []float32 {
+	bad := []float32{rtiBadVelocity, rtiBadVelocity, rtiBadVelocity, rtiBadVelocity}
+	if len(beams) < 4 {
+		return bad
+	}
+
+	b := make([]float64, 4)
+	badBeam := -1
+	for beam := 0; beam < 4; beam++ {
+		if beams[beam] == rtiBadVelocity {
+			if badBeam >= 0 {
+				return bad
+			}
+			badBeam = beam
+			continue
+		}
+		b[beam] = float64(beams[beam])
+	}
+
+	// 3 beam solution.  The error velocity is b0 + b1 - b2 - b3.
+	switch badBeam {
+	case 0:
+		b[0] = b[2] + b[3] - b[1]
+	case 1:
+		b[1] = b[2] + b[3] - b[0]
+	case 2:
+		b[2] = b[0] + b[1] - b[3]
+	case 3:
+		b[3] = b[0] + b[1] - b[2]
+	}
+
+	angle := t.beamAngle * math.Pi / 180
+	a := 1 / (2 * math.Sin(angle))
+	c := 1 / (4 * math.Cos(angle))
+	d := a / math.Sqrt2
+
+	x := a * (b[0] - b[1])
+	y := a * (b[3] - b[2])
+	z := c * (b[0] + b[1] + b[2] + b[3])
+	e := d * (b[0] + b[1] - b[2] - b[3])
+	if badBeam >= 0 {
+		e = rtiBadVelocity
+	}
+	return []float32{float32(x), float32(y), float32(z), float32(e)}
+}
+
+// rotate will rotate the X, Y and Z velocity by the heading, pitch and roll
+// in degrees.  The error velocity is not changed.
+func rotate(vel []float32, heading float64, pitch float64, roll float64) []float32 {
+	if len(vel) < 3 || vel[0] == rtiBadVelocity || vel[1] == rtiBadVelocity || vel[2] == rtiBadVelocity {
+		return []float32{rtiBadVelocity, rtiBadVelocity, rtiBadVelocity, rtiBadVelocity}
+	}
+
+	ch, sh := math.Cos(heading*math.Pi/180), math.Sin(heading*math.Pi/180)
+	cp, sp := math.Cos(pitch*math.Pi/180), math.Sin(pitch*math.Pi/180)
+	cr, sr := math.Cos(roll*math.Pi/180), math.Sin(roll*math.Pi/180)
+	x, y, z := float64(vel[0]), float64(vel[1]), float64(vel[2])
+
+	east := x*(ch*cr+sh*sp*sr) + y*(sh*cp) + z*(ch*sr-sh*sp*cr)
+	north := x*(-sh*cr+ch*sp*sr) + y*(ch*cp) + z*(-sh*sr-ch*sp*cr)
+	up := x*(-cp*sr) + y*sp + z*(cp*cr)
+
+	errVel := float32(rtiBadVelocity)
+	if len(vel) > 3 {
+		errVel = vel[3]
+	}
+	return []float32{float32(east), float32(north), float32(up), errVel}
+}
+
+// earthVelocity will rotate the instrument velocities to East, North,
+// Vertical and error velocity.  The declination is added to the heading.
+func (t transformConfig) earthVelocity(instVel [][]float32, heading float32, pitch float32, roll float32) [][]float32 {
+	vel := make([][]float32, len(instVel))
+	for bin := range instVel {
+		vel[bin] = rotate(instVel[bin], float64(heading)+t.declination, float64(pitch), float64(roll))
+	}
+	return vel
+}
+
+// shipVelocity will get the ship velocities of the ensemble.  These are
+// Starboard, Forward, Up and error velocity.  If there are no instrument
+// velocities, nil is returned.
+func (t transformConfig) shipVelocity(ens rti.Ensemble) [][]float32 {
+	ens = t.fill(ens)
+	instVel := ens.InstrumentVelocityData.Velocity
+	if len(instVel) == 0 {
+		return nil
+	}
+
+	vel := make([][]float32, len(instVel))
+	for bin := range instVel {
+		vel[bin] = rotate(instVel[bin], t.shipOffset, float64(ens.AncillaryData.Pitch), float64(ens.AncillaryData.Roll))
+	}
+	return vel
+}
+
+// beamVertical will get the vertical part of each beam's direction when
+// the ADCP is tilted, relative to when it is level.
+func (t transformConfig) beamVertical(pitch float64, roll float64) []float64 {
+	angle := t.beamAngle * math.Pi / 180
+	s, c := math.Sin(angle), math.Cos(angle)
+
+	// Direction of each beam in instrument coordinates
+	beams := [][]float32{
+		{float32(s), 0, float32(c)},
+		{float32(-s), 0, float32(c)},
+		{0, float32(-s), float32(c)},
+		{0, float32(s), float32(c)},
+	}
+
+	vertical := make([]float64, len(beams))
+	for beam, dir := range beams {
+		vertical[beam] = math.Abs(float64(rotate(dir, 0, pitch, roll)[2])) / c
+	}
+	return vertical
+}
+
+// mapBins will get the beam velocities of the bins at the same depth
+// in each beam.  With tilt, the bin of a beam nearest the depth of the
+// level bin is used.  Bins beyond the profile are bad.
+func (t transformConfig) mapBins(ens rti.Ensemble) [][]float32 {
+	beamVel := ens.BeamVelocityData.Velocity
+	anc := ens.AncillaryData
+	if anc.BinSize <= 0 || (anc.Pitch == 0 && anc.Roll == 0) {
+		return beamVel
+	}
+
+	vertical := t.beamVertical(float64(anc.Pitch), float64(anc.Roll))
+	mapped := make([][]float32, len(beamVel))
+	for bin := range beamVel {
+		mapped[bin] = make([]float32, len(beamVel[bin]))
+		copy(mapped[bin], beamVel[bin])
+
+		depth := float64(binDepth(ens, bin))
+		for beam := 0; beam < 4; beam++ {
+			// Bin of the beam at the depth
+			src := int(math.Floor((depth/vertical[beam]-float64(anc.FirstBinRange))/float64(anc.BinSize) + 0.5))
+			if src < 0 || src >= len(beamVel) || beam >= len(beamVel[src]) {
+				mapped[bin][beam] = rtiBadVelocity
+				continue
+			}
+			mapped[bin][beam] = beamVel[src][beam]
+		}
+	}
+	return mapped
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// transformTestBeams will get the beam velocities of the water velocity in
+// instrument coordinates.  Each beam measures the velocity along its
+// direction.
+func transformTestBeams(config transformConfig, x float64, y float64, z float64) []float32 {
+	angle := config.beamAngle * math.Pi / 180
+	s, c := math.Sin(angle), math.Cos(angle)
+	return []float32{
+		float32(x*s + z*c),
+		float32(-x*s + z*c),
+		float32(-y*s + z*c),
+		float32(y*s + z*c),
+	}
+}
+
+func TestBeamToInstrument(t *testing.T) {
+	config := transformConfig{beamAngle: 20}
+	beams := transformTestBeams(config, 0.3, -0.2, 0.05)
+
+	vel := config.beamToInstrument(beams)
+	assertFloat(t, "X", vel[0], 0.3)
+	assertFloat(t, "Y", vel[1], -0.2)
+	assertFloat(t, "Z", vel[2], 0.05)
+	assertFloat(t, "Error", vel[3], 0)
+
+	// Velocity that is not the same in all the beams is error velocity
+	noisy := append([]float32(nil), beams...)
+	noisy[0] += 0.01
+	noisy[1] += 0.01
+	if vel := config.beamToInstrument(noisy); math.Abs(float64(vel[3])) < 0.001 {
+		t.Errorf("error velocity = %v, want not 0", vel[3])
+	}
+}
+
+func TestBeamToInstrumentThreeBeams(t *testing.T) {
+	config := transformConfig{beamAngle: 20}
+	beams := transformTestBeams(config, 0.3, -0.2, 0.05)
+
+	// Any one bad beam gives the same velocity without an error velocity
+	for bad := 0; bad < 4; bad++ {
+		three := append([]float32(nil), beams...)
+		three[bad] = rtiBadVelocity
+		vel := config.beamToInstrument(three)
+		assertFloat(t, "3 beam X", vel[0], 0.3)
+		assertFloat(t, "3 beam Y", vel[1], -0.2)
+		assertFloat(t, "3 beam Z", vel[2], 0.05)
+		if vel[3] != rtiBadVelocity {
+			t.Errorf("bad beam %d: error velocity = %v, want bad", bad, vel[3])
+		}
+	}
+
+	// Two bad beams are all bad
+	two := append([]float32(nil), beams...)
+	two[0] = rtiBadVelocity
+	two[3] = rtiBadVelocity
+	for i, val := range config.beamToInstrument(two) {
+		if val != rtiBadVelocity {
+			t.Errorf("2 bad beams: velocity %d = %v, want bad", i, val)
+		}
+	}
+}
+
+func TestEarthVelocity(t *testing.T) {
+	// Level with the Y axis to the North East and 10 degrees declination
+	config := transformConfig{beamAngle: 20, declination: 10}
+	vel := config.earthVelocity([][]float32{{0, 1, 0, 0.01}}, 35, 0, 0)[0]
+	assertFloat(t, "East", vel[0], float32(math.Sin(45*math.Pi/180)))
+	assertFloat(t, "North", vel[1], float32(math.Cos(45*math.Pi/180)))
+	assertFloat(t, "Up", vel[2], 0)
+	assertFloat(t, "Error", vel[3], 0.01)
+
+	// Tilt only changes the direction, not the speed
+	tilted := config.earthVelocity([][]float32{{0.3, -0.2, 0.05, 0}}, 120, 5, -8)[0]
+	speed := math.Sqrt(0.3*0.3 + 0.2*0.2 + 0.05*0.05)
+	got := math.Sqrt(float64(tilted[0]*tilted[0] + tilted[1]*tilted[1] + tilted[2]*tilted[2]))
+	if math.Abs(got-speed) > 1e-4 {
+		t.Errorf("tilted speed = %v, want %v", got, speed)
+	}
+
+	// Pitch up with the Y axis North tilts a forward velocity up
+	up := config.earthVelocity([][]float32{{0, 1, 0, 0}}, -10, 30, 0)[0]
+	assertFloat(t, "Pitch North", up[1], float32(math.Cos(30*math.Pi/180)))
+	assertFloat(t, "Pitch Up", up[2], 0.5)
+}
+
+func TestTransformFill(t *testing.T) {
+	config := transformConfig{beamAngle: 20}
+	var ens rti.Ensemble
+	ens.AncillaryData.Heading = 90
+	ens.BeamVelocityData.Velocity = [][]float32{
+		transformTestBeams(config, 0, 1, 0),
+		transformTestBeams(config, 0, 2, 0),
+	}
+
+	ens = config.fill(ens)
+	if len(ens.InstrumentVelocityData.Velocity) != 2 || len(ens.EarthVelocityData.Velocity) != 2 {
+		t.Fatalf("instrument and earth bins = %d %d, want 2 2", len(ens.InstrumentVelocityData.Velocity), len(ens.EarthVelocityData.Velocity))
+	}
+	for bin, speed := range []float32{1, 2} {
+		assertFloat(t, "East", ens.EarthVelocityData.Velocity[bin][0], speed)
+		assertFloat(t, "North", ens.EarthVelocityData.Velocity[bin][1], 0)
+	}
+}
+
+func TestMapBins(t *testing.T) {
+	const numBins = 30
+	config := transformConfig{beamAngle: 20, binMapping: true}
+
+	// Each beam velocity is the depth the beam measured in the bin
+	var ens rti.Ensemble
+	ens.AncillaryData.FirstBinRange = 1
+	ens.AncillaryData.BinSize = 0.5
+	ens.AncillaryData.Pitch = 4
+	ens.AncillaryData.Roll = 15
+	vertical := config.beamVertical(4, 15)
+	ens.BeamVelocityData.Velocity = make([][]float32, numBins)
+	for bin := range ens.BeamVelocityData.Velocity {
+		ens.BeamVelocityData.Velocity[bin] = make([]float32, 4)
+		for beam := range vertical {
+			ens.BeamVelocityData.Velocity[bin][beam] = binDepth(ens, bin) * float32(vertical[beam])
+		}
+	}
+
+	// The mapped bins are the nearest to the depth of the level bin
+	moved := false
+	mapped := config.mapBins(ens)
+	for bin := range mapped {
+		depth := float64(binDepth(ens, bin))
+		for beam, val := range mapped[bin] {
+			if val == rtiBadVelocity {
+				if depth/vertical[beam] < float64(binDepth(ens, numBins-1)) {
+					t.Errorf("bin %d beam %d is bad inside the profile", bin, beam)
+				}
+				continue
+			}
+			if diff := math.Abs(float64(val) - depth); diff > float64(ens.AncillaryData.BinSize)*vertical[beam]/2+1e-4 {
+				t.Errorf("bin %d beam %d depth = %v, want %v", bin, beam, val, depth)
+			}
+			if val != ens.BeamVelocityData.Velocity[bin][beam] {
+				moved = true
+			}
+		}
+	}
+	if !moved {
+		t.Error("no bins were mapped")
+	}
+
+	// Level bins are not mapped
+	ens.AncillaryData.Pitch = 0
+	ens.AncillaryData.Roll = 0
+	for bin, beams := range config.mapBins(ens) {
+		for beam, val := range beams {
+			if val != ens.BeamVelocityData.Velocity[bin][beam] {
+				t.Errorf("level bin %d beam %d was mapped", bin, beam)
+			}
+		}
+	}
+}
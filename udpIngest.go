@@ -0,0 +1,256 @@
+///
+/// UDP socket to receive the ensembles broadcast
+/// on the ship LAN.
+///
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+const (
+	// Largest UDP datagram.
+	udpReadSize = 1024 * 64
+
+	// Number of ensembles to hold while waiting for
+	// a missing ensemble before it is considered dropped.
+	udpReorderWindow = 5
+
+	// Longest time to hold an ensemble while waiting for
+	// a missing ensemble before it is considered dropped.
+	udpReorderWait = 2 * time.Second
+
+	// Ensemble number jump back that is an ADCP restarting its
+	// ensemble numbers instead of a late ensemble.
+	udpRestartJump = 1000
+)
+
+// Formats of the datagrams from a sender.
+const (
+	udpFormatUnknown = iota // No datagram decoded yet
+	udpFormatJSON           // Each datagram is a JSON ensemble
+	udpFormatBinary         // Datagrams are an RTI binary or PD0 stream
+)
+
+// udpSource is the datagrams from a sender.  The format is decided by
+// the first datagram, because a datagram that continues a binary
+// ensemble can start with any byte.
+type udpSource struct {
+	format int           // Format of the datagrams
+	codec  ensembleCodec // RTI binary or PD0 stream
+}
+
+// add will decode the ensembles in the datagram.
+func (s *udpSource) add(datagram []byte) []rti.Ensemble {
+	if s.format != udpFormatBinary && isJSONData(datagram) {
+		ens, err := decodeJSONEnsemble(datagram)
+		if err == nil {
+			s.format = udpFormatJSON
+			return []rti.Ensemble{ens}
+		}
+		if s.format == udpFormatJSON {
+			log.Print("Err converting JSON: ", err)
+			return nil
+		}
+	}
+	if s.format == udpFormatJSON {
+		log.Print("Datagram is not a JSON ensemble")
+		return nil
+	}
+	s.format = udpFormatBinary
+	return s.codec.add(datagram)
+}
+
+// udpPending is an ensemble waiting for a missing ensemble.
+type udpPending struct {
+	ens     rti.Ensemble // Ensemble
+	arrived time.Time    // Time the ensemble was received
+}
+
+// udpReorder will put the ensembles from an ADCP back in order
+// using the ensemble number.  Duplicate and late ensembles are dropped.
+type udpReorder struct {
+	started    bool                  // Flag if an ensemble has been received
+	lastEnsNum uint32                // Last ensemble number passed on
+	pending    map[uint32]udpPending // Ensembles waiting for a missing ensemble
+}
+
+// restarted will check if the ensemble number is from the ADCP
+// restarting its ensemble numbers instead of a late ensemble.
+func (r *udpReorder) restarted(ensNum uint32) bool {
+	if ensNum >= r.lastEnsNum {
+		return false
+	}
+	back := r.lastEnsNum - ensNum
+	return back > udpRestartJump || (ensNum <= udpReorderWindow && back > udpReorderWindow)
+}
+
+// add will add the ensemble received at the given time and return
+// all the ensembles that are now in order.
+func (r *udpReorder) add(ens rti.Ensemble, now time.Time) []rti.Ensemble {
+	ensNum := uint32(ens.EnsembleData.EnsembleNumber)
+
+	if !r.started || r.restarted(ensNum) {
+		// First ensemble or the ADCP restarted its ensemble numbers
+		if r.started {
+			log.Printf("UDP ingest ensemble numbers restarted at %d", ensNum)
+		}
+		r.started = true
+		r.lastEnsNum = ensNum - 1
+		r.pending = make(map[uint32]udpPending)
+	} else if ensNum <= r.lastEnsNum {
+		// Duplicate or too late
+		return nil
+	}
+	r.pending[ensNum] = udpPending{ens: ens, arrived: now}
+
+	ensembles := r.next()
+	for len(r.pending) > udpReorderWindow {
+		// The missing ensemble was dropped
+		ensembles = append(ensembles, r.skip()...)
+	}
+	return ensembles
+}
+
+// flush will pass on the ensembles that waited too long for a
+// missing ensemble, so the ensembles are not held when the
+// ensembles are slow or stop.
+func (r *udpReorder) flush(now time.Time) []rti.Ensemble {
+	var ensembles []rti.Ensemble
+	for len(r.pending) > 0 {
+		oldest := r.oldest()
+		if now.Sub(r.pending[oldest].arrived) < udpReorderWait {
+			break
+		}
+		ensembles = append(ensembles, r.skip()...)
+	}
+	return ensembles
+}
+
+// next will pass on all the pending ensembles that are in order.
+func (r *udpReorder) next() []rti.Ensemble {
+	var ensembles []rti.Ensemble
+	for {
+		next, ok := r.pending[r.lastEnsNum+1]
+		if !ok {
+			return ensembles
+		}
+		delete(r.pending, r.lastEnsNum+1)
+		r.lastEnsNum++
+		ensembles = append(ensembles, next.ens)
+	}
+}
+
+// oldest will get the lowest pending ensemble number.
+func (r *udpReorder) oldest() uint32 {
+	first := true
+	var oldest uint32
+	for num := range r.pending {
+		if first || num < oldest {
+			oldest = num
+			first = false
+		}
+	}
+	return oldest
+}
+
+// skip will give up on the missing ensembles and pass on the
+// pending ensembles from the oldest.
+func (r *udpReorder) skip() []rti.Ensemble {
+	oldest := r.oldest()
+	log.Printf("UDP ingest dropped ensembles %d to %d", r.lastEnsNum+1, oldest-1)
+	r.lastEnsNum = oldest - 1
+	return r.next()
+}
+
+// startUDPIngest will listen for ensembles on the UDP address.
+// If group is set, the multicast group is joined.
+// An empty address will not start the UDP ingest.
+func startUDPIngest(addr string, group string) {
+	if addr == "" {
+		return
+	}
+
+	go func() {
+		if err := listenUDP(addr, group); err != nil {
+			log.Println("Error listening for UDP ingest: " + err.Error())
+		}
+	}()
+}
+
+// listenUDP will read the ensembles from the UDP datagrams
+// and pass them to the server.
+func listenUDP(addr string, group string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	if group != "" {
+		// Join the multicast group on the port
+		udpAddr.IP = net.ParseIP(group)
+		conn, err = net.ListenMulticastUDP("udp", nil, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp", udpAddr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Printf("UDP ingest listening on %s", udpAddr)
+
+	sources := make(map[string]*udpSource)  // Datagrams of each sender
+	reorder := make(map[string]*udpReorder) // Reorder the ensembles for each ADCP and subsystem
+	buf := make([]byte, udpReadSize)
+	for {
+		// Wake to flush the held ensembles if the datagrams stop
+		if err := conn.SetReadDeadline(time.Now().Add(udpReorderWait)); err != nil {
+			return err
+		}
+		n, src, err := conn.ReadFromUDP(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			n = 0
+		} else if err != nil {
+			return err
+		}
+
+		// Decode the ensembles in the datagram
+		var ensembles []rti.Ensemble
+		if n > 0 {
+			source, ok := sources[src.String()]
+			if !ok {
+				source = &udpSource{}
+				sources[src.String()] = source
+			}
+			ensembles = source.add(buf[:n])
+		}
+
+		// Pass the ensembles to the server in order.  Each subsystem
+		// has its own ensemble numbers.
+		now := time.Now()
+		for _, ens := range ensembles {
+			key := adcpKey(ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens))
+			r, ok := reorder[key]
+			if !ok {
+				r = &udpReorder{}
+				reorder[key] = r
+			}
+
+			for _, orderedEns := range r.add(ens, now) {
+				server.ensembles <- orderedEns
+			}
+		}
+		for _, r := range reorder {
+			for _, orderedEns := range r.flush(now) {
+				server.ensembles <- orderedEns
+			}
+		}
+	}
+}
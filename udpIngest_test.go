@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+// udpTestEnsemble will get an ensemble with the ensemble number.
+func udpTestEnsemble(num uint32) rti.Ensemble {
+	ens := pd0TestEnsemble()
+	ens.EnsembleData.EnsembleNumber = num
+	return ens
+}
+
+// udpEnsembleNumbers will get the ensemble numbers of the ensembles.
+func udpEnsembleNumbers(ensembles []rti.Ensemble) []uint32 {
+	var nums []uint32
+	for _, ens := range ensembles {
+		nums = append(nums, ens.EnsembleData.EnsembleNumber)
+	}
+	return nums
+}
+
+func TestUDPReorder(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		nums  []uint32
+		want  []uint32
+		flush []uint32
+	}{
+		{"in order", []uint32{100, 101, 102}, []uint32{100, 101, 102}, nil},
+		{"reorder", []uint32{100, 102, 101, 103}, []uint32{100, 101, 102, 103}, nil},
+		{"duplicate", []uint32{100, 101, 101, 102}, []uint32{100, 101, 102}, nil},
+		{"drop", []uint32{100, 102, 103, 104, 105, 106, 107}, []uint32{100, 102, 103, 104, 105, 106, 107}, nil},
+		{"late", []uint32{100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 101, 111}, []uint32{100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 111}, nil},
+		{"restart", []uint32{100, 101, 1, 2}, []uint32{100, 101, 1, 2}, nil},
+		{"restart jump", []uint32{5000, 5001, 3000, 3001}, []uint32{5000, 5001, 3000, 3001}, nil},
+		{"wait", []uint32{100, 102, 103}, []uint32{100}, []uint32{102, 103}},
+	}
+	for _, test := range tests {
+		var r udpReorder
+		var got []rti.Ensemble
+		for _, num := range test.nums {
+			got = append(got, r.add(udpTestEnsemble(num), now)...)
+		}
+		if nums := udpEnsembleNumbers(got); !equalUint32(nums, test.want) {
+			t.Errorf("%s: ensembles = %v, want %v", test.name, nums, test.want)
+		}
+
+		// Ensembles held for a missing ensemble are passed on after the wait
+		if flushed := r.flush(now.Add(udpReorderWait / 2)); len(flushed) != 0 {
+			t.Errorf("%s: flushed %v before the wait", test.name, udpEnsembleNumbers(flushed))
+		}
+		if nums := udpEnsembleNumbers(r.flush(now.Add(udpReorderWait))); !equalUint32(nums, test.flush) {
+			t.Errorf("%s: flushed = %v, want %v", test.name, nums, test.flush)
+		}
+	}
+}
+
+// equalUint32 will check if the values are the same.
+func equalUint32(a []uint32, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -4,15 +4,15 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 )
 
-const downloadDir = "//home//ubuntu//upload//"
-
 // upload logic
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("method:", r.Method)
@@ -25,20 +25,92 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		t, _ := template.ParseFiles("upload.html")
 		t.Execute(w, token)
 	} else {
-		r.ParseMultipartForm(32 << 20)
-		file, handler, err := r.FormFile("uploadfile")
+		receiveUploads(w, r)
+	}
+}
+
+// trustedProxies is the addresses of the proxies trusted to give the
+// client address in X-Forwarded-For.
+var trustedProxies = make(map[string]bool)
+
+// setTrustedProxies will set the comma separated addresses of the
+// trusted proxies.
+func setTrustedProxies(list string) {
+	trustedProxies = make(map[string]bool)
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			trustedProxies[addr] = true
+		}
+	}
+}
+
+// uploaderName will get who is uploading the files.  It is the basic
+// auth user or the address of the client.  X-Forwarded-For is only used
+// when the request is from a trusted proxy, and the client is the last
+// address in it that is not a trusted proxy.
+func uploaderName(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && trustedProxies[host] {
+		addrs := strings.Split(forwarded, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if addr != "" && !trustedProxies[addr] {
+				return addr
+			}
+		}
+	}
+	return host
+}
+
+// receiveUploads will stream each file in the multipart form to the
+// upload store and start an ingest job for it.  The ingest jobs
+// are sent back so the upload page can poll them.
+func receiveUploads(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	uploader := uploaderName(r)
+
+	jobs := []ingestJob{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			fmt.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Only the files are stored
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		file, err := uploads.save(part.FileName(), uploader, part)
+		part.Close()
+		if err == errUploadTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
 			return
 		}
-		defer file.Close()
-		fmt.Fprintf(w, "%v", handler.Header)
-		f, err := os.OpenFile(downloadDir+handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)
 		if err != nil {
-			fmt.Println(err)
+			log.Println("Error storing upload: " + err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer f.Close()
-		io.Copy(f, file)
+
+		// Ingest the file in the background
+		jobs = append(jobs, ingest.add(file.Name))
 	}
+
+	writeJSON(w, jobs)
 }
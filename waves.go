@@ -0,0 +1,902 @@
+///
+/// Wave spectra from bursts of ensembles.
+///
+/// A wave ADCP is on the bottom looking up and samples a burst of
+/// ensembles at a fixed rate.  The ensembles of each ADCP are gathered
+/// until the burst has the number of samples or there is a gap in time.
+///
+/// The surface elevation spectrum is found from each of the time series
+/// of the burst that are available:
+///
+///	Range track   Mean bottom track range to the surface
+///	Pressure      Pressure sensor, corrected for the depth with linear wave theory
+///	Velocity      East and North velocity of a bin near the surface, corrected the same way
+///
+/// The depth is from the pressure or the range track, so a burst needs
+/// one of them.  The significant wave height and peak period are from the
+/// range track spectrum if there is one, else the pressure.  The velocity
+/// spectrum is a check of the others.  The direction is from the
+/// co-spectra of the surface elevation and the East and North velocity.
+/// The directions are the directions the waves come from, clockwise
+/// from North.
+///
+///	GET /api/waves                                        Last wave summary of each ADCP
+///	GET /api/waves?serial=&config=                        Last wave summary and spectrum of an ADCP
+///	GET /api/waves/file?file=&serial=&config=&start=&end=&samples=&height=&bin=
+///	                                                      Process the bursts of a data file
+///
+///	adcpio waves -in file -samples 1024 -height 0.5 -bin -1
+///
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+const (
+	waveGravity     = 9.81             // Gravity in m/s^2
+	waveDensity     = 1025.0           // Density of sea water in kg/m^3
+	waveSegment     = 256              // Samples in each spectrum segment
+	waveMinSamples  = 64               // Fewest samples in a burst to process
+	waveMaxGap      = 10 * time.Second // Largest time between the samples of a burst
+	waveMaxBad      = 0.1              // Largest part of a time series that can be bad
+	waveMinFreq     = 0.035            // Lowest frequency in Hz of the wave height
+	waveMaxFreq     = 1.0              // Highest frequency in Hz of the wave height
+	waveMinResponse = 0.1              // Lowest depth response of the pressure and velocity
+	waveBinDepth    = 0.75             // Deepest wave bin as the part of the depth to the ADCP
+	waveDirections  = 36               // Directions of the directional spectrum
+
+	waveSourceRange    = "range"    // Range track to the surface
+	waveSourcePressure = "pressure" // Pressure sensor
+)
+
+// waveConfig is the configuration of the wave processing.
+type waveConfig struct {
+	samples int     // Samples in a burst.  0 to not process waves
+	height  float64 // Height of the ADCP above the bottom in meters
+	bin     int     // Bin of the wave velocity.  Less than 0 to select the bin
+}
+
+// waveSummary is the wave height, period and direction of a burst.
+type waveSummary struct {
+	ID              string    // Data ID
+	SerialNum       string    // Serial Number
+	SubsystemConfig string    // Subsystem configuration
+	CepoIndex       uint8     // Subystem configuration
+	Replay          bool      // Flag if the data is from a replay
+	Average         bool      // Flag if the data is averaged
+	BurstStart      time.Time // Time of the first sample
+	BurstEnd        time.Time // Time of the last sample
+	SampleCount     int       // Number of samples in the burst
+	SampleInterval  float64   // Time between the samples in seconds
+	WaterDepth      float64   // Mean water depth in meters
+	WaveBin         int       // Bin of the wave velocity.  -1 if none
+	Source          string    // Time series of the wave height and period
+	Hs              float64   // Significant wave height in meters
+	Tp              float64   // Peak period in seconds
+	Dp              float64   // Peak direction in degrees the waves come from
+	Directional     bool      // Flag if there is a direction
+}
+
+// waveSpectrum is the spectra of a burst.  The spectra are the surface
+// elevation in m^2/Hz at each frequency.  A spectrum without its time
+// series is empty.
+type waveSpectrum struct {
+	ID                  string      // Data ID
+	SerialNum           string      // Serial Number
+	SubsystemConfig     string      // Subsystem configuration
+	CepoIndex           uint8       // Subystem configuration
+	Replay              bool        // Flag if the data is from a replay
+	Average             bool        // Flag if the data is averaged
+	BurstStart          time.Time   // Time of the first sample
+	Source              string      // Time series of the spectrum
+	Frequency           []float64   // Frequency in Hz
+	Spectrum            []float64   // Spectrum of the source
+	RangeSpectrum       []float64   // Range track spectrum
+	PressureSpectrum    []float64   // Pressure spectrum
+	VelocitySpectrum    []float64   // Velocity spectrum
+	Direction           []float64   // Mean direction in degrees the waves come from at each frequency
+	Spread              []float64   // Directional spread in degrees at each frequency
+	Directions          []float64   // Directions in degrees of the directional spectrum
+	DirectionalSpectrum [][]float64 // [frequency][direction] spectrum in m^2/Hz/degree
+}
+
+// waveResult is the summary and spectrum of a burst.
+type waveResult struct {
+	Summary  waveSummary  // Wave height, period and direction
+	Spectrum waveSpectrum // Spectra
+}
+
+// waveProcessor will gather the bursts of each ADCP and keep the
+// last result of each ADCP.
+type waveProcessor struct {
+	mutex   sync.Mutex                // Lock the bursts and results
+	config  waveConfig                // Configuration
+	bursts  map[string][]rti.Ensemble // Burst in progress of each ADCP.  Key is the ADCP key
+	results map[string]waveResult     // Last result of each ADCP.  Key is the ADCP key
+}
+
+// waves is the wave processing of the live and replayed ensembles.
+var waves = newWaveProcessor(waveConfig{bin: -1})
+
+// newWaveProcessor will create the wave processing with the configuration.
+func newWaveProcessor(config waveConfig) *waveProcessor {
+	return &waveProcessor{
+		config:  config,                          // Configuration
+		bursts:  make(map[string][]rti.Ensemble), // Burst of each ADCP
+		results: make(map[string]waveResult),     // Last result of each ADCP
+	}
+}
+
+// configure will set the configuration of the wave processing.
+// The bursts in progress are removed.
+func (w *waveProcessor) configure(samples int, height float64, bin int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.config = waveConfig{
+		samples: samples, // Samples in a burst
+		height:  height,  // Height of the ADCP
+		bin:     bin,     // Wave bin
+	}
+	w.bursts = make(map[string][]rti.Ensemble)
+}
+
+// add will add the ensemble to the burst of its ADCP.  When the burst
+// has all the samples or there is a gap in time, the burst is processed
+// and the results are returned.
+func (w *waveProcessor) add(ens rti.Ensemble) []waveResult {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.config.samples <= 0 {
+		return nil
+	}
+
+	var results []waveResult
+	key := adcpKey(ens.EnsembleData.SerialNumber.SerialNumber, subsystemConfig(ens))
+	burst := w.bursts[key]
+
+	// A gap in time ends the burst
+	if len(burst) > 0 {
+		gap := ensembleTime(ens).Sub(ensembleTime(burst[len(burst)-1]))
+		if gap <= 0 || gap > waveMaxGap {
+			if result, ok := w.process(key, burst); ok {
+				results = append(results, result)
+			}
+			burst = nil
+		}
+	}
+
+	burst = append(burst, ens)
+	if len(burst) >= w.config.samples {
+		if result, ok := w.process(key, burst); ok {
+			results = append(results, result)
+		}
+		burst = nil
+	}
+	w.bursts[key] = burst
+	return results
+}
+
+// flush will process the bursts in progress.  This is used at the end
+// of a data file.
+func (w *waveProcessor) flush() []waveResult {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	keys := make([]string, 0, len(w.bursts))
+	for key := range w.bursts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var results []waveResult
+	for _, key := range keys {
+		if result, ok := w.process(key, w.bursts[key]); ok {
+			results = append(results, result)
+		}
+		delete(w.bursts, key)
+	}
+	return results
+}
+
+// process will process the burst and keep the result.  A burst with too
+// few samples or without a good time series is not processed.
+func (w *waveProcessor) process(key string, burst []rti.Ensemble) (waveResult, bool) {
+	if len(burst) < waveMinSamples {
+		return waveResult{}, false
+	}
+	result, err := processWaveBurst(burst, w.config)
+	if err != nil {
+		log.Printf("Waves not processed for %s: %s", key, err.Error())
+		return waveResult{}, false
+	}
+	w.results[key] = result
+	return result, true
+}
+
+// result will get the last result of the ADCP.
+func (w *waveProcessor) result(key string) (waveResult, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	result, ok := w.results[key]
+	return result, ok
+}
+
+// summaries will get the last summary of each ADCP.
+func (w *waveProcessor) summaries() []waveSummary {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	keys := make([]string, 0, len(w.results))
+	for key := range w.results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	summaries := make([]waveSummary, 0, len(keys))
+	for _, key := range keys {
+		summaries = append(summaries, w.results[key].Summary)
+	}
+	return summaries
+}
+
+// addWaves will add the ensemble to the wave burst of its ADCP and send
+// the results of a finished burst to the displays.
+func addWaves(ens rti.Ensemble, replay bool) {
+	for _, result := range waves.add(ens) {
+		result.Summary.Replay = replay
+		result.Spectrum.Replay = replay
+		sendWaveData(result)
+	}
+}
+
+// sendWaveData will send the wave summary and spectrum to the displays.
+func sendWaveData(result waveResult) {
+	// Wave summary
+	b, err := json.Marshal(result.Summary)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	sendAdcpDataToDisplays(wavesID, result.Summary.SerialNum, result.Summary.SubsystemConfig, false, b)
+
+	// Wave spectrum
+	b, err = json.Marshal(result.Spectrum)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	sendAdcpDataToDisplays(waveSpectrumID, result.Spectrum.SerialNum, result.Spectrum.SubsystemConfig, false, b)
+}
+
+// waveSeries is the time series of a burst.  A time series that
+// is not available is nil.
+type waveSeries struct {
+	pressure []float64 // Depth of the ADCP from the pressure in meters
+	surface  []float64 // Range track to the surface in meters
+	east     []float64 // East velocity of the wave bin in m/s
+	north    []float64 // North velocity of the wave bin in m/s
+}
+
+// processWaveBurst will find the spectra, wave height, period and
+// direction of the burst.  An error is returned if the burst has no
+// time series with the depth or the time between samples is not known.
+func processWaveBurst(burst []rti.Ensemble, config waveConfig) (waveResult, error) {
+	n := len(burst)
+	if n < 2 {
+		return waveResult{}, errors.New("too few samples")
+	}
+	first := burst[0]
+	last := burst[n-1]
+
+	// Sample rate
+	dt := ensembleTime(last).Sub(ensembleTime(first)).Seconds() / float64(n-1)
+	if dt <= 0 {
+		return waveResult{}, errors.New("no time between samples")
+	}
+	fs := 1 / dt
+
+	// Depth of the ADCP
+	series := waveSeries{
+		pressure: waveTimeSeries(burst, func(ens rti.Ensemble) (float64, bool) {
+			p := float64(ens.AncillaryData.Pressure)
+			return p / (waveDensity * waveGravity), p > 0
+		}),
+		surface: waveTimeSeries(burst, waveSurfaceRange),
+	}
+	sensorDepth := float64(0)
+	switch {
+	case series.pressure != nil:
+		sensorDepth = mean(series.pressure)
+	case series.surface != nil:
+		sensorDepth = mean(series.surface)
+	default:
+		return waveResult{}, errors.New("no pressure or range track")
+	}
+	depth := sensorDepth + config.height
+
+	// Velocity of the wave bin near the surface
+	bin := config.bin
+	if bin < 0 {
+		bin = waveVelocityBin(last, sensorDepth)
+	}
+	if bin >= 0 {
+		series.east = waveTimeSeries(burst, waveBinVelocity(bin, 0))
+		series.north = waveTimeSeries(burst, waveBinVelocity(bin, 1))
+		if series.east == nil || series.north == nil {
+			series.east, series.north = nil, nil
+		}
+	}
+	if series.east == nil {
+		bin = -1
+	}
+	velHeight := config.height
+	if bin >= 0 {
+		velHeight += float64(binDepth(last, bin))
+	}
+
+	// Length of the spectrum segments
+	segment := waveSegment
+	for segment > n {
+		segment /= 2
+	}
+	if segment < waveMinSamples/2 {
+		return waveResult{}, errors.New("burst is too short")
+	}
+
+	// Frequencies and the response of the pressure and velocity at each
+	// frequency from linear wave theory
+	numFreq := segment / 2
+	freq := make([]float64, numFreq)
+	pressureResponse := make([]float64, numFreq)
+	velocityResponse := make([]float64, numFreq)
+	for i := range freq {
+		freq[i] = float64(i+1) * fs / float64(segment)
+		omega := 2 * math.Pi * freq[i]
+		k := waveNumber(omega, depth)
+		if response := depthResponse(k, config.height, depth); response >= waveMinResponse {
+			pressureResponse[i] = response
+		}
+		if response := depthResponse(k, velHeight, depth); response >= waveMinResponse {
+			velocityResponse[i] = omega * response / math.Tanh(k*depth)
+		}
+	}
+
+	// Surface elevation spectrum of each time series
+	spectrum := waveSpectrum{
+		ID:              waveSpectrumID,                               // ID
+		SerialNum:       first.EnsembleData.SerialNumber.SerialNumber, // Serial number
+		SubsystemConfig: subsystemConfig(first),                       // Subsystem configuration
+		CepoIndex:       first.EnsembleData.SubsystemConfig.CepoIndex, // Subsystem Config
+		BurstStart:      ensembleTime(first),                          // Time of the first sample
+		Frequency:       freq,                                         // Frequencies
+	}
+	var pp []float64
+	if series.surface != nil {
+		spectrum.RangeSpectrum = crossSpectrum(series.surface, series.surface, segment, fs)
+	}
+	if series.pressure != nil {
+		pp = crossSpectrum(series.pressure, series.pressure, segment, fs)
+		spectrum.PressureSpectrum = correctSpectrum(pp, pressureResponse)
+	}
+	var uu, vv []float64
+	if series.east != nil {
+		uu = crossSpectrum(series.east, series.east, segment, fs)
+		vv = crossSpectrum(series.north, series.north, segment, fs)
+		uv := make([]float64, numFreq)
+		for i := range uv {
+			uv[i] = uu[i] + vv[i]
+		}
+		spectrum.VelocitySpectrum = correctSpectrum(uv, velocityResponse)
+	}
+
+	// Source of the wave height and period
+	spectrum.Source = waveSourcePressure
+	spectrum.Spectrum = spectrum.PressureSpectrum
+	if series.surface != nil {
+		spectrum.Source = waveSourceRange
+		spectrum.Spectrum = spectrum.RangeSpectrum
+	}
+
+	summary := waveSummary{
+		ID:              wavesID,                                        // ID
+		SerialNum:       spectrum.SerialNum,                             // Serial number
+		SubsystemConfig: spectrum.SubsystemConfig,                       // Subsystem configuration
+		CepoIndex:       spectrum.CepoIndex,                             // Subsystem Config
+		BurstStart:      spectrum.BurstStart,                            // Time of the first sample
+		BurstEnd:        ensembleTime(last),                             // Time of the last sample
+		SampleCount:     n,                                              // Number of samples
+		SampleInterval:  dt,                                             // Time between samples
+		WaterDepth:      depth,                                          // Water depth
+		WaveBin:         bin,                                            // Wave bin
+		Source:          spectrum.Source,                                // Source of the wave height
+		Hs:              significantHeight(freq, spectrum.Spectrum, fs), // Significant wave height
+	}
+	peak := peakFrequency(freq, spectrum.Spectrum, fs)
+	if peak >= 0 {
+		summary.Tp = 1 / freq[peak]
+	}
+
+	// Direction from the co-spectra of the surface and the velocity
+	elevation := series.surface
+	if elevation == nil {
+		elevation = series.pressure
+	}
+	if elevation != nil && series.east != nil {
+		ee := crossSpectrum(elevation, elevation, segment, fs)
+		eu := crossSpectrum(elevation, series.east, segment, fs)
+		ev := crossSpectrum(elevation, series.north, segment, fs)
+		uv := crossSpectrum(series.east, series.north, segment, fs)
+		spectrum.setDirections(ee, eu, ev, uu, vv, uv)
+		if peak >= 0 {
+			summary.Dp = spectrum.Direction[peak]
+			summary.Directional = true
+		}
+	}
+
+	return waveResult{Summary: summary, Spectrum: spectrum}, nil
+}
+
+// waveTimeSeries will get the time series of the value of each ensemble.
+// Bad values are replaced by the mean of the good values.  If too many
+// values are bad, nil is returned.
+func waveTimeSeries(burst []rti.Ensemble, value func(ens rti.Ensemble) (float64, bool)) []float64 {
+	series := make([]float64, len(burst))
+	good := make([]bool, len(burst))
+	sum := float64(0)
+	count := 0
+	for i, ens := range burst {
+		series[i], good[i] = value(ens)
+		if good[i] {
+			sum += series[i]
+			count++
+		}
+	}
+	if count == 0 || float64(len(burst)-count) > waveMaxBad*float64(len(burst)) {
+		return nil
+	}
+	for i := range series {
+		if !good[i] {
+			series[i] = sum / float64(count)
+		}
+	}
+	return series
+}
+
+// waveSurfaceRange will get the mean range of the good bottom track beams.
+// Looking up, this is the range to the surface.
+func waveSurfaceRange(ens rti.Ensemble) (float64, bool) {
+	sum := float64(0)
+	count := 0
+	for _, r := range ens.BottomTrackData.Range {
+		if r > 0 && r != rtiBadVelocity {
+			sum += float64(r)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
+
+// waveBinVelocity will get the earth velocity of the beam in the bin.
+func waveBinVelocity(bin int, beam int) func(ens rti.Ensemble) (float64, bool) {
+	return func(ens rti.Ensemble) (float64, bool) {
+		vel, ok := binValue(ens.EarthVelocityData.Velocity, bin, beam)
+		return float64(vel), ok && vel != rtiBadVelocity
+	}
+}
+
+// waveVelocityBin will select the bin nearest the surface that is clear
+// of the surface.  If no bin is, -1 is returned.
+func waveVelocityBin(ens rti.Ensemble, sensorDepth float64) int {
+	bin := -1
+	for b := range ens.EarthVelocityData.Velocity {
+		if float64(binDepth(ens, b)) > waveBinDepth*sensorDepth {
+			break
+		}
+		bin = b
+	}
+	return bin
+}
+
+// waveNumber will solve the dispersion relation omega^2 = g k tanh(k h)
+// for the wave number k with Newton's method.
+func waveNumber(omega float64, depth float64) float64 {
+	if omega <= 0 || depth <= 0 {
+		return 0
+	}
+
+	// Deep water wave number to start
+	k := omega * omega / waveGravity
+	if kh := k * depth; kh < 1 {
+		// Shallow water wave number to start
+		k = omega / math.Sqrt(waveGravity*depth)
+	}
+	for i := 0; i < 50; i++ {
+		t := math.Tanh(k * depth)
+		f := waveGravity*k*t - omega*omega
+		df := waveGravity*t + waveGravity*k*depth*(1-t*t)
+		step := f / df
+		k -= step
+		if math.Abs(step) < 1e-12*k {
+			break
+		}
+	}
+	return k
+}
+
+// depthResponse will get cosh(k z) / cosh(k h), the part of the surface
+// wave motion at the height z above the bottom in the depth h.  This is
+// found with exponentials so it does not overflow in deep water.
+func depthResponse(k float64, z float64, h float64) float64 {
+	return math.Exp(k*(z-h)) * (1 + math.Exp(-2*k*z)) / (1 + math.Exp(-2*k*h))
+}
+
+// correctSpectrum will get the surface elevation spectrum from the spectrum
+// of the sensor with the response of the sensor at each frequency.  A
+// frequency with no response is 0.
+func correctSpectrum(spectrum []float64, response []float64) []float64 {
+	corrected := make([]float64, len(spectrum))
+	for i := range spectrum {
+		if response[i] <= 0 {
+			continue
+		}
+		corrected[i] = spectrum[i] / (response[i] * response[i])
+	}
+	return corrected
+}
+
+// waveBand will check if the frequency is used for the wave height and period.
+func waveBand(f float64, fs float64) bool {
+	return f >= waveMinFreq && f <= waveMaxFreq && f < fs/2
+}
+
+// significantHeight will get the significant wave height 4 sqrt(m0) from the
+// spectrum in the wave band.
+func significantHeight(freq []float64, spectrum []float64, fs float64) float64 {
+	if len(freq) < 2 || len(spectrum) != len(freq) {
+		return 0
+	}
+	df := freq[1] - freq[0]
+	m0 := float64(0)
+	for i, f := range freq {
+		if waveBand(f, fs) {
+			m0 += spectrum[i] * df
+		}
+	}
+	return 4 * math.Sqrt(m0)
+}
+
+// peakFrequency will get the index of the largest spectrum in the
+// wave band.  If there is no energy, -1 is returned.
+func peakFrequency(freq []float64, spectrum []float64, fs float64) int {
+	peak := -1
+	for i, f := range freq {
+		if i >= len(spectrum) || !waveBand(f, fs) || spectrum[i] <= 0 {
+			continue
+		}
+		if peak < 0 || spectrum[i] > spectrum[peak] {
+			peak = i
+		}
+	}
+	return peak
+}
+
+// setDirections will set the mean direction, spread and directional spectrum
+// from the auto and co-spectra of the surface elevation (e) and the East (u)
+// and North (v) velocity.  The Fourier coefficients of the directional
+// distribution are for the direction the waves come from, so a wave from
+// direction theta has velocity (-sin theta, -cos theta).
+func (spectrum *waveSpectrum) setDirections(ee, eu, ev, uu, vv, uv []float64) {
+	numFreq := len(spectrum.Frequency)
+	spectrum.Direction = make([]float64, numFreq)
+	spectrum.Spread = make([]float64, numFreq)
+	spectrum.Directions = make([]float64, waveDirections)
+	spectrum.DirectionalSpectrum = make([][]float64, numFreq)
+	for d := range spectrum.Directions {
+		spectrum.Directions[d] = float64(d) * 360 / waveDirections
+	}
+
+	for i := 0; i < numFreq; i++ {
+		spectrum.DirectionalSpectrum[i] = make([]float64, waveDirections)
+		horizontal := uu[i] + vv[i]
+		norm := math.Sqrt(ee[i] * horizontal)
+		if norm <= 0 || horizontal <= 0 {
+			continue
+		}
+
+		// Fourier coefficients
+		a1 := -ev[i] / norm
+		b1 := -eu[i] / norm
+		a2 := (vv[i] - uu[i]) / horizontal
+		b2 := 2 * uv[i] / horizontal
+
+		// Mean direction and spread
+		dir := math.Atan2(b1, a1) * 180 / math.Pi
+		if dir < 0 {
+			dir += 360
+		}
+		spectrum.Direction[i] = dir
+		r1 := math.Min(math.Hypot(a1, b1), 1)
+		spectrum.Spread[i] = math.Sqrt(2*(1-r1)) * 180 / math.Pi
+
+		// Directional distribution for each degree
+		for d, theta := range spectrum.Directions {
+			t := theta * math.Pi / 180
+			dist := (0.5 + a1*math.Cos(t) + b1*math.Sin(t) + a2*math.Cos(2*t) + b2*math.Sin(2*t)) / math.Pi
+			if dist < 0 {
+				dist = 0
+			}
+			if i < len(spectrum.Spectrum) {
+				spectrum.DirectionalSpectrum[i][d] = spectrum.Spectrum[i] * dist * math.Pi / 180
+			}
+		}
+	}
+}
+
+// crossSpectrum will get the one sided co-spectrum of x and y with Welch's
+// method.  The series are split into segments that overlap by half.  Each
+// segment is detrended and Hann windowed.  The spectrum does not include
+// the 0 frequency.  With x and y the same, it is the power spectral density.
+func crossSpectrum(x []float64, y []float64, segment int, fs float64) []float64 {
+	numFreq := segment / 2
+	spectrum := make([]float64, numFreq)
+
+	// Hann window
+	window := make([]float64, segment)
+	windowPower := float64(0)
+	for i := range window {
+		window[i] = 0.5 * (1 - math.Cos(2*math.Pi*float64(i)/float64(segment)))
+		windowPower += window[i] * window[i]
+	}
+
+	segments := 0
+	for start := 0; start+segment <= len(x); start += segment / 2 {
+		xf := windowedFFT(x[start:start+segment], window)
+		yf := windowedFFT(y[start:start+segment], window)
+		for i := range spectrum {
+			spectrum[i] += real(xf[i+1] * cmplx.Conj(yf[i+1]))
+		}
+		segments++
+	}
+
+	scale := 2 / (fs * windowPower * float64(segments))
+	for i := range spectrum {
+		spectrum[i] *= scale
+	}
+
+	// Nyquist frequency is only once in the one sided spectrum
+	spectrum[numFreq-1] /= 2
+	return spectrum
+}
+
+// windowedFFT will detrend the series, apply the window and get the FFT.
+func windowedFFT(series []float64, window []float64) []complex128 {
+	n := len(series)
+
+	// Linear trend
+	sumX, sumY, sumXY, sumXX := float64(0), float64(0), float64(0), float64(0)
+	for i, v := range series {
+		x := float64(i)
+		sumX += x
+		sumY += v
+		sumXY += x * v
+		sumXX += x * x
+	}
+	slope := (float64(n)*sumXY - sumX*sumY) / (float64(n)*sumXX - sumX*sumX)
+	offset := (sumY - slope*sumX) / float64(n)
+
+	values := make([]complex128, n)
+	for i, v := range series {
+		values[i] = complex((v-offset-slope*float64(i))*window[i], 0)
+	}
+	fft(values)
+	return values
+}
+
+// fft will get the discrete Fourier transform of the values in place.
+// The number of values is a power of 2.
+func fft(values []complex128) {
+	n := len(values)
+
+	// Bit reversed order
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+
+	// Butterflies
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := values[start+k]
+				odd := values[start+k+size/2] * w
+				values[start+k] = even + odd
+				values[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// mean will get the mean of the values.
+func mean(values []float64) float64 {
+	sum := float64(0)
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// processWaveFiles will process the bursts of the ensembles in the data
+// files.  The last burst of each ADCP is processed at the end of the files.
+func processWaveFiles(paths []string, filter ensembleFilter, config waveConfig) ([]waveResult, error) {
+	processor := newWaveProcessor(config)
+
+	var results []waveResult
+	err := readFilteredEnsembles(paths, filter, func(ens rti.Ensemble) error {
+		results = append(results, processor.add(transformEnsemble(ens))...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(results, processor.flush()...), nil
+}
+
+// wavesHandler will get the last wave results.
+//
+//	/api/waves?serial=&config=
+//
+// Without serial, the summary of each ADCP is returned.
+func wavesHandler(w http.ResponseWriter, r *http.Request) {
+	serialNum := r.FormValue("serial")
+	if serialNum == "" {
+		writeJSON(w, waves.summaries())
+		return
+	}
+
+	result, ok := waves.result(adcpKey(serialNum, r.FormValue("config")))
+	if !ok {
+		http.Error(w, "No waves for the ADCP", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// wavesFileHandler will process the wave bursts of a data file.
+//
+//	/api/waves/file?file=name&serial=&config=&start=&end=&samples=&height=&bin=
+//
+// If file is not given, the ingested files are used.  The configuration
+// not given is the same as the live processing.
+func wavesFileHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEnsembleFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config, err := parseWaveConfig(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths, err := parseDataFiles(r, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	results, err := processWaveFiles(paths, filter, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// parseWaveConfig will get the wave configuration from the request.
+func parseWaveConfig(r *http.Request) (waveConfig, error) {
+	waves.mutex.Lock()
+	config := waves.config
+	waves.mutex.Unlock()
+
+	var err error
+	if s := r.FormValue("samples"); s != "" {
+		if config.samples, err = strconv.Atoi(s); err != nil {
+			return config, fmt.Errorf("bad samples: %s", s)
+		}
+	}
+	if s := r.FormValue("height"); s != "" {
+		if config.height, err = strconv.ParseFloat(s, 64); err != nil {
+			return config, fmt.Errorf("bad height: %s", s)
+		}
+	}
+	if s := r.FormValue("bin"); s != "" {
+		if config.bin, err = strconv.Atoi(s); err != nil {
+			return config, fmt.Errorf("bad bin: %s", s)
+		}
+	}
+	if config.samples <= 0 {
+		return config, errors.New("samples in a burst are required")
+	}
+	return config, nil
+}
+
+// wavesCommand will process the wave bursts of a data file from the command
+// line.  The results are written as JSON.
+//
+//	adcpio waves -in file -out file.json -samples 1024 -height 0.5 -bin -1 -serial num -config cfg -start time -end time
+func wavesCommand(args []string) error {
+	cmd := flag.NewFlagSet("waves", flag.ExitOnError)
+	in := cmd.String("in", "", "RTI binary, PD0 or JSON-lines data file")
+	out := cmd.String("out", "", "JSON file to create, empty for stdout")
+	samples := cmd.Int("samples", 1024, "samples in a wave burst")
+	height := cmd.Float64("height", 0, "height of the ADCP above the bottom in meters")
+	bin := cmd.Int("bin", -1, "bin of the wave velocity, -1 to select the bin")
+	serial := cmd.String("serial", "", "serial number of the ADCP")
+	config := cmd.String("config", "", "subsystem configuration of the ADCP")
+	start := cmd.String("start", "", "start time in RFC3339")
+	end := cmd.String("end", "", "end time in RFC3339")
+	cmd.Parse(args)
+
+	if *in == "" || *samples <= 0 {
+		cmd.Usage()
+		return errors.New("-in and -samples are required")
+	}
+
+	filter, err := newEnsembleFilter(*serial, *config, *start, *end)
+	if err != nil {
+		return err
+	}
+
+	results, err := processWaveFiles([]string{*in}, filter, waveConfig{samples: *samples, height: *height, bin: *bin})
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(results); err != nil {
+		w.Close()
+		return err
+	}
+	if w == os.Stdout {
+		return nil
+	}
+	return w.Close()
+}
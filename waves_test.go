@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ricorx7/go-rti"
+)
+
+const (
+	waveTestDepth     = 10.0 // Water depth in meters
+	waveTestHeight    = 0.5  // Height of the ADCP above the bottom in meters
+	waveTestAmplitude = 0.5  // Wave amplitude in meters
+	waveTestPeriod    = 8.0  // Wave period in seconds
+	waveTestFrom      = 225  // Direction in degrees the waves come from
+	waveTestSamples   = 1024 // Samples in a burst at 1 Hz
+)
+
+// waveTestBurst will create a burst of an upward looking ADCP under a
+// single wave train.  The pressure, range track and velocity of each
+// ensemble are from linear wave theory.
+func waveTestBurst(start time.Time) []rti.Ensemble {
+	const numBins = 10
+
+	omega := 2 * math.Pi / waveTestPeriod
+	k := waveNumber(omega, waveTestDepth)
+	sensorDepth := waveTestDepth - waveTestHeight
+	toward := (waveTestFrom + 180) * math.Pi / 180
+
+	burst := make([]rti.Ensemble, waveTestSamples)
+	for i := range burst {
+		t := start.Add(time.Duration(i) * time.Second)
+		eta := waveTestAmplitude * math.Cos(omega*float64(i))
+
+		var ens rti.Ensemble
+		ens.EnsembleData.EnsembleNumber = uint32(i + 1)
+		ens.EnsembleData.NumBins = numBins
+		ens.EnsembleData.NumBeams = 4
+		ens.EnsembleData.SerialNumber.SerialNumber = "01400000000000000000000000000001"
+		ens.EnsembleData.Year = uint32(t.Year())
+		ens.EnsembleData.Month = uint32(t.Month())
+		ens.EnsembleData.Day = uint32(t.Day())
+		ens.EnsembleData.Hour = uint32(t.Hour())
+		ens.EnsembleData.Minute = uint32(t.Minute())
+		ens.EnsembleData.Second = uint32(t.Second())
+
+		ens.AncillaryData.FirstBinRange = 1
+		ens.AncillaryData.BinSize = 1
+		pressureDepth := sensorDepth + eta*depthResponse(k, waveTestHeight, waveTestDepth)
+		ens.AncillaryData.Pressure = float32(pressureDepth * waveDensity * waveGravity)
+
+		surface := float32(sensorDepth + eta)
+		ens.BottomTrackData.Range = []float32{surface, surface, surface, surface}
+
+		ens.EarthVelocityData.Velocity = make([][]float32, numBins)
+		for bin := range ens.EarthVelocityData.Velocity {
+			z := waveTestHeight + float64(binDepth(ens, bin))
+			speed := eta * omega * depthResponse(k, z, waveTestDepth) / math.Tanh(k*waveTestDepth)
+			ens.EarthVelocityData.Velocity[bin] = []float32{float32(speed * math.Sin(toward)), float32(speed * math.Cos(toward)), 0, 0}
+		}
+		burst[i] = ens
+	}
+	return burst
+}
+
+// waveTestFile will write the bursts to an RTI binary file.
+func waveTestFile(t *testing.T, bursts ...[]rti.Ensemble) string {
+	path := filepath.Join(t.TempDir(), "waves.ens")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, burst := range bursts {
+		for _, ens := range burst {
+			if _, err := f.Write(encodeRtiEnsemble(ens)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWaveNumber(t *testing.T) {
+	for _, depth := range []float64{1, 10, 100, 5000} {
+		for _, period := range []float64{2, 8, 20} {
+			omega := 2 * math.Pi / period
+			k := waveNumber(omega, depth)
+			if got := waveGravity * k * math.Tanh(k*depth); math.Abs(got-omega*omega) > 1e-9 {
+				t.Errorf("depth %v period %v: g k tanh(kh) = %v, want %v", depth, period, got, omega*omega)
+			}
+		}
+	}
+}
+
+func TestFFT(t *testing.T) {
+	const n = 16
+	values := make([]complex128, n)
+	for i := range values {
+		values[i] = complex(math.Cos(2*math.Pi*3*float64(i)/n), 0)
+	}
+	fft(values)
+	for i, v := range values {
+		want := 0.0
+		if i == 3 || i == n-3 {
+			want = n / 2
+		}
+		if math.Abs(real(v)-want) > 1e-9 || math.Abs(imag(v)) > 1e-9 {
+			t.Errorf("bin %d = %v, want %v", i, v, want)
+		}
+	}
+}
+
+func TestProcessWaveFiles(t *testing.T) {
+	// Two bursts an hour apart
+	start := time.Date(2020, 3, 4, 12, 0, 0, 0, time.Local)
+	path := waveTestFile(t, waveTestBurst(start), waveTestBurst(start.Add(time.Hour)))
+
+	results, err := processWaveFiles([]string{path}, ensembleFilter{}, waveConfig{samples: 2048, height: waveTestHeight, bin: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("bursts = %d, want 2", len(results))
+	}
+
+	hs := 4 * math.Sqrt(waveTestAmplitude*waveTestAmplitude/2)
+	for _, result := range results {
+		summary := result.Summary
+		if summary.SampleCount != waveTestSamples || summary.SampleInterval != 1 {
+			t.Errorf("samples = %d every %v s, want %d every 1 s", summary.SampleCount, summary.SampleInterval, waveTestSamples)
+		}
+		if summary.Source != waveSourceRange {
+			t.Errorf("source = %s, want %s", summary.Source, waveSourceRange)
+		}
+		if math.Abs(summary.WaterDepth-waveTestDepth) > 0.01 {
+			t.Errorf("depth = %v, want %v", summary.WaterDepth, waveTestDepth)
+		}
+		if math.Abs(summary.Hs-hs) > 0.02*hs {
+			t.Errorf("Hs = %v, want %v", summary.Hs, hs)
+		}
+		if math.Abs(summary.Tp-waveTestPeriod) > 0.01 {
+			t.Errorf("Tp = %v, want %v", summary.Tp, waveTestPeriod)
+		}
+		if !summary.Directional || math.Abs(summary.Dp-waveTestFrom) > 1 {
+			t.Errorf("Dp = %v, want %v", summary.Dp, waveTestFrom)
+		}
+
+		// Each time series has the same wave height
+		spectrum := result.Spectrum
+		for name, s := range map[string][]float64{
+			"range":    spectrum.RangeSpectrum,
+			"pressure": spectrum.PressureSpectrum,
+			"velocity": spectrum.VelocitySpectrum,
+		} {
+			if got := significantHeight(spectrum.Frequency, s, 1); math.Abs(got-hs) > 0.05*hs {
+				t.Errorf("%s Hs = %v, want %v", name, got, hs)
+			}
+		}
+	}
+}
+
+func TestWaveProcessorBurst(t *testing.T) {
+	processor := newWaveProcessor(waveConfig{samples: 512, height: waveTestHeight, bin: -1})
+
+	var results []waveResult
+	for _, ens := range waveTestBurst(time.Date(2020, 3, 4, 12, 0, 0, 0, time.Local)) {
+		results = append(results, processor.add(ens)...)
+	}
+	if len(results) != 2 {
+		t.Fatalf("bursts = %d, want 2", len(results))
+	}
+	if len(processor.flush()) != 0 {
+		t.Error("burst left after the full bursts")
+	}
+
+	key := adcpKey(results[1].Summary.SerialNum, results[1].Summary.SubsystemConfig)
+	last, ok := processor.result(key)
+	if !ok || !last.Summary.BurstStart.Equal(results[1].Summary.BurstStart) {
+		t.Errorf("last result = %v, want the second burst", last.Summary.BurstStart)
+	}
+}
@@ -24,8 +24,9 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (readWaitTime * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 1024 * 20
+	// Maximum message size allowed from peer.  This is the largest
+	// RTI binary ensemble, so a binary frame can hold a whole ensemble.
+	maxMessageSize = rtiHeaderSize + rtiMaxPayloadSize + rtiChecksumSize
 )
 
 // upgrader sets the buffer sizes for the websocket.
@@ -46,6 +47,9 @@ type websocketConn struct {
 
 	// ADCP Serial Number to associate with the websocket connection
 	adcpSerialNum string
+
+	// Reassemble the RTI binary or PD0 ensembles
+	codec ensembleCodec
 }
 
 // reader is a Websocket reader
@@ -63,7 +67,7 @@ func (wsConn *websocketConn) reader() {
 
 	for {
 		// Block until a message is received from the websocket
-		_, message, err := wsConn.ws.ReadMessage()
+		mt, message, err := wsConn.ws.ReadMessage()
 		if err != nil {
 			if err == io.EOF {
 				// Connection is closed with EOF so return
@@ -76,7 +80,18 @@ func (wsConn *websocketConn) reader() {
 		}
 
 		log.Printf("Websocket message: %d", len(message))
-		server.broadcast <- message
+
+		// Text frames are JSON ensembles.  Binary frames are the RTI binary
+		// or PD0 stream and are only given to the codec, because an ensemble
+		// split across frames can continue with any byte.
+		switch mt {
+		case websocket.TextMessage:
+			server.broadcast <- message
+		case websocket.BinaryMessage:
+			for _, ens := range wsConn.codec.add(message) {
+				server.ensembles <- ens
+			}
+		}
 	}
 
 }